@@ -1,28 +1,45 @@
 package main
 
 import (
-	"os"
-	"strconv"
+	"./service"
 )
 
 type args struct {
-	Interval      int
-	Retry         int
-	RetryInterval int
+	Interval          int
+	Retry             int
+	RetryInterval     int
+	MaxPerCycle       int
+	MaxInterval       int
+	RemoveGrace       int
+	StartupGrace      int
+	InitialDelay      int
+	MaxRemoveFraction float64
+	CooldownChanges   int
+	CooldownInterval  int
+	RenotifyInterval  int
 }
 
+// getArgs reads the arguments of the listener from environment variables.
+// Intervals are at least a second so that Docker and BigIp are not polled in a busy loop,
+// and there is at least one attempt to send a notification.
 func getArgs() *args {
 	return &args{
-		Interval:      getValue(5, "DF_INTERVAL"),
-		Retry:         getValue(1, "DF_RETRY"),
-		RetryInterval: getValue(0, "DF_RETRY_INTERVAL"),
+		Interval:          service.GetValueInRange(5, 1, service.UNBOUNDED, "DF_INTERVAL"),
+		Retry:             service.GetValueInRange(1, 1, service.UNBOUNDED, "DF_RETRY"),
+		RetryInterval:     getValue(0, "DF_RETRY_INTERVAL"),
+		MaxPerCycle:       getValue(0, "DF_MAX_PER_CYCLE"),
+		MaxInterval:       service.GetValueInRange(300, 1, service.UNBOUNDED, "DF_MAX_INTERVAL"),
+		RemoveGrace:       getValue(0, "DF_REMOVE_GRACE"),
+		StartupGrace:      getValue(0, "DF_STARTUP_GRACE"),
+		InitialDelay:      getValue(0, "DF_INITIAL_DELAY"),
+		MaxRemoveFraction: service.GetFloatValueInRange(0, 0, 1, "DF_MAX_REMOVE_FRACTION"),
+		CooldownChanges:   getValue(0, "DF_COOLDOWN_CHANGES"),
+		CooldownInterval:  getValue(60, "DF_COOLDOWN_INTERVAL"),
+		RenotifyInterval:  getValue(0, "DF_RENOTIFY_INTERVAL"),
 	}
 }
 
+// getValue returns the non-negative number of the environment variable, or defValue when it is not set
 func getValue(defValue int, varName string) int {
-	value := defValue
-	if len(os.Getenv(varName)) > 0 {
-		value, _ = strconv.Atoi(os.Getenv(varName))
-	}
-	return value
+	return service.GetValueInRange(defValue, 0, service.UNBOUNDED, varName)
 }
@@ -27,6 +27,8 @@ func (s *ArgsTestSuite) Test_GetArgs_ReturnsDefaultValues() {
 	s.Equal(5, args.Interval)
 	s.Equal(1, args.Retry)
 	s.Equal(0, args.RetryInterval)
+	s.Equal(0, args.MaxPerCycle)
+	s.Equal(300, args.MaxInterval)
 }
 
 func (s *ArgsTestSuite) Test_GetArgs_ReturnsIntervalFromEnv() {
@@ -61,3 +63,143 @@ func (s *ArgsTestSuite) Test_GetArgs_ReturnsRetryIntervalFromEnv() {
 
 	s.Equal(expected, args.RetryInterval)
 }
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsMaxPerCycleFromEnv() {
+	expected := rand.Int()
+	maxOrig := os.Getenv("DF_MAX_PER_CYCLE")
+	defer func() { os.Setenv("DF_MAX_PER_CYCLE", maxOrig) }()
+	os.Setenv("DF_MAX_PER_CYCLE", strconv.Itoa(expected))
+
+	args := getArgs()
+
+	s.Equal(expected, args.MaxPerCycle)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsMaxIntervalFromEnv() {
+	expected := rand.Int()
+	maxOrig := os.Getenv("DF_MAX_INTERVAL")
+	defer func() { os.Setenv("DF_MAX_INTERVAL", maxOrig) }()
+	os.Setenv("DF_MAX_INTERVAL", strconv.Itoa(expected))
+
+	args := getArgs()
+
+	s.Equal(expected, args.MaxInterval)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsRemoveGraceFromEnv() {
+	expected := rand.Int()
+	graceOrig := os.Getenv("DF_REMOVE_GRACE")
+	defer func() { os.Setenv("DF_REMOVE_GRACE", graceOrig) }()
+	os.Setenv("DF_REMOVE_GRACE", strconv.Itoa(expected))
+
+	args := getArgs()
+
+	s.Equal(expected, args.RemoveGrace)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsStartupGraceFromEnv() {
+	expected := rand.Int()
+	graceOrig := os.Getenv("DF_STARTUP_GRACE")
+	defer func() { os.Setenv("DF_STARTUP_GRACE", graceOrig) }()
+	os.Setenv("DF_STARTUP_GRACE", strconv.Itoa(expected))
+
+	args := getArgs()
+
+	s.Equal(expected, args.StartupGrace)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsInitialDelayFromEnv() {
+	expected := rand.Int()
+	delayOrig := os.Getenv("DF_INITIAL_DELAY")
+	defer func() { os.Setenv("DF_INITIAL_DELAY", delayOrig) }()
+	os.Setenv("DF_INITIAL_DELAY", strconv.Itoa(expected))
+
+	args := getArgs()
+
+	s.Equal(expected, args.InitialDelay)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsMaxRemoveFractionFromEnv() {
+	fractionOrig := os.Getenv("DF_MAX_REMOVE_FRACTION")
+	defer func() { os.Setenv("DF_MAX_REMOVE_FRACTION", fractionOrig) }()
+	os.Setenv("DF_MAX_REMOVE_FRACTION", "0.5")
+
+	args := getArgs()
+
+	s.Equal(0.5, args.MaxRemoveFraction)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsCooldownFromEnv() {
+	changesOrig := os.Getenv("DF_COOLDOWN_CHANGES")
+	intervalOrig := os.Getenv("DF_COOLDOWN_INTERVAL")
+	defer func() {
+		os.Setenv("DF_COOLDOWN_CHANGES", changesOrig)
+		os.Setenv("DF_COOLDOWN_INTERVAL", intervalOrig)
+	}()
+	os.Setenv("DF_COOLDOWN_CHANGES", "20")
+	os.Setenv("DF_COOLDOWN_INTERVAL", "120")
+
+	args := getArgs()
+
+	s.Equal(20, args.CooldownChanges)
+	s.Equal(120, args.CooldownInterval)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ReturnsRenotifyIntervalFromEnv() {
+	intervalOrig := os.Getenv("DF_RENOTIFY_INTERVAL")
+	defer func() { os.Setenv("DF_RENOTIFY_INTERVAL", intervalOrig) }()
+	os.Setenv("DF_RENOTIFY_INTERVAL", "3600")
+
+	args := getArgs()
+
+	s.Equal(3600, args.RenotifyInterval)
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_ClampsValuesOutOfRange() {
+	tests := []struct {
+		varName string
+		value   string
+		get     func(a *args) interface{}
+		clamped interface{}
+	}{
+		{"DF_INTERVAL", "0", func(a *args) interface{} { return a.Interval }, 1},
+		{"DF_INTERVAL", "-5", func(a *args) interface{} { return a.Interval }, 1},
+		{"DF_RETRY", "0", func(a *args) interface{} { return a.Retry }, 1},
+		{"DF_RETRY", "-1", func(a *args) interface{} { return a.Retry }, 1},
+		{"DF_RETRY_INTERVAL", "-1", func(a *args) interface{} { return a.RetryInterval }, 0},
+		{"DF_MAX_INTERVAL", "0", func(a *args) interface{} { return a.MaxInterval }, 1},
+		{"DF_REMOVE_GRACE", "-10", func(a *args) interface{} { return a.RemoveGrace }, 0},
+		{"DF_MAX_REMOVE_FRACTION", "-0.5", func(a *args) interface{} { return a.MaxRemoveFraction }, 0.0},
+		{"DF_MAX_REMOVE_FRACTION", "1.5", func(a *args) interface{} { return a.MaxRemoveFraction }, 1.0},
+	}
+	for _, t := range tests {
+		orig := os.Getenv(t.varName)
+		os.Setenv(t.varName, t.value)
+
+		actual := t.get(getArgs())
+
+		s.Equal(t.clamped, actual, "%s=%s", t.varName, t.value)
+		os.Setenv(t.varName, orig)
+	}
+}
+
+func (s *ArgsTestSuite) Test_GetArgs_Panics_WhenValueIsNotANumber() {
+	for _, varName := range []string{"DF_INTERVAL", "DF_RETRY", "DF_MAX_INTERVAL", "DF_MAX_PER_CYCLE", "DF_MAX_REMOVE_FRACTION"} {
+		orig := os.Getenv(varName)
+		os.Setenv(varName, "five")
+
+		s.Panics(func() { getArgs() }, varName)
+		os.Setenv(varName, orig)
+	}
+}
+
+func (s *ArgsTestSuite) Test_GetValue_ClampsNegativeValues() {
+	defer os.Unsetenv("DF_BIGIP_GET_TIMEOUT")
+	os.Setenv("DF_BIGIP_GET_TIMEOUT", "-3")
+
+	s.Equal(0, getValue(10, "DF_BIGIP_GET_TIMEOUT"))
+
+	os.Setenv("DF_BIGIP_GET_TIMEOUT", " 3 ")
+
+	s.Equal(3, getValue(10, "DF_BIGIP_GET_TIMEOUT"))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecord is a routing change as it is written to the audit log
+type auditRecord struct {
+	Action    string    `json:"action"`
+	Service   string    `json:"service,omitempty"`
+	ServiceID string    `json:"serviceId"`
+	Paths     []string  `json:"paths,omitempty"`
+	Domains   []string  `json:"domains,omitempty"`
+	DataGroup string    `json:"dataGroup"`
+	BigIp     string    `json:"bigIp"`
+	Ts        time.Time `json:"ts"`
+}
+
+// auditLog writes a JSON line per routing change, apart from the general log.
+// It is safe for concurrent use.
+type auditLog struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// newAuditLogFromEnv returns the audit log set with `DF_AUDIT_LOG`, either `stdout` or the path of a file.
+// It returns nil when the audit log is disabled.
+func newAuditLogFromEnv() *auditLog {
+	target := os.Getenv("DF_AUDIT_LOG")
+	if len(target) == 0 {
+		return nil
+	}
+	if strings.EqualFold(target, "stdout") {
+		return &auditLog{w: os.Stdout}
+	}
+	f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	checkErr(err)
+	return &auditLog{w: f}
+}
+
+// write writes the records, one JSON line each
+func (a *auditLog) write(records []auditRecord) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	encoder := json.NewEncoder(a.w)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			logPrintf("ERROR: Unable to write audit record: %s", err.Error())
+		}
+	}
+}
+
+// getAuditRecords returns the records of the change of the routes of a service.
+// Routes that changed are recorded as removed and then added.
+func getAuditRecords(serviceID string, before, after ServiceRoutes, getDataGroup func(ServiceRoutes) string, bigIp string) []auditRecord {
+	if sameRoutes(before, after) {
+		return nil
+	}
+	now := time.Now()
+	records := []auditRecord{}
+	if len(before.Paths) > 0 || len(before.Domains) > 0 {
+		records = append(records, auditRecord{Action: "remove", Service: before.Name, ServiceID: serviceID, Paths: before.Paths, Domains: before.Domains, DataGroup: getDataGroup(before), BigIp: bigIp, Ts: now})
+	}
+	if len(after.Paths) > 0 || len(after.Domains) > 0 {
+		records = append(records, auditRecord{Action: "add", Service: after.Name, ServiceID: serviceID, Paths: after.Paths, Domains: after.Domains, DataGroup: getDataGroup(after), BigIp: bigIp, Ts: now})
+	}
+	return records
+}
+
+// sameRoutes tells whether the routes are the same. A renewed expiry is not a change.
+func sameRoutes(a, b ServiceRoutes) bool {
+	return strings.Join(a.Paths, ",") == strings.Join(b.Paths, ",") &&
+		strings.Join(a.Domains, ",") == strings.Join(b.Domains, ",") &&
+		(a.Data == b.Data || (a.TTL > 0 && a.TTL == b.TTL && a.BaseData == b.BaseData)) &&
+		a.DataGroup == b.DataGroup
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -9,22 +11,81 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"./metrics"
 	"./service"
 )
 
 const (
-	DG_PATH            = "/mgmt/tm/ltm/data-group/internal/"
-	SERVICE_PATH_LABEL = "com.df.servicePath"
-	BIGIP_HEADER       = "X-f5key"
-	BIGIP_KEY_FILE     = "/run/secrets/bigip-key"
+	DG_PATH              = "/mgmt/tm/ltm/data-group/internal/"
+	SERVICE_PATH_LABEL   = "com.df.servicePath"
+	SERVICE_DOMAIN_LABEL = "com.df.serviceDomain"
+	SERVICE_PORT_LABEL   = "com.df.port"
+	// Data group the paths of a service are written to instead of the data group from config
+	SERVICE_DATA_GROUP_LABEL = "com.df.bigipDataGroup"
+	PORT_TEMPLATE            = "{{.Data}}:{{.Port}}"
+	BIGIP_HEADER             = "X-f5key"
+	BIGIP_KEY_SECRET         = "bigip-key"
+	PATH_DELIMITER           = ","
+	// Time to live of the records of a service, in seconds or as a duration such as `1h`
+	SERVICE_TTL_LABEL = "com.df.bigipTTL"
+	TTL_TEMPLATE      = "{{.Data}}|expires={{.Expires}}"
+	// Separates the data of a record from the owner of the record
+	OWNER_DELIMITER = "|owner="
+	// Prefixes the cache keys of routes adopted from the data group, which belong to no known service
+	ADOPTED_PREFIX = "adopted:"
+	// Number of times a rate-limited BigIp request is retried
+	BIGIP_RATE_LIMIT_RETRIES      = 3
+	BIGIP_MAX_IDLE_CONNS          = 100
+	BIGIP_MAX_IDLE_CONNS_PER_HOST = 10
+	BIGIP_IDLE_CONN_TIMEOUT       = 90
+	BIGIP_MAX_CONCURRENCY         = 0
+	BIGIP_CONFLICT_RETRIES        = 3
+	// Internal data groups hold their records, external data groups reference a records file
+	GROUP_TYPE_INTERNAL = "internal"
+	GROUP_TYPE_EXTERNAL = "external"
+	FILE_UPLOAD_PATH    = "/mgmt/shared/file-transfer/uploads/"
+	FILE_UPLOAD_DIR     = "/var/config/rest/downloads/"
+	FILE_DG_PATH        = "/mgmt/tm/sys/file/data-group/"
+	// Records are written as an array of name and data objects, or as an object of data by name
+	RECORD_FORMAT_ARRAY = "array"
+	RECORD_FORMAT_MAP   = "map"
 )
 
 type Config struct {
 	Host        string `json:"BIGIP_HOST"`
 	DataGroup   string `json:"BIGIP_DG"`
 	PoolPattern string `json:"BIGIP_RWP"`
+	// Optional settings that override the environment variables when present
+	Timeout configInt `json:"BIGIP_TIMEOUT,omitempty"`
+	Retry   configInt `json:"BIGIP_RETRY,omitempty"`
+	// Comma-separated notification addresses that are preferred over the environment variables at startup
+	NotifyCreateServiceUrl string `json:"NOTIFY_CREATE_SERVICE_URL,omitempty"`
+	NotifyRemoveServiceUrl string `json:"NOTIFY_REMOVE_SERVICE_URL,omitempty"`
+}
+
+// configInt is a number of the config API, given either as a JSON number or as a string
+type configInt int
+
+func (c *configInt) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if len(value) == 0 || value == "null" {
+		*c = 0
+		return nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("Invalid number %s", string(data))
+	}
+	*c = configInt(i)
+	return nil
 }
 
 type Record struct {
@@ -32,137 +93,1106 @@ type Record struct {
 	Data string `json:"data,omitempty"`
 }
 
+// DataGroupDrift lists the differences between the records of a data group in BigIp and the cached routes
+type DataGroupDrift struct {
+	DataGroup string          `json:"dataGroup"`
+	Untracked []Record        `json:"untracked"`
+	Missing   []MissingRecord `json:"missing"`
+}
+
+// MissingRecord is a record of the cached routes of a service that is not in BigIp
+type MissingRecord struct {
+	ServiceID string `json:"serviceId"`
+	Service   string `json:"service,omitempty"`
+	Record
+}
+
 type DataGroup struct {
 	Records []Record `json:"records,omitempty"`
+	version string
+}
+
+// versionConflictError is returned when the data group changed between reading and writing it
+type versionConflictError struct {
+	url string
+}
+
+func (e *versionConflictError) Error() string {
+	return fmt.Sprintf("ERROR: Data group %s was modified since it was read", e.url)
+}
+
+// bigIpAuthError is returned when BigIp rejects the configured key
+type bigIpAuthError struct {
+	url        string
+	statusCode int
+}
+
+func (e *bigIpAuthError) Error() string {
+	return fmt.Sprintf("ERROR: Request %s was not authorized, status code %d", e.url, e.statusCode)
+}
+
+// ServiceRoutes is the cached state of the records added for a service
+type ServiceRoutes struct {
+	Paths     []string  `json:"paths"`
+	Domains   []string  `json:"domains,omitempty"`
+	Data      string    `json:"data"`
+	DataGroup string    `json:"dataGroup,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	AddedAt   time.Time `json:"addedAt"`
+	// Routes with a time to live carry their expiry in Data, which is renewed before half of the time to live is left
+	TTL       int    `json:"ttl,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	BaseData  string `json:"baseData,omitempty"`
 }
 
+// BigIp routes services through data groups.
+// updateLock serializes the updates of the routes with the refresh of the config,
+// so the data group urls, the pattern and the timeouts are read under it.
 type BigIp struct {
-	Url      string
-	Key      string
-	Services map[string][]string
-	Pattern  string
-	Client   *http.Client
+	Host             string
+	Url              string
+	DomainUrl        string
+	Key              string
+	KeyFile          string
+	KeyHeader        string
+	Services         map[string]ServiceRoutes
+	CacheFile        string
+	CompressCache    bool
+	AdoptRecords     bool
+	Pattern          string
+	PathDelimiter    string
+	PathSource       string
+	DataTemplate     *template.Template
+	PortTemplate     *template.Template
+	TTLTemplate      *template.Template
+	GetTimeout       time.Duration
+	PutTimeout       time.Duration
+	RateLimitRetries int
+	Authoritative    bool
+	Owner            string
+	MinWriteInterval time.Duration
+	PayloadEnvelope  string
+	PrettyPayload    bool
+	HostPaths        bool
+	WarnMissingPath  bool
+	GroupType        string
+	RecordFormat     string
+	ExcludePaths     []string
+	PathInclude      *regexp.Regexp
+	ConfigApi        string
+	ConfigRefresh    time.Duration
+	configApiTimeout time.Duration
+	config           Config
+	configReadAt     time.Time
+	domainDataGroup  string
+	adoptedUrls      map[string]bool
+	audit            *auditLog
+	errorLog         *service.LogDeduper
+	nameTransforms   []recordNameTransform
+	patternFromEnv   bool
+	defaultPattern   string
+	envGetTimeout    time.Duration
+	envPutTimeout    time.Duration
+	envRetries       int
+	MaxConcurrency   int
+	inFlight         chan struct{}
+	Client           *http.Client
+	lock             sync.RWMutex
+	keyLock          sync.RWMutex
+	updateLock       sync.Mutex
+	lastWrite        time.Time
+	pendingAdded     []service.SwarmService
+	pendingRemoved   []string
 }
 
 type BigIpClient interface {
 	AddRoutes(services *[]service.SwarmService) error
 	RemoveRoutes(services *[]string) error
+	Reconcile(added *[]service.SwarmService, removed *[]string) error
+	RefreshConfig() error
+	RemovePathRecords(paths []string) error
+	GetRoutes() map[string]ServiceRoutes
+	GetDrift() ([]DataGroupDrift, error)
+	ClearRoutes()
+}
+
+// noopBigIp satisfies BigIpClient when BigIp integration is disabled
+type noopBigIp struct{}
+
+func (n noopBigIp) AddRoutes(services *[]service.SwarmService) error {
+	return nil
+}
+
+func (n noopBigIp) RemoveRoutes(services *[]string) error {
+	return nil
 }
 
+func (n noopBigIp) Reconcile(added *[]service.SwarmService, removed *[]string) error {
+	return nil
+}
+
+func (n noopBigIp) RefreshConfig() error {
+	return nil
+}
+
+func (n noopBigIp) RemovePathRecords(paths []string) error {
+	return nil
+}
+
+func (n noopBigIp) GetRoutes() map[string]ServiceRoutes {
+	return map[string]ServiceRoutes{}
+}
+
+func (n noopBigIp) GetDrift() ([]DataGroupDrift, error) {
+	return []DataGroupDrift{}, nil
+}
+
+func (n noopBigIp) ClearRoutes() {}
+
+// Returns a copy of the cached service routes
+func (b *BigIp) GetRoutes() map[string]ServiceRoutes {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	routes := make(map[string]ServiceRoutes, len(b.Services))
+	for id, r := range b.Services {
+		routes[id] = r
+	}
+	return routes
+}
+
+// Empties the route cache so that routes of running services are added again.
+// Records in BigIp are left as they are.
+func (b *BigIp) ClearRoutes() {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	b.lock.Lock()
+	b.Services = map[string]ServiceRoutes{}
+	b.lock.Unlock()
+	b.saveCache()
+}
+
+// Adds the routes of services to BigIP and cache
 func (b *BigIp) AddRoutes(services *[]service.SwarmService) error {
+	return b.Reconcile(services, &[]string{})
+}
+
+// From a list of SwarmService structs, removes the services from BigIP and cached
+func (b *BigIp) RemoveRoutes(services *[]string) error {
+	return b.Reconcile(&[]service.SwarmService{}, services)
+}
+
+// Adds the routes of added services and removes the routes of removed services.
+// Each data group is read and updated once, regardless of the number of services.
+// In authoritative mode, data groups are overwritten with the records of all cached routes,
+// even when there are no changes, so that records written by anyone else are removed.
+//
+// With a minimum write interval, changes made within the interval of the previous write are
+// accumulated and written together by the first call after the interval elapses.
+// Updates of the routes are serialized, so that the cache is not read while another update changes it.
+func (b *BigIp) Reconcile(added *[]service.SwarmService, removed *[]string) error {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	if b.MinWriteInterval <= 0 {
+		return b.reconcile(added, removed)
+	}
+	b.queueChanges(added, removed)
+	if time.Since(b.lastWrite) < b.MinWriteInterval {
+		if len(b.pendingAdded) > 0 || len(b.pendingRemoved) > 0 {
+			log.Printf("Deferring BigIp changes of %d services until %s", len(b.pendingAdded)+len(b.pendingRemoved), b.lastWrite.Add(b.MinWriteInterval).Format(time.RFC3339))
+		}
+		return nil
+	}
+	pendingAdded, pendingRemoved := b.pendingAdded, b.pendingRemoved
+	b.pendingAdded, b.pendingRemoved = nil, nil
+	if len(pendingAdded) > 0 || len(pendingRemoved) > 0 || b.Authoritative {
+		b.lastWrite = time.Now()
+	}
+	return b.reconcile(&pendingAdded, &pendingRemoved)
+}
+
+// Accumulates changes until the next write.
+// A removed service is no longer added and only the latest change of an added service is kept.
+func (b *BigIp) queueChanges(added *[]service.SwarmService, removed *[]string) {
+	for _, s := range *added {
+		b.pendingAdded = removePendingService(b.pendingAdded, s.Service.ID)
+		b.pendingAdded = append(b.pendingAdded, s)
+	}
+	for _, id := range *removed {
+		b.pendingAdded = removePendingService(b.pendingAdded, id)
+		b.pendingRemoved = append(b.pendingRemoved, id)
+	}
+}
+
+func removePendingService(services []service.SwarmService, id string) []service.SwarmService {
+	kept := []service.SwarmService{}
+	for _, s := range services {
+		if s.Service.ID != id {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+func (b *BigIp) reconcile(added *[]service.SwarmService, removed *[]string) error {
+	changed := map[string]bool{}
+	for _, s := range *added {
+		changed[s.Service.ID] = true
+	}
+	for _, id := range *removed {
+		changed[id] = true
+	}
+	renewed := b.getExpiringRoutes(changed)
+	if len(*added) == 0 && len(*removed) == 0 && len(renewed) == 0 && !b.Authoritative {
+		return nil
+	}
 	errs := []error{}
-	for _, s := range *services {
-		//If servicepath label exists
-		if label, ok := s.Service.Spec.Labels[SERVICE_PATH_LABEL]; ok {
-			//There might be multiple paths for a service
-			label = strings.ToLower(label)
-			paths := strings.Split(label, ",")
-			log.Printf("Adding %v to %s", paths, b.Url)
-			err := b.updateDataGroup(paths, false)
-			if err != nil {
-				log.Printf("%s", err.Error())
-				errs = append(errs, err)
-			} else {
-				//Add service to cache
-				b.Services[s.Service.ID] = paths
+	//Path records are grouped by the url of their data group
+	pathAdd, pathRemove := map[string][]Record{}, map[string][]Record{}
+	domainAdd, domainRemove := []Record{}, []Record{}
+	updates := map[string]ServiceRoutes{}
+	for _, id := range *removed {
+		if cached, ok := b.Services[id]; ok {
+			pathUrl := b.getPathUrl(cached)
+			log.Printf("Removing %v from %s", append(cached.Paths, cached.Domains...), pathUrl)
+			pathRemove[pathUrl] = append(pathRemove[pathUrl], b.getRecords(cached.Paths, cached.Data)...)
+			domainRemove = append(domainRemove, b.getRecords(cached.Domains, cached.Data)...)
+			updates[id] = ServiceRoutes{}
+		}
+	}
+	for _, s := range *added {
+		routes, ok, err := b.buildRoutes(s)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			errs = append(errs, err)
+			continue
+		}
+		//Records of an updated service are replaced
+		if cached, ok := b.Services[s.Service.ID]; ok {
+			cachedUrl := b.getPathUrl(cached)
+			pathRemove[cachedUrl] = append(pathRemove[cachedUrl], b.getRecords(cached.Paths, cached.Data)...)
+			domainRemove = append(domainRemove, b.getRecords(cached.Domains, cached.Data)...)
+			routes.AddedAt = cached.AddedAt
+		}
+		if ok {
+			pathUrl := b.getPathUrl(routes)
+			if b.AdoptRecords {
+				b.adoptDataGroup(pathUrl, routes.DataGroup, false)
+			}
+			log.Printf("Adding %v to %s", append(routes.Paths, routes.Domains...), pathUrl)
+			pathAdd[pathUrl] = append(pathAdd[pathUrl], b.getRecords(routes.Paths, routes.Data)...)
+			domainAdd = append(domainAdd, b.getRecords(routes.Domains, routes.Data)...)
+		}
+		updates[s.Service.ID] = routes
+	}
+	//Records with a renewed expiry replace the records with the same names
+	for id, routes := range renewed {
+		pathUrl := b.getPathUrl(routes)
+		pathAdd[pathUrl] = append(pathAdd[pathUrl], b.getRecords(routes.Paths, routes.Data)...)
+		domainAdd = append(domainAdd, b.getRecords(routes.Domains, routes.Data)...)
+		updates[id] = routes
+	}
+	pathErrs := map[string]error{}
+	var domainErr error
+	//Records of external data groups cannot be read, so they are always written in full
+	if b.Authoritative || b.GroupType == GROUP_TYPE_EXTERNAL {
+		pathRecords, domainRecords := b.getDesiredRecords(updates)
+		for _, url := range sortedUrls(pathRecords) {
+			if err := b.replaceDataGroup(url, pathRecords[url]); err != nil {
+				pathErrs[url] = err
+			}
+		}
+		domainErr = b.replaceDataGroup(b.DomainUrl, domainRecords)
+	} else {
+		urls := sortedUrls(pathAdd, pathRemove)
+		for _, url := range urls {
+			if err := b.updateDataGroup(url, pathAdd[url], pathRemove[url]); err != nil {
+				pathErrs[url] = err
 			}
 		}
+		domainErr = b.updateDataGroup(b.DomainUrl, domainAdd, domainRemove)
+		if len(pathErrs) == 0 && domainErr != nil {
+			for _, url := range urls {
+				if b.rollbackDataGroup(url, pathAdd[url], pathRemove[url]) {
+					pathErrs[url] = domainErr
+				}
+			}
+		}
+	}
+	for _, err := range pathErrs {
+		b.errorLog.Printf("%s", err.Error())
+		errs = append(errs, err)
+	}
+	if domainErr != nil {
+		b.errorLog.Printf("%s", domainErr.Error())
+		errs = append(errs, domainErr)
+	}
+	if len(pathErrs) == 0 && domainErr == nil {
+		b.errorLog.Reset()
+	}
+	//Update cache with the changes that were written, keeping previous routes of failed data groups
+	audit := []auditRecord{}
+	b.lock.Lock()
+	for id, routes := range updates {
+		cached := b.Services[id]
+		if (len(cached.Paths) > 0 && pathErrs[b.getPathUrl(cached)] != nil) || (len(routes.Paths) > 0 && pathErrs[b.getPathUrl(routes)] != nil) {
+			routes.Paths = cached.Paths
+			routes.DataGroup = cached.DataGroup
+		}
+		if domainErr != nil {
+			routes.Domains = cached.Domains
+		}
+		audit = append(audit, getAuditRecords(id, cached, routes, b.getDataGroupName, b.Host)...)
+		if len(routes.Paths) == 0 && len(routes.Domains) == 0 {
+			delete(b.Services, id)
+			continue
+		}
+		if routes.AddedAt.IsZero() {
+			routes.AddedAt = time.Now()
+		}
+		b.Services[id] = routes
 	}
+	b.releaseAdopted(updates)
+	b.lock.Unlock()
+	b.saveCache()
+	b.audit.write(audit)
 	if len(errs) > 0 {
-		return fmt.Errorf("Adding routes for at least one of the service failed")
+		return fmt.Errorf("Updating routes for at least one of the service failed")
 	}
 	return nil
 }
 
-// From a list of SwarmService structs, removes the services from BigIP and cached
-func (b *BigIp) RemoveRoutes(services *[]string) error {
-	errs := []error{}
-	for _, s := range *services {
-		if paths, ok := b.Services[s]; ok {
-			log.Printf("Removing %v from %s", paths, b.Url)
-			err := b.updateDataGroup(paths, true)
-			if err != nil {
-				log.Printf("%s", err.Error())
-				errs = append(errs, err)
-			} else {
-				//Delete from cache
-				delete(b.Services, s)
+// Returns the name of the data group the paths of the routes are written to
+func (b *BigIp) getDataGroupName(routes ServiceRoutes) string {
+	if len(routes.DataGroup) == 0 {
+		return b.config.DataGroup
+	}
+	return routes.DataGroup
+}
+
+// Returns the url of the data group the paths of the routes are written to.
+// Routes without a data group of their own use the data group from config.
+func (b *BigIp) getPathUrl(routes ServiceRoutes) string {
+	if len(routes.DataGroup) == 0 {
+		return b.Url
+	}
+	return getDataGroupUrl(b.Host, routes.DataGroup)
+}
+
+// Returns the urls of the maps sorted, so that data groups are always written in the same order
+func sortedUrls(records ...map[string][]Record) []string {
+	urls := []string{}
+	for _, m := range records {
+		for url := range m {
+			if !containsPath(urls, url) {
+				urls = append(urls, url)
 			}
 		}
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("Removing routes for at least one of the service failed")
+	sort.Strings(urls)
+	return urls
+}
+
+// Reverts an update of a data group so that routes are not left half written when a later update fails.
+// Returns true when the data group was reverted.
+func (b *BigIp) rollbackDataGroup(url string, added []Record, removed []Record) bool {
+	if len(added) == 0 && len(removed) == 0 {
+		return false
+	}
+	log.Printf("Rolling back the update of %s", url)
+	if err := b.updateDataGroup(url, removed, added); err != nil {
+		log.Printf("ERROR: Unable to roll back the update of %s \n %s", url, err.Error())
+		metrics.RecordError("RollbackDataGroup")
+		return false
+	}
+	return true
+}
+
+// Compares the records of the data groups in BigIp with the cached routes.
+// Records of other owners are ignored. A record whose data differs from the cached routes
+// is reported as untracked and the record of the cached routes as missing.
+func (b *BigIp) GetDrift() ([]DataGroupDrift, error) {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	if b.GroupType == GROUP_TYPE_EXTERNAL {
+		return nil, fmt.Errorf("Records of external data groups cannot be compared")
+	}
+	expected := map[string]map[string]MissingRecord{}
+	dataGroups := map[string]string{}
+	track := func(url, dataGroup string) {
+		if _, ok := expected[url]; !ok && len(url) > 0 {
+			expected[url] = map[string]MissingRecord{}
+			dataGroups[url] = dataGroup
+		}
+	}
+	track(b.Url, b.config.DataGroup)
+	track(b.DomainUrl, b.domainDataGroup)
+	for id, routes := range b.GetRoutes() {
+		url := b.getPathUrl(routes)
+		track(url, b.getDataGroupName(routes))
+		for _, r := range b.getRecords(routes.Paths, routes.Data) {
+			expected[url][r.Name] = MissingRecord{ServiceID: id, Service: routes.Name, Record: r}
+		}
+		if len(b.DomainUrl) > 0 {
+			for _, r := range b.getRecords(routes.Domains, routes.Data) {
+				expected[b.DomainUrl][r.Name] = MissingRecord{ServiceID: id, Service: routes.Name, Record: r}
+			}
+		}
+	}
+	urls := []string{}
+	for url := range expected {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	drifts := []DataGroupDrift{}
+	for _, url := range urls {
+		dg, err := b.getDataGroup(url)
+		if err != nil {
+			return nil, err
+		}
+		drift := DataGroupDrift{DataGroup: dataGroups[url], Untracked: []Record{}, Missing: []MissingRecord{}}
+		found := map[string]bool{}
+		for _, r := range dg.Records {
+			if !b.isOwned(r) {
+				continue
+			}
+			if e, ok := expected[url][r.Name]; ok && e.Data == r.Data {
+				found[r.Name] = true
+				continue
+			}
+			drift.Untracked = append(drift.Untracked, r)
+		}
+		for name, e := range expected[url] {
+			if !found[name] {
+				drift.Missing = append(drift.Missing, e)
+			}
+		}
+		sort.Slice(drift.Missing, func(i, j int) bool { return drift.Missing[i].Name < drift.Missing[j].Name })
+		drifts = append(drifts, drift)
+	}
+	return drifts, nil
+}
+
+// Returns the complete path records, by data group url, and domain records of the cached routes once updates are applied.
+// Data groups that no longer have records are returned empty so that they are cleared.
+// Records are sorted by name so that the data group content does not depend on the order of services.
+func (b *BigIp) getDesiredRecords(updates map[string]ServiceRoutes) (map[string][]Record, []Record) {
+	current := b.GetRoutes()
+	pathRecords := map[string][]Record{b.Url: {}}
+	for _, routes := range current {
+		pathRecords[b.getPathUrl(routes)] = []Record{}
+	}
+	desired := current
+	for id, routes := range updates {
+		desired[id] = routes
+	}
+	domainRecords := []Record{}
+	for _, routes := range desired {
+		url := b.getPathUrl(routes)
+		pathRecords[url] = append(pathRecords[url], b.getRecords(routes.Paths, routes.Data)...)
+		domainRecords = append(domainRecords, b.getRecords(routes.Domains, routes.Data)...)
+	}
+	for _, records := range pathRecords {
+		sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	}
+	sort.Slice(domainRecords, func(i, j int) bool { return domainRecords[i].Name < domainRecords[j].Name })
+	return pathRecords, domainRecords
+}
+
+// Returns the routes of a service built from its labels.
+// The returned bool is false when the service is excluded from routing or has neither path nor domain to route.
+func (b *BigIp) buildRoutes(s service.SwarmService) (ServiceRoutes, bool, error) {
+	if ok, reason := service.ShouldRoute(s, nil); !ok {
+		log.Printf("Service %s is not routed because %s", s.Service.Spec.Name, reason)
+		return ServiceRoutes{}, false, nil
+	}
+	pathLabel, hasPath := b.getServicePath(s)
+	domainLabel, hasDomainLabel := s.Service.Spec.Labels[service.Label(SERVICE_DOMAIN_LABEL)]
+	hasDomain := hasDomainLabel && len(b.DomainUrl) > 0
+	//If servicepath or servicedomain label exists
+	if !hasPath && !hasDomain {
+		b.warnMissingPath(s)
+		return ServiceRoutes{}, false, nil
+	}
+	data, err := b.getData(s)
+	if err != nil {
+		return ServiceRoutes{}, false, err
+	}
+	routes := ServiceRoutes{Data: data, Name: s.Service.Spec.Name}
+	if ttl, ok := b.getTTL(s); ok {
+		routes.TTL = ttl
+		routes.BaseData = data
+		if err := b.setExpiry(&routes, time.Now()); err != nil {
+			return ServiceRoutes{}, false, fmt.Errorf("ERROR: Unable to render TTL template for service %s \n %s", s.Spec.Name, err.Error())
+		}
+	}
+	if dataGroup, ok := s.Service.Spec.Labels[service.Label(SERVICE_DATA_GROUP_LABEL)]; ok {
+		routes.DataGroup = strings.TrimSpace(dataGroup)
+	}
+	if hasPath {
+		//There might be multiple paths for a service
+		routes.Paths = b.filterPaths(s.Service.ID, b.getPaths(pathLabel))
+		if b.HostPaths && hasDomainLabel {
+			routes.Paths = getHostPaths(b.getPaths(domainLabel), routes.Paths)
+		}
+	}
+	if hasDomain {
+		routes.Domains = b.getPaths(domainLabel)
+	}
+	//Routes are cached with the names written to BigIp, so that they are removed by the same names
+	routes.Paths = transformNames(b.nameTransforms, routes.Paths)
+	routes.Domains = transformNames(b.nameTransforms, routes.Domains)
+	if len(routes.Paths) == 0 && len(routes.Domains) == 0 {
+		return ServiceRoutes{}, false, nil
+	}
+	return routes, true, nil
+}
+
+// Returns the time to live, in seconds, set with the `com.df.bigipTTL` label of the service
+func (b *BigIp) getTTL(s service.SwarmService) (int, bool) {
+	value, ok := s.Spec.Labels[service.Label(SERVICE_TTL_LABEL)]
+	if !ok {
+		return 0, false
+	}
+	ttl, err := strconv.Atoi(value)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(value)
+		ttl, err = int(duration/time.Second), durationErr
+	}
+	if err != nil || ttl <= 0 {
+		log.Printf("WARNING: Invalid %s label value %s of the service %s. Its records do not expire", service.Label(SERVICE_TTL_LABEL), value, s.Spec.Name)
+		return 0, false
+	}
+	return ttl, true
+}
+
+// Sets the expiry of routes with a time to live, counted from now, and renders it into their data
+func (b *BigIp) setExpiry(routes *ServiceRoutes, now time.Time) error {
+	expiresAt := now.Add(time.Second * time.Duration(routes.TTL))
+	var buff bytes.Buffer
+	err := b.TTLTemplate.Execute(&buff, struct {
+		Data      string
+		Expires   int64
+		ExpiresAt string
+	}{
+		Data:      routes.BaseData,
+		Expires:   expiresAt.Unix(),
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	routes.Data = buff.String()
+	routes.ExpiresAt = expiresAt.Unix()
+	return nil
+}
+
+// Returns the cached routes, other than those of the skipped services, whose expiry is renewed.
+// Expiries are renewed once less than half of the time to live is left.
+func (b *BigIp) getExpiringRoutes(skip map[string]bool) map[string]ServiceRoutes {
+	now := time.Now()
+	expiring := map[string]ServiceRoutes{}
+	for id, routes := range b.GetRoutes() {
+		if routes.TTL <= 0 || skip[id] || now.Unix() < routes.ExpiresAt-int64(routes.TTL/2) {
+			continue
+		}
+		if err := b.setExpiry(&routes, now); err != nil {
+			log.Printf("ERROR: Unable to renew the expiry of the routes of %s \n %s", id, err.Error())
+			continue
+		}
+		expiring[id] = routes
+	}
+	return expiring
+}
+
+// Logs a warning for a service with routing labels but without path label, so that it is not skipped silently
+func (b *BigIp) warnMissingPath(s service.SwarmService) {
+	if !b.WarnMissingPath {
+		return
+	}
+	for _, label := range []string{SERVICE_PORT_LABEL, SERVICE_DOMAIN_LABEL, SERVICE_DATA_GROUP_LABEL} {
+		if _, ok := s.Service.Spec.Labels[service.Label(label)]; ok {
+			log.Printf("WARNING: Service %s has the %s label but no %s label. It is not routed", s.Service.Spec.Name, service.Label(label), service.Label(SERVICE_PATH_LABEL))
+			metrics.RecordError("MissingPathLabel")
+			return
+		}
+	}
+}
+
+// Drops the paths that are not routed according to service.ShouldRoutePath
+func (b *BigIp) filterPaths(serviceID string, paths []string) []string {
+	included := []string{}
+	for _, p := range paths {
+		if ok, reason := service.ShouldRoutePath(p, b.PathInclude, b.ExcludePaths); !ok {
+			log.Printf("Path %s of service %s is not routed because %s", p, serviceID, reason)
+			continue
+		}
+		included = append(included, p)
+	}
+	return included
+}
+
+// Returns the paths prefixed with each of the domains, e.g. `example.com/api`
+func getHostPaths(domains []string, paths []string) []string {
+	hostPaths := []string{}
+	for _, d := range domains {
+		for _, p := range paths {
+			hostPaths = append(hostPaths, d+p)
+		}
+	}
+	return hostPaths
+}
+
+// Removes the records of the paths from the data groups, whichever service routes them.
+// Only records of this listener are removed. The paths are removed from the cached routes of every service.
+func (b *BigIp) RemovePathRecords(paths []string) error {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	return b.removePathRecords(b.GetRoutes(), []string{b.Url}, paths)
+}
+
+// Removes only the given paths of a service from BigIp and cache, keeping its remaining paths.
+// The service is removed from the cache once it has neither paths nor domains left.
+func (b *BigIp) RemovePaths(serviceID string, paths []string) error {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	b.lock.RLock()
+	cached, ok := b.Services[serviceID]
+	b.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Service %s is not cached", serviceID)
+	}
+	return b.removePathRecords(map[string]ServiceRoutes{serviceID: cached}, []string{}, paths)
+}
+
+// Removes the records of the paths from the data groups of the routes and of the urls,
+// and the paths from the cached routes. The caller holds updateLock.
+func (b *BigIp) removePathRecords(routesByID map[string]ServiceRoutes, urls []string, paths []string) error {
+	remove := []string{}
+	for _, p := range paths {
+		remove = append(remove, strings.ToLower(p))
+	}
+	remove = transformNames(b.nameTransforms, remove)
+	updates := map[string]ServiceRoutes{}
+	for id, routes := range routesByID {
+		if url := b.getPathUrl(routes); !containsPath(urls, url) {
+			urls = append(urls, url)
+		}
+		remaining := []string{}
+		for _, p := range routes.Paths {
+			if !containsPath(remove, p) {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) != len(routes.Paths) {
+			routes.Paths = remaining
+			updates[id] = routes
+		}
+	}
+	sort.Strings(urls)
+	pathErrs := map[string]error{}
+	//Records of external data groups cannot be read, so they are written in full without the paths
+	if b.GroupType == GROUP_TYPE_EXTERNAL {
+		pathRecords, _ := b.getDesiredRecords(updates)
+		for _, url := range sortedUrls(pathRecords) {
+			if err := b.replaceDataGroup(url, pathRecords[url]); err != nil {
+				pathErrs[url] = err
+			}
+		}
+	} else {
+		for _, url := range urls {
+			log.Printf("Removing %v from %s", remove, url)
+			if err := b.updateDataGroup(url, nil, b.getRecords(remove, "")); err != nil {
+				pathErrs[url] = err
+			}
+		}
+	}
+	for _, err := range pathErrs {
+		log.Printf("%s", err.Error())
+	}
+	//Update cache of the services whose data group was written
+	audit := []auditRecord{}
+	b.lock.Lock()
+	for id, routes := range updates {
+		if pathErrs[b.getPathUrl(routes)] != nil {
+			continue
+		}
+		audit = append(audit, getAuditRecords(id, b.Services[id], routes, b.getDataGroupName, b.Host)...)
+		if len(routes.Paths) == 0 && len(routes.Domains) == 0 {
+			delete(b.Services, id)
+			continue
+		}
+		b.Services[id] = routes
+	}
+	b.lock.Unlock()
+	b.saveCache()
+	b.audit.write(audit)
+	if len(pathErrs) > 0 {
+		return fmt.Errorf("Removing paths from at least one of the data groups failed")
 	}
 	return nil
 }
 
-func (b *BigIp) updateDataGroup(paths []string, remove bool) error {
+// Removes and then adds records with a single read and write of the data group.
+// Records are matched by name on removal, so their data does not need to match the data group.
+// Records with the name of an added record are replaced, e.g. when routes are added again after the cache was cleared.
+func (b *BigIp) updateDataGroup(url string, add []Record, remove []Record) error {
+	if len(url) == 0 || (len(add) == 0 && len(remove) == 0) {
+		return nil
+	}
+	return b.modifyDataGroup(url, func(records []Record) []Record {
+		//Remove records from unmarshalled struct
+		records = b.removeRecords(records, remove)
+		records = b.removeRecords(records, add)
+		//Append records to unmarshalled struct
+		return b.appendRecords(url, records, add)
+	})
+}
+
+// Appends the added records, except those whose name is taken by a record of another owner.
+// Such records are kept and the added ones are skipped, so that the data group never holds the same name twice.
+func (b *BigIp) appendRecords(url string, records []Record, add []Record) []Record {
+	taken := make(map[string]bool, len(records))
+	for _, r := range records {
+		taken[r.Name] = true
+	}
+	for _, r := range add {
+		if taken[r.Name] {
+			log.Printf("WARNING: Record %s is not added to %s because a record of another owner has the same name", r.Name, url)
+			metrics.RecordError("RecordOwnerConflict")
+			continue
+		}
+		taken[r.Name] = true
+		records = append(records, r)
+	}
+	return records
+}
+
+// Reads the records of a data group, either as an array of name and data objects or as an object of data by name.
+// Records read as an object are sorted by name.
+func unmarshalDataGroup(body []byte) (*DataGroup, error) {
+	raw := struct {
+		Records json.RawMessage `json:"records"`
+	}{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	dg := &DataGroup{}
+	records := bytes.TrimSpace(raw.Records)
+	if len(records) == 0 || bytes.Equal(records, []byte("null")) {
+		return dg, nil
+	}
+	if records[0] != '{' {
+		if err := json.Unmarshal(records, &dg.Records); err != nil {
+			return nil, err
+		}
+		return dg, nil
+	}
+	recordMap := map[string]string{}
+	if err := json.Unmarshal(records, &recordMap); err != nil {
+		return nil, err
+	}
+	for name, data := range recordMap {
+		dg.Records = append(dg.Records, Record{Name: name, Data: data})
+	}
+	sort.Slice(dg.Records, func(i, j int) bool { return dg.Records[i].Name < dg.Records[j].Name })
+	return dg, nil
+}
+
+// Returns true when the body has no top level records but contains records deeper in the response.
+// Writing the data group after such a response would clear the records that could not be parsed.
+func hasNestedRecords(body []byte) bool {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+	if _, ok := fields["records"]; ok {
+		return false
+	}
+	return bytes.Contains(body, []byte(`"records"`))
+}
+
+// Overwrites all records of the data group owned by this listener.
+// Without an owner the data group is overwritten without reading its current records.
+// External data groups are always overwritten by uploading their records file.
+func (b *BigIp) replaceDataGroup(url string, records []Record) error {
+	if len(url) == 0 {
+		return nil
+	}
+	if b.GroupType == GROUP_TYPE_EXTERNAL {
+		return b.putExternalDataGroup(url, records)
+	}
+	if len(b.Owner) == 0 {
+		return b.putDataGroup(url, &DataGroup{Records: records})
+	}
+	return b.modifyDataGroup(url, func(current []Record) []Record {
+		//Records of other owners are kept
+		kept := []Record{}
+		for _, r := range current {
+			if !b.isOwned(r) {
+				kept = append(kept, r)
+			}
+		}
+		return b.appendRecords(url, kept, records)
+	})
+}
+
+// Reads the records of the data group and writes the records returned by modify
+func (b *BigIp) modifyDataGroup(url string, modify func(records []Record) []Record) error {
+	for i := 0; ; i++ {
+		err := b.readModifyWrite(url, modify)
+		if _, ok := err.(*versionConflictError); !ok || i >= BIGIP_CONFLICT_RETRIES {
+			return err
+		}
+		log.Printf("Data group %s was modified concurrently. Retrying the update", url)
+	}
+}
+
+// Reads the data group, modifies its records and writes them back.
+// The write is conditional on the ETag of the read, if BigIp returned one,
+// so that concurrent writes of other listeners are not overwritten.
+func (b *BigIp) readModifyWrite(url string, modify func(records []Record) []Record) error {
+	dg, err := b.getDataGroup(url)
+	if err != nil {
+		return err
+	}
+	dg.Records = modify(dg.Records)
+	return b.putDataGroup(url, dg)
+}
+
+// Reads the records of the data group, along with its ETag
+func (b *BigIp) getDataGroup(url string) (*DataGroup, error) {
 	//Get current records
-	req, err := b.newRequest("GET", nil)
-	resp, err := b.Client.Do(req)
+	resp, body, err := b.send("GET", url, nil, b.GetTimeout, nil)
 	if err != nil {
-		return fmt.Errorf("ERROR: Unable to get details of data group from url %s \n %s", b.Url, err.Error())
+		return nil, fmt.Errorf("ERROR: Unable to get details of data group from url %s \n %s", url, err.Error())
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	//If GET request is successful add or remove records
-	if resp.StatusCode == http.StatusOK {
-		//Unmarshal reponse into a struct
-		dg := &DataGroup{}
-		err := json.Unmarshal(body, dg)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ERROR: Request %s returned status code %d\n%s", url, resp.StatusCode, service.TruncateBody(body))
+	}
+	//Unmarshal reponse into a struct
+	dg, err := unmarshalDataGroup(body)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Unable to unmarshal response from %s ", url)
+	}
+	if len(dg.Records) == 0 && hasNestedRecords(body) {
+		log.Printf("WARNING: Records of the data group %s could not be parsed from %s", url, service.TruncateBody(body))
+		return nil, fmt.Errorf("ERROR: Unable to find records at the top level of the response from %s. The data group was not updated", url)
+	}
+	metrics.RecordDataGroupSize(url, len(dg.Records))
+	dg.version = resp.Header.Get("ETag")
+	return dg, nil
+}
+
+func (b *BigIp) putDataGroup(url string, dg *DataGroup) error {
+	//Convert update struct to Json payload
+	payload, err := b.marshalDataGroup(dg)
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to marshal %+v", dg)
+	}
+	header := http.Header{}
+	if len(dg.version) > 0 {
+		header.Set("If-Match", dg.version)
+	}
+	//Update datagroup with updated records
+	resp, body, err := b.send("PUT", url, payload, b.PutTimeout, header)
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to update data group at url %s \n %s", url, err.Error())
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed && len(dg.version) > 0 {
+		return &versionConflictError{url: url}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ERROR: Request %s returned status code %d\n%s", url, resp.StatusCode, service.TruncateBody(body))
+	}
+	return nil
+}
+
+// Uploads the records file of an external data group and points the data group file object to it.
+// The data group file object is named after the data group of url and must exist on BigIp.
+func (b *BigIp) putExternalDataGroup(url string, records []Record) error {
+	i := strings.Index(url, DG_PATH)
+	if i < 0 {
+		return fmt.Errorf("ERROR: Unable to find the data group name in url %s", url)
+	}
+	host, name := url[:i], url[i+len(DG_PATH):]
+	content := marshalExternalRecords(records)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Range", getContentRange(len(content)))
+	uploadUrl := host + FILE_UPLOAD_PATH + name
+	resp, body, err := b.send("POST", uploadUrl, content, b.PutTimeout, header)
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to upload records file to url %s \n %s", uploadUrl, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ERROR: Request %s returned status code %d\n%s", uploadUrl, resp.StatusCode, service.TruncateBody(body))
+	}
+	payload, err := json.Marshal(map[string]string{"sourcePath": "file:" + FILE_UPLOAD_DIR + name})
+	if err != nil {
+		return err
+	}
+	fileUrl := host + FILE_DG_PATH + name
+	resp, body, err = b.send("PUT", fileUrl, payload, b.PutTimeout, nil)
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to update data group file at url %s \n %s", fileUrl, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ERROR: Request %s returned status code %d\n%s", fileUrl, resp.StatusCode, service.TruncateBody(body))
+	}
+	return nil
+}
+
+// Returns the records file of an external data group, one `"name" := "data",` line per record
+func marshalExternalRecords(records []Record) []byte {
+	var buff bytes.Buffer
+	for _, r := range records {
+		buff.WriteString(fmt.Sprintf("%q := %q,\n", r.Name, r.Data))
+	}
+	return buff.Bytes()
+}
+
+// Returns the Content-Range header of an upload of size bytes sent in a single chunk
+func getContentRange(size int) string {
+	if size == 0 {
+		return "0-0/0"
+	}
+	return fmt.Sprintf("0-%d/%d", size-1, size)
+}
+
+// Returns the PUT payload of the data group: `{"records":[{"name":"/path","data":"pool"}]}`.
+// Records are always present, so that an empty list clears the data group.
+// With a payload envelope, the payload is nested under it: `{"<envelope>":{"records":[...]}}`.
+// With PrettyPayload, the payload is indented to ease debugging.
+// Records are sorted by name, so that the payload does not depend on the order routes were processed in.
+func (b *BigIp) marshalDataGroup(dg *DataGroup) ([]byte, error) {
+	//The records are copied so that the order of the caller's records is kept
+	records := append([]Record{}, dg.Records...)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	var payload interface{} = struct {
+		Records []Record `json:"records"`
+	}{records}
+	if b.RecordFormat == RECORD_FORMAT_MAP {
+		recordMap := map[string]string{}
+		for _, r := range records {
+			recordMap[r.Name] = r.Data
+		}
+		payload = struct {
+			Records map[string]string `json:"records"`
+		}{recordMap}
+	}
+	if len(b.PayloadEnvelope) > 0 {
+		payload = map[string]interface{}{b.PayloadEnvelope: payload}
+	}
+	if b.PrettyPayload {
+		return json.MarshalIndent(payload, "", "  ")
+	}
+	return json.Marshal(payload)
+}
+
+// Sends a request to BigIp and returns the response together with its body.
+// Rate-limited (429) requests are retried up to RateLimitRetries times,
+// waiting as long as the `Retry-After` header asks.
+//
+// Requests carry a request ID, so that changes can be traced in BigIp logs.
+// The ID is logged only when the request fails or is retried, so that successful requests do not flood the logs.
+func (b *BigIp) send(method, url string, payload []byte, timeout time.Duration, header http.Header) (*http.Response, []byte, error) {
+	requestID := service.NewRequestID()
+	keyReloaded := false
+	for i := 0; ; i++ {
+		ctx, cancel := operationContext(timeout)
+		req, err := b.newRequest(ctx, method, url, payload)
 		if err != nil {
-			return fmt.Errorf("ERROR: Unable to unmarshal response from %s ", b.Url)
+			cancel()
+			return nil, nil, err
 		}
-		//Create records from paths
-		records := b.getRecords(paths, b.Pattern)
-		if remove {
-			//Remove records from unmarshalled struct
-			dg.Records = b.removeRecords(dg.Records, records)
-		} else {
-			//Append records to unmarshalled struct
-			for _, r := range records {
-				dg.Records = append(dg.Records, r)
-			}
+		for k, v := range header {
+			req.Header[k] = v
 		}
-		//Convert update struct to Json payload
-		payload, err := json.Marshal(dg)
+		req.Header.Set(service.REQUEST_ID_HEADER, requestID)
+		b.acquire()
+		resp, err := b.Client.Do(req)
 		if err != nil {
-			return fmt.Errorf("ERROR: Unable to marshal %+v", dg)
+			b.release()
+			cancel()
+			log.Printf("%s request to %s with request ID %s failed", method, url, requestID)
+			return nil, nil, err
 		}
-		//Update datagroup with updated records
-		req, err := b.newRequest("PUT", payload)
-		resp, err := b.Client.Do(req)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		b.release()
+		cancel()
 		if err != nil {
-			return fmt.Errorf("ERROR: Unable to update data group at url %s \n %s", b.Url, err.Error())
+			return nil, nil, err
 		}
-		defer resp.Body.Close()
-		body, _ := ioutil.ReadAll(resp.Body)
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("ERROR: Request %s returned status code %d\n%s", b.Url, resp.StatusCode, string(body[:]))
+		//The key file is updated in place when the secret is rotated
+		if resp.StatusCode == http.StatusUnauthorized && !keyReloaded && b.reloadKey() {
+			keyReloaded = true
+			log.Printf("Request ID %s was unauthorized. Retrying with the reloaded key", requestID)
+			continue
 		}
-	} else {
-		return fmt.Errorf("ERROR: Request %s returned status code %d\n%s", b.Url, resp.StatusCode, string(body[:]))
+		wait, ok := service.RetryAfter(resp)
+		if !ok || i >= b.RateLimitRetries {
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("%s request to %s with request ID %s returned status code %d", method, url, requestID, resp.StatusCode)
+			}
+			return resp, body, nil
+		}
+		log.Printf("Request ID %s was rate-limited. Retrying in %s", requestID, wait)
+		sleep(wait)
+	}
+}
+
+// Waits until the number of in-flight requests is below `DF_BIGIP_MAX_CONCURRENCY`, if set
+func (b *BigIp) acquire() {
+	if b.inFlight != nil {
+		b.inFlight <- struct{}{}
+	}
+}
+
+func (b *BigIp) release() {
+	if b.inFlight != nil {
+		<-b.inFlight
 	}
-	return nil
 }
 
-func (b *BigIp) newRequest(method string, body []byte) (*http.Request, error) {
-	req, err := http.NewRequest(method, b.Url, bytes.NewBuffer(body))
+func (b *BigIp) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add(BIGIP_HEADER, b.Key)
-	return req, err
+	b.keyLock.RLock()
+	req.Header.Add(b.KeyHeader, b.Key)
+	b.keyLock.RUnlock()
+	return req.WithContext(ctx), nil
+}
+
+// Returns a context bounded by timeout, or an unbounded one when timeout is not set
+func operationContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
 }
 
+// Removes records with the names of remove, leaving records of other owners untouched.
+// Names are looked up in a set, so that data groups with thousands of records are diffed in linear time.
 func (b *BigIp) removeRecords(from []Record, remove []Record) []Record {
+	names := make(map[string]bool, len(remove))
+	for _, r := range remove {
+		names[r.Name] = true
+	}
 	removed := from[:0]
 	for _, r := range from {
-		if !b.containsRecord(remove, r) {
+		if !b.isOwned(r) || !names[r.Name] {
 			removed = append(removed, r)
 		}
 	}
 	return removed
 }
 
+// Records are matched by their exact names. Wildcard records are names like any other,
+// so removing `/api/*` removes only that record and neither `/api/v1` nor `/apiv2`.
 func (b *BigIp) containsRecord(target []Record, candidate Record) bool {
 	for _, t := range target {
 		if t.Name == candidate.Name {
@@ -172,6 +1202,142 @@ func (b *BigIp) containsRecord(target []Record, candidate Record) bool {
 	return false
 }
 
+// Returns the service path read from the task template env var named by PathSource.
+// Falls back to the service path label when PathSource is not set or the env var is missing.
+func (b *BigIp) getServicePath(s service.SwarmService) (string, bool) {
+	if len(b.PathSource) > 0 {
+		prefix := b.PathSource + "="
+		for _, e := range s.Spec.TaskTemplate.ContainerSpec.Env {
+			if strings.HasPrefix(e, prefix) {
+				return strings.TrimPrefix(e, prefix), true
+			}
+		}
+	}
+	label, ok := s.Spec.Labels[service.Label(SERVICE_PATH_LABEL)]
+	return label, ok
+}
+
+// Splits the service path label into lower cased paths using the configured delimiter
+func (b *BigIp) getPaths(label string) []string {
+	label = strings.ToLower(label)
+	return strings.Split(label, b.PathDelimiter)
+}
+
+func containsPath(paths []string, candidate string) bool {
+	for _, p := range paths {
+		if p == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the record data of a service rendered from DataTemplate, or Pattern when no template is set
+func (b *BigIp) getData(s service.SwarmService) (string, error) {
+	if b.DataTemplate == nil {
+		return b.getPortData(s)
+	}
+	var buff bytes.Buffer
+	err := b.DataTemplate.Execute(&buff, struct {
+		ServiceName string
+		Labels      map[string]string
+	}{
+		ServiceName: s.Spec.Name,
+		Labels:      s.Spec.Labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Unable to render data template for service %s \n %s", s.Spec.Name, err.Error())
+	}
+	return buff.String(), nil
+}
+
+// Reads the config API again once the refresh interval elapsed since the config was last read.
+// When the config changed, the data group urls and the pattern are replaced together.
+// The current config is kept when the config API fails or returns an unusable config.
+func (b *BigIp) RefreshConfig() error {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	if b.ConfigRefresh <= 0 || len(b.ConfigApi) == 0 || time.Since(b.configReadAt) < b.ConfigRefresh {
+		return nil
+	}
+	b.configReadAt = time.Now()
+	config, err := fetchConfig(b.ConfigApi, b.configApiTimeout)
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to refresh config from %s \n %s", b.ConfigApi, err.Error())
+	}
+	if *config == b.config {
+		return nil
+	}
+	pattern := config.PoolPattern
+	if b.patternFromEnv {
+		pattern = b.Pattern
+	} else if len(pattern) == 0 {
+		pattern = b.defaultPattern
+	}
+	if len(config.Host) == 0 || len(config.DataGroup) == 0 || (len(pattern) == 0 && b.DataTemplate == nil) {
+		return fmt.Errorf("ERROR: Config from %s is incomplete and was ignored: %+v", b.ConfigApi, *config)
+	}
+	log.Printf("Config changed from %+v to %+v", b.config, *config)
+	b.config = *config
+	b.Host = config.Host
+	b.Url = getDataGroupUrl(config.Host, config.DataGroup)
+	if len(b.domainDataGroup) > 0 {
+		b.DomainUrl = getDataGroupUrl(config.Host, b.domainDataGroup)
+	}
+	b.Pattern = pattern
+	b.applyConfigSettings()
+	return nil
+}
+
+// Applies the timeout and retries from the config API.
+// The values from environment variables are used for the settings the config API does not return.
+func (b *BigIp) applyConfigSettings() {
+	b.GetTimeout, b.PutTimeout = b.envGetTimeout, b.envPutTimeout
+	if b.config.Timeout > 0 {
+		timeout := time.Second * time.Duration(b.config.Timeout)
+		b.GetTimeout, b.PutTimeout = timeout, timeout
+	}
+	b.RateLimitRetries = b.envRetries
+	if b.config.Retry > 0 {
+		b.RateLimitRetries = int(b.config.Retry)
+	}
+}
+
+// Returns an error when neither the pattern nor the data template can provide the data of records
+func (b *BigIp) checkPattern() error {
+	if len(b.Pattern) == 0 && b.DataTemplate == nil {
+		return fmt.Errorf("BigIp: Missing pool pattern. Set BIGIP_RWP in the config API, DF_BIGIP_PATTERN, DF_BIGIP_DEFAULT_PATTERN or DF_BIGIP_DATA_TEMPLATE")
+	}
+	return nil
+}
+
+// Returns the pattern combined with the `com.df.port` label of the service using the port template.
+// Without the label, the pattern is returned as is.
+func (b *BigIp) getPortData(s service.SwarmService) (string, error) {
+	port, ok := s.Spec.Labels[service.Label(SERVICE_PORT_LABEL)]
+	if !ok || len(port) == 0 || b.PortTemplate == nil {
+		return b.Pattern, nil
+	}
+	var buff bytes.Buffer
+	err := b.PortTemplate.Execute(&buff, struct {
+		Data string
+		Port string
+	}{
+		Data: b.Pattern,
+		Port: port,
+	})
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Unable to render port template for service %s \n %s", s.Spec.Name, err.Error())
+	}
+	return buff.String(), nil
+}
+
+// Returns true when the record was written by this listener.
+// Without an owner, every record is considered to be owned.
+func (b *BigIp) isOwned(r Record) bool {
+	return len(b.Owner) == 0 || strings.HasSuffix(r.Data, OWNER_DELIMITER+b.Owner)
+}
+
 func (b *BigIp) getRecords(paths []string, pattern string) []Record {
 	var records []Record
 	for _, path := range paths {
@@ -179,25 +1345,96 @@ func (b *BigIp) getRecords(paths []string, pattern string) []Record {
 			r := Record{}
 			r.Name = path
 			r.Data = pattern
+			if len(b.Owner) > 0 {
+				r.Data += OWNER_DELIMITER + b.Owner
+			}
 			records = append(records, r)
 		}
 	}
 	return records
 }
 
-func readConfig(configApi string) *Config {
-	res, err := http.Get(configApi)
+func readConfig(configApi string, timeout time.Duration) *Config {
+	config, err := fetchConfig(configApi, timeout)
 	checkErr(err)
+	return config
+}
 
+// getNotifyConfig returns the notification addresses the config API returned for the primary BigIp
+func getNotifyConfig(bigIp BigIpClient) (createServiceUrl, removeServiceUrl string) {
+	switch b := bigIp.(type) {
+	case *BigIp:
+		return b.config.NotifyCreateServiceUrl, b.config.NotifyRemoveServiceUrl
+	case *StandbyBigIp:
+		return getNotifyConfig(b.Primary)
+	}
+	return "", ""
+}
+
+func fetchConfig(configApi string, timeout time.Duration) (*Config, error) {
+	ctx, cancel := operationContext(timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", configApi, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: newTransport(getInsecureFromEnv("DF_CONFIG_API_INSECURE", false))}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		checkErr(fmt.Errorf("Config API at %s returned a non 200 OK response", configApi))
+		return nil, fmt.Errorf("Config API at %s returned a non 200 OK response", configApi)
 	}
 	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	//Gateways in front of the config API can answer with an HTML page and status 200
+	if contentType := res.Header.Get("Content-Type"); strings.Contains(strings.ToLower(contentType), "html") {
+		metrics.RecordError("ConfigApiResponse")
+		return nil, fmt.Errorf("Config API at %s returned %s instead of JSON: %s", configApi, contentType, service.TruncateBody(body))
+	}
 	config := &Config{}
-	err = json.Unmarshal(body, config)
-	checkErr(err)
-	return config
+	if err := json.Unmarshal(body, config); err != nil {
+		metrics.RecordError("ConfigApiResponse")
+		return nil, fmt.Errorf("Config API at %s returned a response that is not JSON: %s \n %s", configApi, service.TruncateBody(body), err.Error())
+	}
+	if len(config.Host) == 0 && len(config.DataGroup) == 0 && len(config.PoolPattern) == 0 {
+		metrics.RecordError("ConfigApiResponse")
+		return nil, fmt.Errorf("Config API at %s returned no BigIp settings: %s", configApi, service.TruncateBody(body))
+	}
+	return config, nil
+}
+
+func readKey(keyFile string) (string, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// Reads the key file again, e.g. after the secret was rotated.
+// Returns true when the key changed.
+func (b *BigIp) reloadKey() bool {
+	if len(b.KeyFile) == 0 {
+		return false
+	}
+	key, err := readKey(b.KeyFile)
+	if err != nil {
+		log.Printf("WARNING: Unable to reload the BigIp key from %s: %s", b.KeyFile, err.Error())
+		return false
+	}
+	b.keyLock.Lock()
+	defer b.keyLock.Unlock()
+	if len(key) == 0 || key == b.Key {
+		return false
+	}
+	b.Key = key
+	log.Printf("The BigIp key was reloaded from %s", b.KeyFile)
+	return true
 }
 
 func checkErr(e error) {
@@ -206,29 +1443,352 @@ func checkErr(e error) {
 	}
 }
 
-func NewBigIp(configApi, keyFile string) *BigIp {
+// Ping checks that the data group url responds with 200 OK for the configured key.
+// The key is reloaded once when it is rejected, in case the secret was rotated.
+func (b *BigIp) Ping() error {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+	err := b.ping()
+	if authErr, ok := err.(*bigIpAuthError); ok && authErr.statusCode == http.StatusUnauthorized && b.reloadKey() {
+		return b.ping()
+	}
+	return err
+}
 
-	key, err := ioutil.ReadFile(keyFile)
+func (b *BigIp) ping() error {
+	ctx, cancel := operationContext(b.GetTimeout)
+	defer cancel()
+	req, err := b.newRequest(ctx, "GET", b.Url, nil)
+	if err != nil {
+		return err
+	}
+	b.acquire()
+	defer b.release()
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ERROR: Unable to get details of data group from url %s \n %s", b.Url, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return &bigIpAuthError{url: b.Url, statusCode: resp.StatusCode}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ERROR: Request %s returned status code %d", b.Url, resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns a transport that skips certificate verification when insecure is true
+func newTransport(insecure bool) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		Proxy:           service.ProxyFromEnv(),
+	}
+}
+
+// Returns whether certificate verification is skipped, as set by the environment variable name
+func getInsecureFromEnv(name string, defValue bool) bool {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return defValue
+	}
+	return strings.EqualFold(value, "true")
+}
+
+func NewBigIp(configApi, keyFile string) *BigIp {
+	key, err := readKey(keyFile)
 	checkErr(err)
 
-	config := readConfig(configApi)
+	//The timeout is read once, so that refreshing the config does not read it again
+	timeout := getConfigApiTimeoutFromEnv()
+	config := readConfig(configApi, timeout)
 
+	b := newBigIp(config, key)
+	b.ConfigApi = configApi
+	b.configApiTimeout = timeout
+	b.KeyFile = keyFile
+	return b
+}
+
+func getDataGroupUrl(host, dataGroup string) string {
 	var buff bytes.Buffer
-	buff.WriteString(config.Host)
+	buff.WriteString(host)
 	buff.WriteString(DG_PATH)
-	buff.WriteString(config.DataGroup)
+	buff.WriteString(dataGroup)
+	return buff.String()
+}
+
+func newBigIp(config *Config, key string) *BigIp {
+
+	//Ignore https unless DF_BIGIP_INSECURE is false
+	tr := newTransport(getInsecureFromEnv("DF_BIGIP_INSECURE", true))
+	//Keep connections to BigIp open so that they are reused across updates
+	tr.MaxIdleConns = getValue(BIGIP_MAX_IDLE_CONNS, "DF_BIGIP_MAX_IDLE_CONNS")
+	tr.MaxIdleConnsPerHost = getValue(BIGIP_MAX_IDLE_CONNS_PER_HOST, "DF_BIGIP_MAX_IDLE_CONNS_PER_HOST")
+	tr.IdleConnTimeout = time.Second * time.Duration(getValue(BIGIP_IDLE_CONN_TIMEOUT, "DF_BIGIP_IDLE_CONN_TIMEOUT"))
+	//Requests beyond the limit wait so that the management interface of BigIp is not overwhelmed
+	maxConcurrency := getValue(BIGIP_MAX_CONCURRENCY, "DF_BIGIP_MAX_CONCURRENCY")
+	var inFlight chan struct{}
+	if maxConcurrency > 0 {
+		inFlight = make(chan struct{}, maxConcurrency)
+	}
+	b := &BigIp{
+		config:         *config,
+		configReadAt:   time.Now(),
+		Host:           config.Host,
+		Url:            getDataGroupUrl(config.Host, config.DataGroup),
+		Key:            key,
+		KeyHeader:      BIGIP_HEADER,
+		Services:       make(map[string]ServiceRoutes),
+		adoptedUrls:    map[string]bool{},
+		Pattern:        config.PoolPattern,
+		PathDelimiter:  PATH_DELIMITER,
+		GroupType:      GROUP_TYPE_INTERNAL,
+		RecordFormat:   RECORD_FORMAT_ARRAY,
+		PortTemplate:   template.Must(template.New("port").Parse(PORT_TEMPLATE)),
+		TTLTemplate:    template.Must(template.New("ttl").Parse(TTL_TEMPLATE)),
+		MaxConcurrency: maxConcurrency,
+		inFlight:       inFlight,
+		errorLog:       service.NewLogDeduper(),
+		envRetries:     BIGIP_RATE_LIMIT_RETRIES,
+		Client:         &http.Client{Transport: tr},
+	}
+	b.applyConfigSettings()
+	return b
+}
+
+func getKeyFileFromEnv() string {
+	keyFile := os.Getenv("DF_BIGIP_KEY_FILE")
+	if len(keyFile) == 0 {
+		keyFile = getSecretFile(BIGIP_KEY_SECRET)
+	}
+	return keyFile
+}
+
+// Loads cached service routes from CacheFile.
+// A missing file leaves the cache empty and a malformed one is discarded with a warning.
+// Compressed files are detected by their content, so that files written with and without CompressCache are loaded.
+func (b *BigIp) loadCache() {
+	if len(b.CacheFile) == 0 {
+		return
+	}
+	content, err := ioutil.ReadFile(b.CacheFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("WARNING: Unable to read cache file %s, starting with an empty cache \n %s", b.CacheFile, err.Error())
+		return
+	}
+	content, err = gunzipIfCompressed(content)
+	if err != nil {
+		log.Printf("WARNING: Discarding malformed cache file %s, starting with an empty cache \n %s", b.CacheFile, err.Error())
+		return
+	}
+	services := map[string]ServiceRoutes{}
+	err = json.Unmarshal(content, &services)
+	if err != nil {
+		log.Printf("WARNING: Discarding malformed cache file %s, starting with an empty cache \n %s", b.CacheFile, err.Error())
+		return
+	}
+	b.lock.Lock()
+	b.Services = services
+	b.lock.Unlock()
+}
+
+// Seeds the cache with the records of the path and domain data groups, e.g. on the first start without a cache file.
+// Data groups of services are adopted when a service routes to them for the first time, see adoptDataGroup.
+// Only records tagged with Owner are adopted, since records of other listeners or written by hand look alike otherwise.
+// Services cannot be told from records, so records are grouped by their data under ADOPTED_PREFIX keys.
+// Paths and domains are released from adopted routes as services route them. The listener removes what is left once all listed services are routed.
+// Adoption is best-effort. The cache stays empty when the data groups cannot be read.
+func (b *BigIp) adoptRecords() {
+	if !b.canAdoptRecords() {
+		return
+	}
+	b.adoptDataGroup(b.Url, "", false)
+	if len(b.DomainUrl) > 0 {
+		b.adoptDataGroup(b.DomainUrl, "", true)
+	}
+	b.saveCache()
+}
+
+// Returns true when records can be adopted, logging why they cannot otherwise
+func (b *BigIp) canAdoptRecords() bool {
+	if b.GroupType == GROUP_TYPE_EXTERNAL {
+		log.Printf("WARNING: Records of external data groups cannot be read and are not adopted")
+		return false
+	}
+	if len(b.Owner) == 0 {
+		log.Printf("WARNING: Records are not adopted because DF_BIGIP_OWNER is not set")
+		return false
+	}
+	return true
+}
+
+// Marks the data groups of the cached routes as adopted, since the cache file already tracks their records
+func (b *BigIp) markCachedDataGroupsAdopted() {
+	b.adoptedUrls[b.Url] = true
+	if len(b.DomainUrl) > 0 {
+		b.adoptedUrls[b.DomainUrl] = true
+	}
+	for _, routes := range b.GetRoutes() {
+		b.adoptedUrls[b.getPathUrl(routes)] = true
+	}
+}
+
+// Adopts the owned records of the data group at url, once per data group.
+// dataGroup is the name of a data group of services and empty for the data group from config.
+// Records of the domain data group are adopted as domains.
+// Records the cache already holds are skipped, so that records of routed services are never adopted.
+// The caller must hold updateLock.
+func (b *BigIp) adoptDataGroup(url string, dataGroup string, domains bool) {
+	if b.adoptedUrls[url] {
+		return
+	}
+	dg, err := b.getDataGroup(url)
+	if err != nil {
+		log.Printf("WARNING: Unable to adopt records of %s \n %s", url, err.Error())
+		return
+	}
+	b.adoptedUrls[url] = true
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	cached := map[string]bool{}
+	for _, routes := range b.Services {
+		names := routes.Domains
+		if !domains {
+			if b.getPathUrl(routes) != url {
+				continue
+			}
+			names = routes.Paths
+		}
+		for _, name := range names {
+			cached[name] = true
+		}
+	}
+	for _, r := range dg.Records {
+		if !b.isOwned(r) || cached[r.Name] {
+			continue
+		}
+		data := strings.TrimSuffix(r.Data, OWNER_DELIMITER+b.Owner)
+		id := ADOPTED_PREFIX + data
+		if len(dataGroup) > 0 {
+			id = ADOPTED_PREFIX + dataGroup + ":" + data
+		}
+		routes := b.Services[id]
+		if domains {
+			log.Printf("Adopting domain %s with data %s", r.Name, data)
+			routes.Domains = append(routes.Domains, r.Name)
+		} else {
+			log.Printf("Adopting path %s of %s with data %s", r.Name, url, data)
+			routes.Paths = append(routes.Paths, r.Name)
+			routes.DataGroup = dataGroup
+		}
+		routes.Data = data
+		if routes.AddedAt.IsZero() {
+			routes.AddedAt = time.Now()
+		}
+		b.Services[id] = routes
+	}
+}
+
+// Returns true when the routes were adopted from the data group rather than added for a service
+func isAdopted(id string) bool {
+	return strings.HasPrefix(id, ADOPTED_PREFIX)
+}
+
+// Drops the paths routed by services from adopted routes, so that removing adopted routes keeps the records of services.
+// The lock must be held.
+func (b *BigIp) releaseAdopted(updates map[string]ServiceRoutes) {
+	for id, routes := range updates {
+		if isAdopted(id) || (len(routes.Paths) == 0 && len(routes.Domains) == 0) {
+			continue
+		}
+		for adoptedID, adopted := range b.Services {
+			if !isAdopted(adoptedID) {
+				continue
+			}
+			if b.getPathUrl(adopted) == b.getPathUrl(routes) {
+				adopted.Paths = excludePaths(adopted.Paths, routes.Paths)
+			}
+			adopted.Domains = excludePaths(adopted.Domains, routes.Domains)
+			if len(adopted.Paths) == 0 && len(adopted.Domains) == 0 {
+				delete(b.Services, adoptedID)
+			} else {
+				b.Services[adoptedID] = adopted
+			}
+		}
+	}
+}
+
+// Returns the paths that are not in exclude
+func excludePaths(paths []string, exclude []string) []string {
+	excluded := map[string]bool{}
+	for _, p := range exclude {
+		excluded[p] = true
+	}
+	kept := []string{}
+	for _, p := range paths {
+		if !excluded[p] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Writes cached service routes to CacheFile, compressed with gzip when CompressCache is set.
+// The content is written to a temporary file first and renamed so the cache file is never partial.
+func (b *BigIp) saveCache() {
+	if len(b.CacheFile) == 0 {
+		return
+	}
+	b.lock.RLock()
+	content, err := json.Marshal(b.Services)
+	b.lock.RUnlock()
+	if err == nil && b.CompressCache {
+		content, err = gzipContent(content)
+	}
+	if err != nil {
+		log.Printf("ERROR: Unable to marshal cache \n %s", err.Error())
+		return
+	}
+	tmpFile := b.CacheFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, content, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, b.CacheFile)
+	}
+	if err != nil {
+		log.Printf("ERROR: Unable to write cache file %s \n %s", b.CacheFile, err.Error())
+	}
+}
+
+func gzipContent(content []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	w := gzip.NewWriter(&buff)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
 
-	//Ignore https
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// Returns the content decompressed when it starts with the gzip magic bytes, or unchanged otherwise
+func gunzipIfCompressed(content []byte) ([]byte, error) {
+	if len(content) < 2 || content[0] != 0x1f || content[1] != 0x8b {
+		return content, nil
 	}
-	return &BigIp{
-		Url:      buff.String(),
-		Key:      strings.TrimSpace(string(key)),
-		Services: make(map[string][]string),
-		Pattern:  config.PoolPattern,
-		Client:   &http.Client{Transport: tr},
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
 	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func getConfigApiTimeoutFromEnv() time.Duration {
+	return time.Second * time.Duration(getValue(0, "DF_CONFIG_API_TIMEOUT"))
 }
 
 func NewBigIpFromEnv() *BigIp {
@@ -236,9 +1796,111 @@ func NewBigIpFromEnv() *BigIp {
 	if len(configApi) == 0 {
 		checkErr(fmt.Errorf("BigIp: Missing Config API Url"))
 	}
-	keyFile := os.Getenv("DF_BIGIP_KEY_FILE")
-	if len(keyFile) == 0 {
-		keyFile = BIGIP_KEY_FILE
+	return newBigIpFromEnv(configApi, os.Getenv("DF_BIGIP_CACHE_FILE"))
+}
+
+// Returns a BigIp reading its config from the given config API and its settings from environment variables
+func newBigIpFromEnv(configApi, cacheFile string) *BigIp {
+	b := NewBigIp(configApi, getKeyFileFromEnv())
+	if delimiter := os.Getenv("DF_PATH_DELIMITER"); len(delimiter) > 0 {
+		b.PathDelimiter = delimiter
+	}
+	b.PathSource = os.Getenv("DF_PATH_SOURCE")
+	b.CacheFile = cacheFile
+	b.CompressCache = strings.EqualFold(os.Getenv("DF_CACHE_COMPRESS"), "true")
+	b.loadCache()
+	if keyHeader := os.Getenv("DF_BIGIP_KEY_HEADER"); len(keyHeader) > 0 {
+		b.KeyHeader = keyHeader
+	}
+	if dataTemplate := os.Getenv("DF_BIGIP_DATA_TEMPLATE"); len(dataTemplate) > 0 {
+		t, err := template.New("data").Option("missingkey=error").Parse(dataTemplate)
+		checkErr(err)
+		b.DataTemplate = t
+	}
+	if pattern := os.Getenv("DF_BIGIP_PATTERN"); len(pattern) > 0 {
+		b.Pattern = pattern
+		b.patternFromEnv = true
+	}
+	//The default pattern is used while the config API does not return a pattern
+	b.defaultPattern = os.Getenv("DF_BIGIP_DEFAULT_PATTERN")
+	if len(b.Pattern) == 0 && len(b.defaultPattern) > 0 {
+		log.Printf("BIGIP_RWP is not set in the config API. Using the default pattern %s", b.defaultPattern)
+		b.Pattern = b.defaultPattern
+	}
+	checkErr(b.checkPattern())
+	if ttlTemplate := os.Getenv("DF_BIGIP_TTL_TEMPLATE"); len(ttlTemplate) > 0 {
+		t, err := template.New("ttl").Option("missingkey=error").Parse(ttlTemplate)
+		checkErr(err)
+		b.TTLTemplate = t
+	}
+	if portTemplate := os.Getenv("DF_BIGIP_PORT_TEMPLATE"); len(portTemplate) > 0 {
+		t, err := template.New("port").Option("missingkey=error").Parse(portTemplate)
+		checkErr(err)
+		b.PortTemplate = t
+	}
+	if domainDataGroup := os.Getenv("DF_BIGIP_DOMAIN_DG"); len(domainDataGroup) > 0 {
+		b.domainDataGroup = domainDataGroup
+		b.DomainUrl = getDataGroupUrl(b.Host, domainDataGroup)
+	}
+	b.envGetTimeout = time.Second * time.Duration(getValue(0, "DF_BIGIP_GET_TIMEOUT"))
+	b.envPutTimeout = time.Second * time.Duration(getValue(0, "DF_BIGIP_PUT_TIMEOUT"))
+	b.applyConfigSettings()
+	b.Authoritative = strings.EqualFold(os.Getenv("DF_BIGIP_AUTHORITATIVE"), "true")
+	b.Owner = os.Getenv("DF_BIGIP_OWNER")
+	b.MinWriteInterval = time.Second * time.Duration(getValue(0, "DF_BIGIP_MIN_WRITE_INTERVAL"))
+	b.PayloadEnvelope = os.Getenv("DF_BIGIP_PAYLOAD_ENVELOPE")
+	b.PrettyPayload = strings.EqualFold(os.Getenv("DF_BIGIP_PRETTY_PAYLOAD"), "true")
+	b.HostPaths = strings.EqualFold(os.Getenv("DF_BIGIP_HOST_PATHS"), "true")
+	b.WarnMissingPath = strings.EqualFold(os.Getenv("DF_WARN_MISSING_PATH"), "true")
+	if exclude := os.Getenv("DF_EXCLUDE_PATHS"); len(exclude) > 0 {
+		for _, p := range strings.Split(strings.ToLower(exclude), ",") {
+			b.ExcludePaths = append(b.ExcludePaths, strings.TrimSpace(p))
+		}
+	}
+	if include := os.Getenv("DF_PATH_INCLUDE_REGEX"); len(include) > 0 {
+		r, err := regexp.Compile(include)
+		if err != nil {
+			checkErr(fmt.Errorf("BigIp: Invalid DF_PATH_INCLUDE_REGEX %s: %s", include, err.Error()))
+		}
+		b.PathInclude = r
+	}
+	if transform := os.Getenv("DF_RECORD_NAME_TRANSFORM"); len(transform) > 0 {
+		transforms, err := parseRecordNameTransforms(transform)
+		if err != nil {
+			checkErr(fmt.Errorf("BigIp: Invalid DF_RECORD_NAME_TRANSFORM %s: %s", transform, err.Error()))
+		}
+		b.nameTransforms = transforms
+	}
+	b.ConfigRefresh = time.Second * time.Duration(getValue(0, "DF_CONFIG_REFRESH_INTERVAL"))
+	b.audit = newAuditLogFromEnv()
+	if groupType := strings.ToLower(os.Getenv("DF_BIGIP_GROUP_TYPE")); len(groupType) > 0 {
+		if groupType != GROUP_TYPE_INTERNAL && groupType != GROUP_TYPE_EXTERNAL {
+			checkErr(fmt.Errorf("BigIp: Invalid DF_BIGIP_GROUP_TYPE %s", groupType))
+		}
+		b.GroupType = groupType
+	}
+	if recordFormat := strings.ToLower(os.Getenv("DF_BIGIP_RECORD_FORMAT")); len(recordFormat) > 0 {
+		if recordFormat != RECORD_FORMAT_ARRAY && recordFormat != RECORD_FORMAT_MAP {
+			checkErr(fmt.Errorf("BigIp: Invalid DF_BIGIP_RECORD_FORMAT %s", recordFormat))
+		}
+		b.RecordFormat = recordFormat
+	}
+	b.AdoptRecords = strings.EqualFold(os.Getenv("DF_BIGIP_ADOPT_RECORDS"), "true") && b.canAdoptRecords()
+	if b.AdoptRecords {
+		if cacheFileExists(b.CacheFile) {
+			b.markCachedDataGroupsAdopted()
+		} else {
+			b.adoptRecords()
+		}
+	}
+	return b
+}
+
+// Returns true when the cache file is set and exists
+func cacheFileExists(cacheFile string) bool {
+	if len(cacheFile) == 0 {
+		return false
 	}
-	return NewBigIp(configApi, keyFile)
+	_, err := os.Stat(cacheFile)
+	return err == nil
 }
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 
 	service "./service"
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -90,6 +100,447 @@ func (s *BigIpTestSuite) Test_NewBigIpFromEnv() {
 	assert.NotNil(s.T(), bigIp.Client, "should create a http client")
 }
 
+func (s *BigIpTestSuite) Test_NewBigIp_ConfiguresIdleConnections() {
+	bigIp := newBigIp(&Config{Host: "https://bigip", DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	tr := bigIp.Client.Transport.(*http.Transport)
+
+	assert.Equal(s.T(), BIGIP_MAX_IDLE_CONNS, tr.MaxIdleConns)
+	assert.Equal(s.T(), BIGIP_MAX_IDLE_CONNS_PER_HOST, tr.MaxIdleConnsPerHost)
+	assert.Equal(s.T(), BIGIP_IDLE_CONN_TIMEOUT*time.Second, tr.IdleConnTimeout)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIp_ConfiguresIdleConnectionsFromEnv() {
+	os.Setenv("DF_BIGIP_MAX_IDLE_CONNS", "20")
+	os.Setenv("DF_BIGIP_MAX_IDLE_CONNS_PER_HOST", "5")
+	os.Setenv("DF_BIGIP_IDLE_CONN_TIMEOUT", "30")
+	defer func() {
+		os.Unsetenv("DF_BIGIP_MAX_IDLE_CONNS")
+		os.Unsetenv("DF_BIGIP_MAX_IDLE_CONNS_PER_HOST")
+		os.Unsetenv("DF_BIGIP_IDLE_CONN_TIMEOUT")
+	}()
+
+	bigIp := newBigIp(&Config{Host: "https://bigip", DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	tr := bigIp.Client.Transport.(*http.Transport)
+
+	assert.Equal(s.T(), 20, tr.MaxIdleConns)
+	assert.Equal(s.T(), 5, tr.MaxIdleConnsPerHost)
+	assert.Equal(s.T(), 30*time.Second, tr.IdleConnTimeout)
+}
+
+func (s *BigIpTestSuite) Test_Send_LimitsConcurrentRequests() {
+	os.Setenv("DF_BIGIP_MAX_CONCURRENCY", "2")
+	defer os.Unsetenv("DF_BIGIP_MAX_CONCURRENCY")
+	var lock sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bigIp.send("GET", bigIp.Url, nil, 0, nil)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(s.T(), 2, bigIp.MaxConcurrency)
+	assert.Equal(s.T(), 2, maxInFlight)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_ReadsKeyFromSecretsDir() {
+	os.MkdirAll("/tmp/secrets-custom", 0755)
+	ioutil.WriteFile("/tmp/secrets-custom/"+BIGIP_KEY_SECRET, []byte("custom-key-value"), 0755)
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_SECRETS_DIR", "/tmp/secrets-custom")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_SECRETS_DIR")
+		os.RemoveAll("/tmp/secrets-custom")
+	}()
+
+	bigIp := NewBigIpFromEnv()
+
+	assert.Equal(s.T(), "/tmp/secrets-custom/bigip-key", getKeyFileFromEnv())
+	assert.Equal(s.T(), "custom-key-value", bigIp.Key, "key should be read from the secrets dir")
+}
+
+func (s *BigIpTestSuite) Test_NewNotificationFromConfig_UsesNotifyAddressesOfConfigApi() {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"BIGIP_HOST": "http://bigip.invalid", "BIGIP_DG": "` + DG + `", "BIGIP_RWP": "` + PATTERN + `",
+			"NOTIFY_CREATE_SERVICE_URL": "http://proxy.invalid/create", "NOTIFY_REMOVE_SERVICE_URL": "http://proxy.invalid/remove"}`))
+	}))
+	defer configSrv.Close()
+	bigIp := NewBigIp(configSrv.URL, s.bigIPKeyFile)
+
+	n := service.NewNotificationFromConfig(getNotifyConfig(&StandbyBigIp{Primary: bigIp}))
+
+	assert.Equal(s.T(), []string{"http://proxy.invalid/create"}, n.CreateServiceAddr)
+	assert.Equal(s.T(), []string{"http://proxy.invalid/remove"}, n.RemoveServiceAddr)
+}
+
+func (s *BigIpTestSuite) Test_GetNotifyConfig_ReturnsNoAddresses_WhenBigIpIsDisabled() {
+	createServiceUrl, removeServiceUrl := getNotifyConfig(noopBigIp{})
+
+	assert.Empty(s.T(), createServiceUrl)
+	assert.Empty(s.T(), removeServiceUrl)
+}
+
+func (s *BigIpTestSuite) Test_GetKeyFileFromEnv_DefaultsToRunSecrets() {
+	assert.Equal(s.T(), "/run/secrets/bigip-key", getKeyFileFromEnv())
+}
+
+func (s *BigIpTestSuite) Test_GetKeyFileFromEnv_PrefersKeyFile() {
+	os.Setenv("DF_SECRETS_DIR", "/tmp/secrets-custom")
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	defer func() {
+		os.Unsetenv("DF_SECRETS_DIR")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+	}()
+
+	assert.Equal(s.T(), s.bigIPKeyFile, getKeyFileFromEnv())
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_SetsPathDelimiter() {
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_PATH_DELIMITER", ";")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_PATH_DELIMITER")
+	}()
+	bigIp := NewBigIpFromEnv()
+	assert.Equal(s.T(), ";", bigIp.PathDelimiter, "delimiter should be set from env")
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_SplitsPathsWithDelimiter() {
+	tests := []struct {
+		delimiter string
+		label     string
+		expected  []string
+	}{
+		{",", "/test-1,/test-2", []string{"/test-1", "/test-2"}},
+		{";", "/test-1;/test-2", []string{"/test-1", "/test-2"}},
+		{";", "/test-1,a;/test-2", []string{"/test-1,a", "/test-2"}},
+	}
+	for _, t := range tests {
+		bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+		bigIp.PathDelimiter = t.delimiter
+		labels := make(map[string]string)
+		labels["com.df.servicePath"] = t.label
+		err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, bigIp.Services[SERVICE_ID].Paths, "paths should be split with %s", t.delimiter)
+	}
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_PrefixesPathsWithDomain_WhenHostPathsIsSet() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.HostPaths = true
+	labels := map[string]string{"com.df.servicePath": "/api,/web", "com.df.serviceDomain": "Example.com"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"example.com/api", "example.com/web"}, bigIp.Services[SERVICE_ID].Paths)
+	assert.Equal(s.T(), []Record{{Name: "example.com/api", Data: PATTERN}, {Name: "example.com/web", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_KeepsPaths_WhenHostPathsIsSetAndDomainIsMissing() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.HostPaths = true
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/api"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"/api"}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_KeepsPaths_WhenHostPathsIsNotSet() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	labels := map[string]string{"com.df.servicePath": "/api", "com.df.serviceDomain": "example.com"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"/api"}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_SkipsExcludedPaths() {
+	tests := []struct {
+		exclude  []string
+		label    string
+		expected []string
+	}{
+		{[]string{"/metrics"}, "/demo,/metrics", []string{"/demo"}},
+		{[]string{"/internal/*"}, "/demo,/internal/health,/internal/ready", []string{"/demo"}},
+		{[]string{"/health*", "/metrics"}, "/demo,/healthz,/metricsz", []string{"/demo", "/metricsz"}},
+	}
+	for _, t := range tests {
+		bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+		bigIp.ExcludePaths = t.exclude
+		labels := map[string]string{"com.df.servicePath": t.label}
+		err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, bigIp.Services[SERVICE_ID].Paths, "paths matching %v should be excluded", t.exclude)
+	}
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_SkipsServices_WithoutNotifyLabelDespitePathLabel() {
+	defer os.Unsetenv("DF_NOTIFY_LABEL")
+	os.Setenv("DF_NOTIFY_LABEL", "com.df.notify")
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "")
+	labels := map[string]string{"com.df.servicePath": "/excluded"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices("excluded-id", labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Empty(s.T(), bigIp.Services, "excluded services should not be routed")
+	assert.Equal(s.T(), 0, srv.puts)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_TransformsRecordNames() {
+	tests := []struct {
+		transform string
+		label     string
+		expected  []string
+	}{
+		{"trim-slash", "/api/v1,/demo", []string{"api/v1", "demo"}},
+		{"prefix:svc_", "/demo", []string{"svc_/demo"}},
+		{"trim-slash,prefix:svc_", "/demo", []string{"svc_demo"}},
+		{"prefix:svc_,trim-slash", "/demo", []string{"svc_/demo"}},
+		{"trim-slash,add-slash,suffix:/", "//demo", []string{"/demo/"}},
+		{"trim-prefix:/api,prefix:/v2", "/api/demo,/other", []string{"/v2/demo", "/v2/other"}},
+	}
+	for _, t := range tests {
+		srv := newDataGroupServer()
+		bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+		transforms, err := parseRecordNameTransforms(t.transform)
+		assert.Nil(s.T(), err, "%s should be valid", t.transform)
+		bigIp.nameTransforms = transforms
+		labels := map[string]string{"com.df.servicePath": t.label}
+
+		err = bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, bigIp.Services[SERVICE_ID].Paths, "cached paths should be transformed with %s", t.transform)
+		assert.Equal(s.T(), t.expected, recordNames(srv.records(DG)), "records should be transformed with %s", t.transform)
+		err = bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Empty(s.T(), srv.records(DG), "records should be removed by their transformed names")
+		srv.Close()
+	}
+}
+
+func (s *BigIpTestSuite) Test_ParseRecordNameTransforms_ReturnsErr_WhenTransformIsInvalid() {
+	for _, transform := range []string{"unknown", "prefix", "prefix:", "trim-slash:x"} {
+		_, err := parseRecordNameTransforms(transform)
+		assert.NotNil(s.T(), err, "%s should be invalid", transform)
+	}
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_RoutesOnlyPathsMatchingIncludeRegex() {
+	tests := []struct {
+		include  string
+		label    string
+		expected []string
+	}{
+		{"^/api/", "/api/demo,/demo", []string{"/api/demo"}},
+		{"^/(api|web)/v[0-9]+$", "/api/v1,/web/v2,/api/v1/admin,/web", []string{"/api/v1", "/web/v2"}},
+	}
+	for _, t := range tests {
+		bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+		bigIp.PathInclude = regexp.MustCompile(t.include)
+		labels := map[string]string{"com.df.servicePath": t.label}
+		err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, bigIp.Services[SERVICE_ID].Paths, "only paths matching %s should be routed", t.include)
+	}
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_DoesNotCacheService_WhenNoPathMatchesIncludeRegex() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.PathInclude = regexp.MustCompile("^/api/")
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/demo"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.NotContains(s.T(), bigIp.Services, SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_Panics_WhenIncludeRegexIsMalformed() {
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_PATH_INCLUDE_REGEX", "^/api/(")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_PATH_INCLUDE_REGEX")
+	}()
+
+	assert.Panics(s.T(), func() { NewBigIpFromEnv() }, "malformed regex should fail at startup")
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_DoesNotCacheService_WhenAllPathsAreExcluded() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.ExcludePaths = []string{"/metrics"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/metrics"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.NotContains(s.T(), bigIp.Services, SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_AddsWildcardRecord() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/api/*,/web*"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/api/*", Data: PATTERN}, {Name: "/web*", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_DropsMalformedWildcards() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/a*pi,/api/**,*,/web"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"/web"}, bigIp.Services[SERVICE_ID].Paths)
+	assert.Equal(s.T(), []Record{{Name: "/web", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_RemoveRoutes_RemovesOnlyTheWildcardRecord() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/api/v1", Data: PATTERN}, {Name: "/apiv2", Data: PATTERN}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/api/*"}))
+	assert.Nil(s.T(), err, "should not return err")
+
+	err = bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/api/v1", Data: PATTERN}, {Name: "/apiv2", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_ReadsExcludePaths() {
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_EXCLUDE_PATHS", "/metrics, /Internal/*")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_EXCLUDE_PATHS")
+	}()
+
+	bigIp := NewBigIpFromEnv()
+
+	assert.Equal(s.T(), []string{"/metrics", "/internal/*"}, bigIp.ExcludePaths)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_WarnsAboutMissingPathLabel_WhenWarnMissingPathIsSet() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.WarnMissingPath = true
+	labels := make(map[string]string)
+	labels["com.df.port"] = "8080"
+	logBuf := &bytes.Buffer{}
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+	errors := getCounterValue("docker_flow_error", "operation", "MissingPathLabel")
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Empty(s.T(), bigIp.Services, "service should not be routed")
+	assert.Contains(s.T(), logBuf.String(), "has the com.df.port label but no com.df.servicePath label")
+	assert.Equal(s.T(), errors+1, getCounterValue("docker_flow_error", "operation", "MissingPathLabel"))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_DoesNotWarnAboutMissingPathLabel_WhenWarnMissingPathIsNotSet() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	labels := make(map[string]string)
+	labels["com.df.port"] = "8080"
+	errors := getCounterValue("docker_flow_error", "operation", "MissingPathLabel")
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), errors, getCounterValue("docker_flow_error", "operation", "MissingPathLabel"))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_ReadsPathLabelWithCustomPrefix() {
+	os.Setenv("DF_LABEL_PREFIX", "com.example.")
+	defer os.Unsetenv("DF_LABEL_PREFIX")
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	labels := map[string]string{"com.example.servicePath": "/custom", "com.df.servicePath": "/default"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"/custom"}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_IgnoresDefaultPrefix_WhenCustomPrefixIsSet() {
+	os.Setenv("DF_LABEL_PREFIX", "com.example.")
+	defer os.Unsetenv("DF_LABEL_PREFIX")
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/default"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.NotContains(s.T(), bigIp.Services, SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_ReadsPathFromEnvSource() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.PathSource = "SERVICE_PATH"
+	services := s.getSwarmServices(SERVICE_ID, map[string]string{})
+	(*services)[0].Spec.TaskTemplate.ContainerSpec.Env = []string{"OTHER=value", "SERVICE_PATH=/from-env"}
+
+	err := bigIp.AddRoutes(services)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"/from-env"}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_FallsBackToLabel_WhenEnvSourceIsMissing() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.PathSource = "SERVICE_PATH"
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{PATH}, bigIp.Services[SERVICE_ID].Paths)
+}
+
 func (s *BigIpTestSuite) Test_AddRemoveRoutes_ReturnErr_IfStatusNot200OK() {
 	bigIp := NewBigIp(s.badConfigServer.URL, s.bigIPKeyFile)
 	assert.NotNil(s.T(), bigIp, "should return bigIp")
@@ -97,45 +548,1721 @@ func (s *BigIpTestSuite) Test_AddRemoveRoutes_ReturnErr_IfStatusNot200OK() {
 	labels["com.df.servicePath"] = "true"
 	err := bigIp.AddRoutes(s.getSwarmServices("123abc", labels))
 	s.Error(err)
-	bigIp.Services["123abc"] = []string{"/test"}
+	bigIp.Services["123abc"] = ServiceRoutes{Paths: []string{"/test"}}
+
+	err = bigIp.RemoveRoutes(&[]string{"123abc"})
+	s.Error(err)
+}
+
+func (s *BigIpTestSuite) Test_Add_Remove_Routes() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	assert.NotNil(s.T(), bigIp, "should return bigIp")
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+	assert.Nil(s.T(), err, "should not return err")
+	assert.True(s.T(), len(bigIp.Services) > 0, "cache size should be > 0")
+	value, ok := bigIp.Services[SERVICE_ID]
+	assert.True(s.T(), ok, "service should be added to cache")
+	assert.Equal(s.T(), value.Paths[0], PATH, "path should be added to cache")
+	assert.Equal(s.T(), PATTERN, value.Data, "data should be added to cache")
+	assert.False(s.T(), value.AddedAt.IsZero(), "added timestamp should be populated")
+
+	err = bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+	assert.Nil(s.T(), err, "should not return err")
+	assert.True(s.T(), len(bigIp.Services) == 0, "cache size should be > 0")
+}
+
+func (s *BigIpTestSuite) Test_RemovePathRecords_IsSerializedWithReconcile() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		id := fmt.Sprintf("service-%d", i)
+		services := s.getSwarmServices(id, map[string]string{"com.df.servicePath": "/" + id + ",/shared"})
+		go func() {
+			defer wg.Done()
+			bigIp.AddRoutes(services)
+		}()
+		go func() {
+			defer wg.Done()
+			bigIp.RemovePathRecords([]string{"/shared"})
+		}()
+	}
+	wg.Wait()
+
+	bigIp.RemovePathRecords([]string{"/shared"})
+
+	assert.Len(s.T(), bigIp.GetRoutes(), 20)
+	for id, routes := range bigIp.GetRoutes() {
+		assert.Equal(s.T(), []string{"/" + id}, routes.Paths)
+	}
+	assert.Len(s.T(), srv.records(DG), 20)
+}
+
+func (s *BigIpTestSuite) Test_RemovePaths_KeepsRemainingPaths() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{"/test-1", "/test-2"}}
+
+	err := bigIp.RemovePaths(SERVICE_ID, []string{"/test-1"})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"/test-2"}, bigIp.Services[SERVICE_ID].Paths, "only the removed path should be dropped from cache")
+}
+
+func (s *BigIpTestSuite) Test_RemovePaths_ReturnsErr_IfServiceNotCached() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+
+	err := bigIp.RemovePaths("not-cached", []string{"/test-1"})
+
+	s.Error(err)
+}
+
+func (s *BigIpTestSuite) Test_RemovePaths_RemovesOnlyPathsOfTheService() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/a", Data: PATTERN},
+		{Name: "/b", Data: PATTERN},
+		{Name: "/c", Data: PATTERN},
+	}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Services["service-1"] = ServiceRoutes{Paths: []string{"/a", "/b"}, Data: PATTERN}
+	bigIp.Services["service-2"] = ServiceRoutes{Paths: []string{"/c"}, Data: PATTERN}
+
+	err := bigIp.RemovePaths("service-1", []string{"/B"})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/a", Data: PATTERN}, {Name: "/c", Data: PATTERN}}, srv.records(DG))
+	assert.Equal(s.T(), map[string]ServiceRoutes{
+		"service-1": {Paths: []string{"/a"}, Data: PATTERN},
+		"service-2": {Paths: []string{"/c"}, Data: PATTERN},
+	}, bigIp.GetRoutes())
+}
+
+func (s *BigIpTestSuite) Test_RemovePathRecords_RemovesPathsOfAnyService() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/a", Data: PATTERN},
+		{Name: "/b", Data: PATTERN},
+		{Name: "/c", Data: PATTERN},
+		{Name: "/d", Data: PATTERN},
+	}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Services["service-1"] = ServiceRoutes{Paths: []string{"/a", "/b"}, Data: PATTERN}
+	bigIp.Services["service-2"] = ServiceRoutes{Paths: []string{"/c"}, Data: PATTERN}
+
+	err := bigIp.RemovePathRecords([]string{"/B", "/c", "/d"})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/a", Data: PATTERN}}, srv.records(DG))
+	assert.Equal(s.T(), map[string]ServiceRoutes{"service-1": {Paths: []string{"/a"}, Data: PATTERN}}, bigIp.GetRoutes())
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_ReloadsKey_WhenKeyIsRejected() {
+	keyFile := "/tmp/secrets/bigip-rotated-key"
+	ioutil.WriteFile(keyFile, []byte("old-key"), 0644)
+	defer os.Remove(keyFile)
+	keys := []string{}
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(BIGIP_HEADER))
+		if r.Header.Get(BIGIP_HEADER) != "new-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"records":[]}`))
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "old-key")
+	bigIp.KeyFile = keyFile
+	ioutil.WriteFile(keyFile, []byte("new-key\n"), 0644)
+
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), "new-key", bigIp.Key, "key should be reloaded from the key file")
+	assert.Equal(s.T(), []string{"old-key", "new-key", "new-key"}, keys, "the rejected request should be retried with the new key")
+}
+
+func (s *BigIpTestSuite) Test_Ping_ReloadsKey_WhenKeyIsRejected() {
+	keyFile := "/tmp/secrets/bigip-rotated-key"
+	ioutil.WriteFile(keyFile, []byte("old-key"), 0644)
+	defer os.Remove(keyFile)
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(BIGIP_HEADER) != "new-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "old-key")
+	bigIp.KeyFile = keyFile
+
+	err := bigIp.Ping()
+
+	assert.NotNil(s.T(), err, "should return err while the key file holds the rejected key")
+	ioutil.WriteFile(keyFile, []byte("new-key"), 0644)
+	err = bigIp.Ping()
+	assert.Nil(s.T(), err, "should not return err once the key file holds the new key")
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_KeepsAddedAt_WhenServiceIsUpdated() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	addedAt := time.Now().Add(-time.Hour)
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{"/test-1"}, AddedAt: addedAt}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/test-1,/test-2"
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), addedAt, bigIp.GetRoutes()[SERVICE_ID].AddedAt, "added timestamp should be kept")
+	assert.Equal(s.T(), []string{"/test-1", "/test-2"}, bigIp.GetRoutes()[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AddRemoveRoutes_UsesDomainDataGroup() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.DomainUrl = getDataGroupUrl(srv.URL, "domain-dg")
+	labels := make(map[string]string)
+	labels["com.df.serviceDomain"] = "Example.com"
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "example.com", Data: PATTERN}}, srv.records("domain-dg"))
+	assert.Empty(s.T(), srv.records(DG), "path data group should not be updated")
+	assert.Equal(s.T(), []string{"example.com"}, bigIp.Services[SERVICE_ID].Domains)
+	assert.Empty(s.T(), bigIp.Services[SERVICE_ID].Paths)
+
+	err = bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Empty(s.T(), srv.records("domain-dg"))
+	assert.Empty(s.T(), bigIp.Services)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_RollsBackPaths_WhenDomainUpdateFails() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	domainSrv := badServer()
+	defer domainSrv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.DomainUrl = getDataGroupUrl(domainSrv.URL, "domain-dg")
+	labels := map[string]string{"com.df.servicePath": "/demo", "com.df.serviceDomain": "example.com"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	s.Error(err)
+	assert.Equal(s.T(), 2, srv.puts, "paths should be written and then rolled back")
+	assert.Empty(s.T(), srv.records(DG))
+	assert.NotContains(s.T(), bigIp.Services, SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_RestoresPreviousPaths_WhenDomainUpdateOfUpdatedServiceFails() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	domainSrv := badServer()
+	defer domainSrv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/demo"}))
+	bigIp.DomainUrl = getDataGroupUrl(domainSrv.URL, "domain-dg")
+	labels := map[string]string{"com.df.servicePath": "/demo-v2", "com.df.serviceDomain": "example.com"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	s.Error(err)
+	assert.Equal(s.T(), []Record{{Name: "/demo", Data: PATTERN}}, srv.records(DG))
+	assert.Equal(s.T(), []string{"/demo"}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_IgnoresDomain_WhenDomainDataGroupIsNotSet() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	labels := make(map[string]string)
+	labels["com.df.serviceDomain"] = "example.com"
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 0, srv.puts)
+	assert.Empty(s.T(), bigIp.Services)
+}
+
+func (s *BigIpTestSuite) Test_LoadCache_DiscardsMalformedCacheFile() {
+	cacheFile := "/tmp/bigip-test-cache.json"
+	ioutil.WriteFile(cacheFile, []byte(`{"`+SERVICE_ID+`":{"paths":["/te`), 0644)
+	defer os.Remove(cacheFile)
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.CacheFile = cacheFile
+
+	assert.NotPanics(s.T(), func() { bigIp.loadCache() })
+
+	assert.Empty(s.T(), bigIp.Services, "cache should be empty")
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{PATH}, bigIp.Services[SERVICE_ID].Paths, "cache should be usable")
+}
+
+func (s *BigIpTestSuite) Test_SaveCache_WritesCacheFileThatLoads() {
+	cacheFile := "/tmp/bigip-test-cache.json"
+	defer os.Remove(cacheFile)
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.CacheFile = cacheFile
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	loaded := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	loaded.CacheFile = cacheFile
+	loaded.loadCache()
+
+	assert.Equal(s.T(), []string{PATH}, loaded.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_SaveCache_WritesCompressedCacheFileThatLoads() {
+	cacheFile := "/tmp/bigip-test-cache.json.gz"
+	defer os.Remove(cacheFile)
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.CacheFile = cacheFile
+	bigIp.CompressCache = true
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	content, _ := ioutil.ReadFile(cacheFile)
+	assert.Equal(s.T(), []byte{0x1f, 0x8b}, content[:2], "cache file should be compressed with gzip")
+	loaded := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	loaded.CacheFile = cacheFile
+	loaded.loadCache()
+
+	assert.Equal(s.T(), []string{PATH}, loaded.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_LoadCache_LoadsUncompressedCacheFile_WhenCompressCacheIsSet() {
+	cacheFile := "/tmp/bigip-test-cache.json"
+	ioutil.WriteFile(cacheFile, []byte(`{"`+SERVICE_ID+`":{"paths":["`+PATH+`"]}}`), 0644)
+	defer os.Remove(cacheFile)
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	bigIp.CacheFile = cacheFile
+	bigIp.CompressCache = true
+
+	bigIp.loadCache()
+
+	assert.Equal(s.T(), []string{PATH}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+// newAdoptingBigIp returns a BigIp created from env vars that adopts the records of srv
+func (s *BigIpTestSuite) newAdoptingBigIp(srv *dataGroupServer, cacheFile string) *BigIp {
+	configSrv := configServer(srv.URL, DG, PATTERN, "service")
+	defer configSrv.Close()
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_OWNER", "listener-a")
+	os.Setenv("DF_BIGIP_ADOPT_RECORDS", "true")
+	defer func() {
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_OWNER")
+		os.Unsetenv("DF_BIGIP_ADOPT_RECORDS")
+	}()
+	return newBigIpFromEnv(configSrv.URL, cacheFile)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_AdoptsOwnedRecords_WhenCacheFileIsMissing() {
+	cacheFile := "/tmp/bigip-test-cache.json"
+	os.Remove(cacheFile)
+	defer os.Remove(cacheFile)
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/a", Data: PATTERN + "|owner=listener-a"},
+		{Name: "/b", Data: PATTERN + "|owner=listener-a"},
+		{Name: "/c", Data: "other-pool|owner=listener-a"},
+		{Name: "/d", Data: PATTERN + "|owner=listener-b"},
+	}}
+
+	bigIp := s.newAdoptingBigIp(srv, cacheFile)
+
+	assert.Len(s.T(), bigIp.Services, 2)
+	assert.Equal(s.T(), []string{"/a", "/b"}, bigIp.Services[ADOPTED_PREFIX+PATTERN].Paths)
+	assert.Equal(s.T(), PATTERN, bigIp.Services[ADOPTED_PREFIX+PATTERN].Data)
+	assert.Equal(s.T(), []string{"/c"}, bigIp.Services[ADOPTED_PREFIX+"other-pool"].Paths)
+	assert.True(s.T(), cacheFileExists(cacheFile), "adopted routes should be cached")
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_AdoptsOwnedRecords_OfDomainDataGroup() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+"domain-dg"] = &DataGroup{Records: []Record{
+		{Name: "a.example.com", Data: PATTERN + "|owner=listener-a"},
+		{Name: "b.example.com", Data: PATTERN + "|owner=listener-b"},
+	}}
+	os.Setenv("DF_BIGIP_DOMAIN_DG", "domain-dg")
+	defer os.Unsetenv("DF_BIGIP_DOMAIN_DG")
+
+	bigIp := s.newAdoptingBigIp(srv, "")
+
+	assert.Len(s.T(), bigIp.Services, 1)
+	assert.Equal(s.T(), []string{"a.example.com"}, bigIp.Services[ADOPTED_PREFIX+PATTERN].Domains)
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_AdoptsOwnedRecordsOfServiceDataGroup_WhenItIsFirstUsed() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+"service-dg"] = &DataGroup{Records: []Record{
+		{Name: "/a", Data: PATTERN + "|owner=listener-a"},
+		{Name: "/b", Data: PATTERN + "|owner=listener-a"},
+	}}
+	bigIp := s.newAdoptingBigIp(srv, "")
+	labels := map[string]string{"com.df.servicePath": "/a", "com.df.bigipDataGroup": "service-dg"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	adopted := bigIp.Services[ADOPTED_PREFIX+"service-dg:"+PATTERN]
+	assert.Equal(s.T(), []string{"/b"}, adopted.Paths, "paths of the service should be released")
+	assert.Equal(s.T(), "service-dg", adopted.DataGroup)
+	assert.Equal(s.T(), []string{"/a"}, bigIp.Services[SERVICE_ID].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AdoptDataGroup_SkipsCachedRecords_AndAdoptsOnlyOnce() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/a", Data: PATTERN + "|owner=listener-a"},
+		{Name: "/b", Data: PATTERN + "|owner=listener-a"},
+	}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Owner = "listener-a"
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{"/a"}, Data: PATTERN}
+
+	bigIp.adoptDataGroup(bigIp.Url, "", false)
+	bigIp.adoptDataGroup(bigIp.Url, "", false)
+
+	assert.Len(s.T(), bigIp.Services, 2)
+	assert.Equal(s.T(), []string{"/b"}, bigIp.Services[ADOPTED_PREFIX+PATTERN].Paths)
+}
+
+func (s *BigIpTestSuite) Test_AdoptRecords_DoesNotAdoptRecords_WhenOwnerIsNotSet() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/a", Data: PATTERN}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	bigIp.adoptRecords()
+
+	assert.Empty(s.T(), bigIp.Services, "records without an owner tag could belong to anyone")
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_DoesNotAdoptRecords_WhenCacheFileExists() {
+	cacheFile := "/tmp/bigip-test-cache.json"
+	ioutil.WriteFile(cacheFile, []byte(`{"`+SERVICE_ID+`":{"paths":["`+PATH+`"]}}`), 0644)
+	defer os.Remove(cacheFile)
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/a", Data: PATTERN + "|owner=listener-a"}}}
+
+	bigIp := s.newAdoptingBigIp(srv, cacheFile)
+
+	assert.Len(s.T(), bigIp.Services, 1)
+	assert.Contains(s.T(), bigIp.Services, SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_RemoveRoutes_KeepsRecordsOfServices_WhenAdoptedRoutesAreRemoved() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/a", Data: PATTERN + "|owner=listener-a"},
+		{Name: "/b", Data: PATTERN + "|owner=listener-a"},
+	}}
+	bigIp := s.newAdoptingBigIp(srv, "")
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/a"}))
+	assert.Nil(s.T(), err, "should not return err")
+
+	err = bigIp.RemoveRoutes(&[]string{ADOPTED_PREFIX + PATTERN})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/a", Data: PATTERN + "|owner=listener-a"}}, srv.records(DG))
+	assert.Len(s.T(), bigIp.Services, 1)
+	assert.Contains(s.T(), bigIp.Services, SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_RemoveRoutes_KeepsRoutesOfServiceWithSameNameInAnotherStack() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	services := []service.SwarmService{}
+	for _, stack := range []string{"stack-a", "stack-b"} {
+		labels := map[string]string{"com.docker.stack.namespace": stack, "com.df.shortName": "true", "com.df.servicePath": "/" + stack}
+		ss := (*s.getSwarmServices(stack+"-api-id", labels))[0]
+		ss.Spec.Name = stack + "_api"
+		services = append(services, ss)
+	}
+	err := bigIp.AddRoutes(&services)
+	assert.Nil(s.T(), err, "should not return err")
+
+	err = bigIp.RemoveRoutes(&[]string{"stack-a-api-id"})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.NotContains(s.T(), bigIp.Services, "stack-a-api-id")
+	assert.Equal(s.T(), []string{"/stack-b"}, bigIp.Services["stack-b-api-id"].Paths)
+	assert.Equal(s.T(), []Record{{Name: "/stack-b", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_AddsAndRemovesWithSinglePut() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/removed", Data: PATTERN}, {Name: "/other", Data: "other"}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Services["removed-id"] = ServiceRoutes{Paths: []string{"/removed"}, Data: PATTERN}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/added"
+
+	err := bigIp.Reconcile(s.getSwarmServices("added-id", labels), &[]string{"removed-id"})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 1, srv.puts, "data group should be updated with a single PUT")
+	assert.Equal(s.T(), []Record{{Name: "/added", Data: PATTERN}, {Name: "/other", Data: "other"}}, srv.records(DG))
+	_, ok := bigIp.Services["removed-id"]
+	assert.False(s.T(), ok, "removed service should be deleted from cache")
+	assert.Equal(s.T(), []string{"/added"}, bigIp.Services["added-id"].Paths)
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_RewritesDataGroup_WhenAuthoritative() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/drift", Data: "other"}, {Name: "/cached", Data: "stale"}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Authoritative = true
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/added"
+
+	err := bigIp.Reconcile(s.getSwarmServices("added-id", labels), &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 1, srv.puts, "data group should be updated with a single PUT")
+	assert.Equal(s.T(), []Record{{Name: "/added", Data: PATTERN}, {Name: "/cached", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_GetDrift_ReportsUntrackedAndMissingRecords() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	owned := PATTERN + OWNER_DELIMITER + "me"
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/tracked", Data: owned},
+		{Name: "/untracked", Data: owned},
+		{Name: "/stale", Data: "old-pattern" + OWNER_DELIMITER + "me"},
+		{Name: "/other-owner", Data: PATTERN + OWNER_DELIMITER + "other"},
+	}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Owner = "me"
+	bigIp.Services["tracked-id"] = ServiceRoutes{Name: "tracked", Paths: []string{"/tracked", "/stale"}, Data: PATTERN}
+	bigIp.Services["missing-id"] = ServiceRoutes{Name: "missing", Paths: []string{"/missing"}, Data: PATTERN}
+
+	drifts, err := bigIp.GetDrift()
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []DataGroupDrift{{
+		DataGroup: DG,
+		Untracked: []Record{{Name: "/untracked", Data: owned}, {Name: "/stale", Data: "old-pattern" + OWNER_DELIMITER + "me"}},
+		Missing: []MissingRecord{
+			{ServiceID: "missing-id", Service: "missing", Record: Record{Name: "/missing", Data: owned}},
+			{ServiceID: "tracked-id", Service: "tracked", Record: Record{Name: "/stale", Data: owned}},
+		},
+	}}, drifts)
+	assert.Equal(s.T(), 0, srv.puts, "data group should not be updated")
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_EncodesExpiry_WhenTTLLabelIsSet() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	labels := map[string]string{"com.df.servicePath": PATH, "com.df.bigipTTL": "60"}
+	before := time.Now().Unix()
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	routes := bigIp.GetRoutes()[SERVICE_ID]
+	assert.True(s.T(), routes.ExpiresAt >= before+60 && routes.ExpiresAt <= time.Now().Unix()+60, "expiry should be 60 seconds from now")
+	assert.Equal(s.T(), []Record{{Name: PATH, Data: fmt.Sprintf("%s|expires=%d", PATTERN, routes.ExpiresAt)}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_RendersExpiryWithTTLTemplate() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.TTLTemplate = template.Must(template.New("ttl").Parse("{{.Data}};until={{.ExpiresAt}}"))
+	labels := map[string]string{"com.df.servicePath": PATH, "com.df.bigipTTL": "1h"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	expiresAt := time.Unix(bigIp.GetRoutes()[SERVICE_ID].ExpiresAt, 0).UTC().Format(time.RFC3339)
+	assert.Equal(s.T(), []Record{{Name: PATH, Data: PATTERN + ";until=" + expiresAt}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_KeepsData_WhenTTLLabelIsInvalid() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	labels := map[string]string{"com.df.servicePath": PATH, "com.df.bigipTTL": "soon"}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: PATH, Data: PATTERN}}, srv.records(DG))
+	assert.Equal(s.T(), int64(0), bigIp.GetRoutes()[SERVICE_ID].ExpiresAt)
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_RenewsExpiry_WhenLessThanHalfOfTTLIsLeft() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	expiresAt := time.Now().Unix() + 10
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: PATH, Data: fmt.Sprintf("%s|expires=%d", PATTERN, expiresAt)}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{PATH}, Data: fmt.Sprintf("%s|expires=%d", PATTERN, expiresAt), TTL: 60, ExpiresAt: expiresAt, BaseData: PATTERN}
+
+	err := bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	renewed := bigIp.GetRoutes()[SERVICE_ID]
+	assert.True(s.T(), renewed.ExpiresAt > expiresAt, "expiry should be renewed")
+	assert.Equal(s.T(), []Record{{Name: PATH, Data: fmt.Sprintf("%s|expires=%d", PATTERN, renewed.ExpiresAt)}}, srv.records(DG))
+
+	puts := srv.puts
+	err = bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), puts, srv.puts, "expiry should not be renewed while more than half of the TTL is left")
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_WritesPathsToDataGroupOfService() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/default", Data: PATTERN}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/other"
+	labels["com.df.bigipDataGroup"] = "other-dg"
+
+	err := bigIp.Reconcile(s.getSwarmServices("other-id", labels), &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/other", Data: PATTERN}}, srv.records("other-dg"))
+	assert.Equal(s.T(), []Record{{Name: "/default", Data: PATTERN}}, srv.records(DG), "default data group should be left alone")
+	assert.Equal(s.T(), "other-dg", bigIp.GetRoutes()["other-id"].DataGroup)
+
+	err = bigIp.Reconcile(&[]service.SwarmService{}, &[]string{"other-id"})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Empty(s.T(), srv.records("other-dg"), "paths should be removed from the data group of the service")
+	assert.Equal(s.T(), []Record{{Name: "/default", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_CachesNewServiceOfAnotherDataGroup_WhenDefaultDataGroupFails() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.failPuts = map[string]bool{DG_PATH + DG: true}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	services := *s.getSwarmServices("default-id", map[string]string{"com.df.servicePath": "/default"})
+	services = append(services, (*s.getSwarmServices("other-id", map[string]string{"com.df.servicePath": "/other", "com.df.bigipDataGroup": "other-dg"}))...)
+
+	err := bigIp.Reconcile(&services, &[]string{})
+
+	assert.Error(s.T(), err, "the failure of the default data group should be returned")
+	assert.Equal(s.T(), []Record{{Name: "/other", Data: PATTERN}}, srv.records("other-dg"))
+	assert.Equal(s.T(), []string{"/other"}, bigIp.GetRoutes()["other-id"].Paths, "written paths should be cached")
+	assert.NotContains(s.T(), bigIp.GetRoutes(), "default-id")
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_RewritesDataGroupsOfServices_WhenAuthoritative() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Authoritative = true
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/other"
+	labels["com.df.bigipDataGroup"] = "other-dg"
+
+	err := bigIp.Reconcile(s.getSwarmServices("other-id", labels), &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/cached", Data: PATTERN}}, srv.records(DG))
+	assert.Equal(s.T(), []Record{{Name: "/other", Data: PATTERN}}, srv.records("other-dg"))
+}
+
+func (s *BigIpTestSuite) Test_MarshalExternalRecords() {
+	records := []Record{{Name: "/demo", Data: "pool-demo"}, {Name: "/other", Data: "pool-other:8080"}}
+
+	actual := marshalExternalRecords(records)
+
+	assert.Equal(s.T(), "\"/demo\" := \"pool-demo\",\n\"/other\" := \"pool-other:8080\",\n", string(actual))
+	assert.Equal(s.T(), "", string(marshalExternalRecords([]Record{})))
+}
+
+func (s *BigIpTestSuite) Test_GetContentRange() {
+	assert.Equal(s.T(), "0-41/42", getContentRange(42))
+	assert.Equal(s.T(), "0-0/0", getContentRange(0))
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_UploadsRecordsFile_WhenGroupIsExternal() {
+	var lock sync.Mutex
+	requests := []string{}
+	uploaded := ""
+	contentRange := ""
+	sourcePath := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case FILE_UPLOAD_PATH + DG:
+			uploaded = string(body)
+			contentRange = r.Header.Get("Content-Range")
+		case FILE_DG_PATH + DG:
+			json.Unmarshal(body, &sourcePath)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.GroupType = GROUP_TYPE_EXTERNAL
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/added"
+
+	err := bigIp.Reconcile(s.getSwarmServices("added-id", labels), &[]string{})
+
+	expected := fmt.Sprintf("%q := %q,\n%q := %q,\n", "/added", PATTERN, "/cached", PATTERN)
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{"POST " + FILE_UPLOAD_PATH + DG, "PUT " + FILE_DG_PATH + DG}, requests)
+	assert.Equal(s.T(), expected, uploaded)
+	assert.Equal(s.T(), fmt.Sprintf("0-%d/%d", len(expected)-1, len(expected)), contentRange)
+	assert.Equal(s.T(), "file:"+FILE_UPLOAD_DIR+DG, sourcePath["sourcePath"])
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_RewritesDataGroupWithoutChanges_WhenAuthoritative() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/drift", Data: "other"}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Authoritative = true
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+
+	err := bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/cached", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_DoesNotUpdateDataGroupWithoutChanges() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+
+	err := bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 0, srv.puts, "data group should not be updated")
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_TagsRecordsWithOwner() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Owner = "listener-a"
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: PATH, Data: PATTERN + "|owner=listener-a"}}, srv.records(DG))
+	assert.Equal(s.T(), PATTERN, bigIp.Services[SERVICE_ID].Data, "cached data should not include the owner")
+}
+
+func (s *BigIpTestSuite) Test_RemoveRoutes_RemovesOnlyOwnedRecords() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/shared", Data: "other-pool"},
+		{Name: "/shared", Data: PATTERN + "|owner=listener-b"},
+		{Name: "/shared", Data: PATTERN + "|owner=listener-a"},
+	}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Owner = "listener-a"
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{"/shared"}, Data: PATTERN}
+
+	err := bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/shared", Data: "other-pool"}, {Name: "/shared", Data: PATTERN + "|owner=listener-b"}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_SkipsRecords_WhoseNameIsUsedByAnotherOwner() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: PATH, Data: PATTERN + "|owner=listener-b"}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Owner = "listener-a"
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH + ",/other"
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/other", Data: PATTERN + "|owner=listener-a"}, {Name: PATH, Data: PATTERN + "|owner=listener-b"}}, srv.records(DG))
+	assert.Contains(s.T(), buf.String(), "WARNING: Record "+PATH+" is not added")
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_SkipsRecords_WhoseNameIsUsedByAnotherOwner_WhenAuthoritative() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/cached", Data: "other-pool"}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Authoritative = true
+	bigIp.Owner = "listener-a"
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+
+	err := bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/cached", Data: "other-pool"}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_WritesAuditRecord() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	buf := &bytes.Buffer{}
+	bigIp.audit = &auditLog{w: buf}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	services := s.getSwarmServices(SERVICE_ID, labels)
+
+	err := bigIp.AddRoutes(services)
+
+	assert.Nil(s.T(), err, "should not return err")
+	records := s.getAuditRecords(buf)
+	assert.Len(s.T(), records, 1, "should write a record per change")
+	assert.Equal(s.T(), "add", records[0]["action"])
+	assert.Equal(s.T(), (*services)[0].Spec.Name, records[0]["service"])
+	assert.Equal(s.T(), SERVICE_ID, records[0]["serviceId"])
+	assert.Equal(s.T(), []interface{}{PATH}, records[0]["paths"])
+	assert.Equal(s.T(), DG, records[0]["dataGroup"])
+	assert.Equal(s.T(), srv.URL, records[0]["bigIp"])
+	assert.NotEmpty(s.T(), records[0]["ts"], "should be timestamped")
+}
+
+func (s *BigIpTestSuite) Test_RemoveRoutes_WritesAuditRecord() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: PATH, Data: PATTERN}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	buf := &bytes.Buffer{}
+	bigIp.audit = &auditLog{w: buf}
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{PATH}, Data: PATTERN, Name: SERVICE_NAME}
+
+	err := bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+
+	assert.Nil(s.T(), err, "should not return err")
+	records := s.getAuditRecords(buf)
+	assert.Len(s.T(), records, 1, "should write a record per change")
+	assert.Equal(s.T(), "remove", records[0]["action"])
+	assert.Equal(s.T(), SERVICE_NAME, records[0]["service"])
+	assert.Equal(s.T(), SERVICE_ID, records[0]["serviceId"])
+	assert.Equal(s.T(), []interface{}{PATH}, records[0]["paths"])
+	assert.Equal(s.T(), DG, records[0]["dataGroup"])
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_DoesNotWriteAuditRecord_WhenRoutesAreUnchanged() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	services := s.getSwarmServices(SERVICE_ID, labels)
+	bigIp.AddRoutes(services)
+	buf := &bytes.Buffer{}
+	bigIp.audit = &auditLog{w: buf}
+
+	err := bigIp.AddRoutes(services)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Empty(s.T(), buf.String(), "should not write audit records")
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_KeepsRecordsOfOtherOwners_WhenAuthoritative() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{
+		{Name: "/other", Data: "other-pool"},
+		{Name: "/stale", Data: PATTERN + "|owner=listener-a"},
+	}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Authoritative = true
+	bigIp.Owner = "listener-a"
+	bigIp.Services["cached-id"] = ServiceRoutes{Paths: []string{"/cached"}, Data: PATTERN}
+
+	err := bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/cached", Data: PATTERN + "|owner=listener-a"}, {Name: "/other", Data: "other-pool"}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_Reconcile_CoalescesChangesWithinMinWriteInterval() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.MinWriteInterval = time.Hour
+	pathLabels := func(path string) map[string]string {
+		return map[string]string{"com.df.servicePath": path}
+	}
+
+	bigIp.Reconcile(s.getSwarmServices("first-id", pathLabels("/first")), &[]string{})
+	bigIp.Reconcile(s.getSwarmServices("second-id", pathLabels("/second")), &[]string{})
+	bigIp.Reconcile(s.getSwarmServices("third-id", pathLabels("/third")), &[]string{})
+	bigIp.Reconcile(s.getSwarmServices("third-id", pathLabels("/third-updated")), &[]string{})
+	bigIp.Reconcile(&[]service.SwarmService{}, &[]string{"second-id"})
+
+	assert.Equal(s.T(), 1, srv.puts, "changes within the interval should be deferred")
+	assert.Equal(s.T(), []Record{{Name: "/first", Data: PATTERN}}, srv.records(DG))
+
+	bigIp.lastWrite = time.Now().Add(-2 * time.Hour)
+	err := bigIp.Reconcile(&[]service.SwarmService{}, &[]string{})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 2, srv.puts, "deferred changes should be flushed with a single PUT")
+	assert.Equal(s.T(), []Record{{Name: "/first", Data: PATTERN}, {Name: "/third-updated", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_ReplacesRecordsOfUpdatedService() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/old", Data: PATTERN}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.Services[SERVICE_ID] = ServiceRoutes{Paths: []string{"/old"}, Data: PATTERN}
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = "/new"
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/new", Data: PATTERN}}, srv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_Marshall_Error() {
+	bigIp := NewBigIp(s.errorConfigServer.URL, s.bigIPKeyFile)
+	assert.NotNil(s.T(), bigIp, "should return bigIp")
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = PATH
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+	s.Error(err)
+}
+
+func (s *BigIpTestSuite) Test_NoopBigIp_ReturnsNil() {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer srv.Close()
+	labels := make(map[string]string)
+	labels["com.df.servicePath"] = srv.URL
+	var bigIp BigIpClient = noopBigIp{}
+
+	assert.Nil(s.T(), bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels)), "AddRoutes should not return err")
+	assert.Nil(s.T(), bigIp.RemoveRoutes(&[]string{SERVICE_ID}), "RemoveRoutes should not return err")
+	assert.False(s.T(), requested, "no request should be sent")
+}
+
+func (s *BigIpTestSuite) Test_NewRequest() {
+	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	req, err := bigIp.newRequest(context.Background(), "GET", bigIp.Url, nil)
+	assert.Nil(s.T(), err, "newRequest with GET should not result in err")
+	assert.NotNil(s.T(), req, "newRequest with GET should not return req object")
+	val := req.Header.Get(BIGIP_HEADER)
+	assert.True(s.T(), val == "test-key-value", "newRequest sets the BIGIP_HEADER")
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_UsesPerOperationTimeouts() {
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"records":[]}`))
+	}))
+	defer bigIpSrv.Close()
+	configSrv := configServer(bigIpSrv.URL, DG, PATTERN, "service")
+	defer configSrv.Close()
+	bigIp := NewBigIp(configSrv.URL, s.bigIPKeyFile)
+
+	bigIp.GetTimeout = 10 * time.Millisecond
+	bigIp.PutTimeout = time.Second
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+	s.Error(err, "short GET deadline should error")
+
+	bigIp.GetTimeout = time.Second
+	bigIp.PutTimeout = 10 * time.Millisecond
+	err = bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+	s.Error(err, "short PUT deadline should error")
+
+	bigIp.GetTimeout = time.Second
+	bigIp.PutTimeout = time.Second
+	err = bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+	assert.Nil(s.T(), err, "longer deadlines should succeed")
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_HonorsRetryAfter() {
+	tests := []struct {
+		retryAfter string
+		minWait    time.Duration
+		maxWait    time.Duration
+	}{
+		{"2", 2 * time.Second, 2 * time.Second},
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+	}
+	for _, t := range tests {
+		requests := 0
+		bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.Header().Set("Retry-After", t.retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"records":[]}`))
+		}))
+		waits := []time.Duration{}
+		sleepOrig := sleep
+		sleep = func(d time.Duration) { waits = append(waits, d) }
+		bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+		err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+		sleep = sleepOrig
+		bigIpSrv.Close()
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), 3, requests, "rate-limited GET should be retried before PUT")
+		if assert.Len(s.T(), waits, 1) {
+			assert.True(s.T(), waits[0] >= t.minWait && waits[0] <= t.maxWait, "unexpected wait %s for Retry-After %s", waits[0], t.retryAfter)
+		}
+	}
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_ReturnsErr_WhenRecordsAreNested() {
+	puts := 0
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			return
+		}
+		w.Write([]byte(`{"kind":"tm:ltm:data-group:internal:internalstate","name":"dg","data":{"records":[{"name":"/demo","data":"pool"}]}}`))
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+	s.Error(err)
+	assert.Equal(s.T(), 0, puts, "data group should not be written")
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_AcceptsUnknownFieldsAndMissingRecords() {
+	tests := []string{
+		`{"kind":"tm:ltm:data-group:internal:internalstate","name":"dg","type":"string"}`,
+		`{"kind":"tm:ltm:data-group:internal:internalstate","name":"dg","records":[{"name":"/demo","data":"pool","extra":true}]}`,
+	}
+	for _, t := range tests {
+		puts := 0
+		bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				puts++
+				return
+			}
+			w.Write([]byte(t))
+		}))
+		bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+		err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+		bigIpSrv.Close()
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), 1, puts)
+	}
+}
+
+func (s *BigIpTestSuite) Test_PutDataGroup_SendsExpectedPayload() {
+	tests := []struct {
+		envelope string
+		records  []Record
+		expected string
+	}{
+		{"", []Record{{Name: "/demo", Data: PATTERN}}, `{"records":[{"name":"/demo","data":"test-pattern"}]}`},
+		{"", nil, `{"records":[]}`},
+		{"data", []Record{{Name: "/demo", Data: PATTERN}}, `{"data":{"records":[{"name":"/demo","data":"test-pattern"}]}}`},
+	}
+	for _, t := range tests {
+		body := ""
+		bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			payload, _ := ioutil.ReadAll(r.Body)
+			body = string(payload)
+		}))
+		bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+		bigIp.PayloadEnvelope = t.envelope
+
+		err := bigIp.putDataGroup(bigIp.Url, &DataGroup{Records: t.records})
+
+		bigIpSrv.Close()
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, body)
+	}
+}
+
+func (s *BigIpTestSuite) Test_PutDataGroup_IndentsPayload_WhenPrettyPayloadIsSet() {
+	body := ""
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+		body = string(payload)
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.PrettyPayload = true
+
+	err := bigIp.putDataGroup(bigIp.Url, &DataGroup{Records: []Record{{Name: "/demo", Data: PATTERN}}})
+
+	expected := `{
+  "records": [
+    {
+      "name": "/demo",
+      "data": "test-pattern"
+    }
+  ]
+}`
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), expected, body)
+}
+
+func (s *BigIpTestSuite) Test_MarshalDataGroup_SortsRecordsByName() {
+	bigIp := newBigIp(&Config{Host: "http://bigip.invalid", DataGroup: DG}, "")
+	records := []Record{{Name: "/demo", Data: "demo-pool"}, {Name: "/api", Data: "api-pool"}, {Name: "/cart", Data: "cart-pool"}}
+
+	payload, err := bigIp.marshalDataGroup(&DataGroup{Records: records})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), `{"records":[{"name":"/api","data":"api-pool"},{"name":"/cart","data":"cart-pool"},{"name":"/demo","data":"demo-pool"}]}`, string(payload))
+	assert.Equal(s.T(), "/demo", records[0].Name, "the order of the records passed in should be kept")
+}
+
+func (s *BigIpTestSuite) Test_MarshalDataGroup_RoundTripsRecordFormats() {
+	records := []Record{{Name: "/a", Data: PATTERN}, {Name: "/b", Data: "other"}}
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{RECORD_FORMAT_ARRAY, `{"records":[{"name":"/a","data":"test-pattern"},{"name":"/b","data":"other"}]}`},
+		{RECORD_FORMAT_MAP, `{"records":{"/a":"test-pattern","/b":"other"}}`},
+	}
+	for _, t := range tests {
+		bigIp := newBigIp(&Config{Host: "http://bigip", DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+		bigIp.RecordFormat = t.format
+
+		payload, err := bigIp.marshalDataGroup(&DataGroup{Records: records})
+
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, string(payload), "format %s", t.format)
+		dg, err := unmarshalDataGroup(payload)
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), records, dg.Records, "format %s", t.format)
+	}
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_WritesMapRecords_WhenRecordFormatIsMap() {
+	body := ""
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"name":"test-dg","records":{"/other":"other"}}`))
+			return
+		}
+		payload, _ := ioutil.ReadAll(r.Body)
+		body = string(payload)
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.RecordFormat = RECORD_FORMAT_MAP
+
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), `{"records":{"/other":"other","/test-path":"test-pattern"}}`, body)
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_RetriesOnVersionConflict() {
+	version := 1
+	ifMatch := []string{}
+	records := `{"records":[{"name":"/other","data":"other-pool"}]}`
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+			w.Write([]byte(records))
+		case "PUT":
+			ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+			if len(ifMatch) == 1 {
+				//Another listener wrote the data group in between
+				version++
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			payload, _ := ioutil.ReadAll(r.Body)
+			records = string(payload)
+		}
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, []Record{{Name: "/demo", Data: PATTERN}}, nil)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []string{`"1"`, `"2"`}, ifMatch, "the retry should write the version it read again")
+	assert.Equal(s.T(), `{"records":[{"name":"/demo","data":"test-pattern"},{"name":"/other","data":"other-pool"}]}`, records)
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_ReturnsErr_WhenVersionConflictPersists() {
+	puts := 0
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		w.Write([]byte(`{"records":[]}`))
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, []Record{{Name: "/demo", Data: PATTERN}}, nil)
+
+	s.Error(err)
+	assert.Equal(s.T(), BIGIP_CONFLICT_RETRIES+1, puts)
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_TruncatesResponseBodyInErr() {
+	body := strings.Repeat("x", service.DEFAULT_ERROR_BODY_LIMIT*4)
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(body))
+	}))
+	defer bigIpSrv.Close()
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, []Record{{Name: "/demo", Data: PATTERN}}, nil)
+
+	s.Require().Error(err)
+	assert.True(s.T(), strings.HasSuffix(err.Error(), "\n"+body[:service.DEFAULT_ERROR_BODY_LIMIT]+"..."), "body should be truncated")
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_SendsRequestID_AndLogsItOnlyOnFailure() {
+	requestIDs := []string{}
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs = append(requestIDs, r.Header.Get("X-Request-ID"))
+		if r.Method == "PUT" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"records":[]}`))
+	}))
+	defer bigIpSrv.Close()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+	assert.Error(s.T(), err)
+	if assert.Len(s.T(), requestIDs, 2) {
+		assert.NotEmpty(s.T(), requestIDs[0])
+		assert.NotEqual(s.T(), requestIDs[0], requestIDs[1], "GET and PUT should have their own request IDs")
+		assert.NotContains(s.T(), logged.String(), requestIDs[0], "successful requests should not be logged")
+		assert.Contains(s.T(), logged.String(), "PUT request to "+bigIp.Url+" with request ID "+requestIDs[1]+" returned status code 500")
+	}
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_ReturnsErr_WhenRateLimitedTooOften() {
+	requests := 0
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer bigIpSrv.Close()
+	sleepOrig := sleep
+	defer func() { sleep = sleepOrig }()
+	sleep = func(d time.Duration) {}
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
 
-	err = bigIp.RemoveRoutes(&[]string{"123abc"})
 	s.Error(err)
+	assert.Equal(s.T(), BIGIP_RATE_LIMIT_RETRIES+1, requests)
 }
 
-func (s *BigIpTestSuite) Test_Add_Remove_Routes() {
+func (s *BigIpTestSuite) Test_FetchConfig_VerifiesCertificate_UnlessConfigApiIsInsecure() {
+	configSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"BIGIP_HOST":"https://bigip","BIGIP_DG":"dg","BIGIP_RWP":"pool"}`))
+	}))
+	defer configSrv.Close()
+	defer os.Unsetenv("DF_CONFIG_API_INSECURE")
+
+	_, err := fetchConfig(configSrv.URL, time.Second)
+	s.Error(err, "self-signed certificate should be rejected")
+
+	os.Setenv("DF_CONFIG_API_INSECURE", "true")
+	_, err = fetchConfig(configSrv.URL, time.Second)
+	assert.Nil(s.T(), err, "should not return err")
+}
+
+func (s *BigIpTestSuite) Test_FetchConfig_ReturnsError_WhenConfigApiReturnsHTML() {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><body>Down for maintenance</body></html>`))
+	}))
+	defer configSrv.Close()
+	errors := getCounterValue("docker_flow_error", "operation", "ConfigApiResponse")
+
+	config, err := fetchConfig(configSrv.URL, time.Second)
+
+	assert.Nil(s.T(), config)
+	assert.Error(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "instead of JSON")
+	assert.Contains(s.T(), err.Error(), "Down for maintenance")
+	assert.Equal(s.T(), errors+1, getCounterValue("docker_flow_error", "operation", "ConfigApiResponse"))
+}
+
+func (s *BigIpTestSuite) Test_FetchConfig_ReturnsError_WhenBodyIsNotAConfig() {
+	for _, body := range []string{`<html>Down for maintenance</html>`, `{}`} {
+		configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+
+		_, err := fetchConfig(configSrv.URL, time.Second)
+
+		configSrv.Close()
+		assert.Error(s.T(), err, "body %s should be rejected", body)
+	}
+}
+
+func (s *BigIpTestSuite) Test_NewBigIp_ConfiguresTLSIndependentlyOfConfigApi() {
+	bigIpSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"records":[]}`))
+	}))
+	defer bigIpSrv.Close()
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API_INSECURE")
+		os.Unsetenv("DF_BIGIP_INSECURE")
+	}()
+
+	os.Setenv("DF_CONFIG_API_INSECURE", "false")
+	bigIp := newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	assert.True(s.T(), bigIp.Client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	assert.Nil(s.T(), bigIp.Ping(), "self-signed BigIp certificate should be accepted by default")
+
+	os.Setenv("DF_CONFIG_API_INSECURE", "true")
+	os.Setenv("DF_BIGIP_INSECURE", "false")
+	bigIp = newBigIp(&Config{Host: bigIpSrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	assert.False(s.T(), bigIp.Client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	s.Error(bigIp.Ping(), "self-signed BigIp certificate should be rejected")
+}
+
+func (s *BigIpTestSuite) Test_RefreshConfig_UpdatesUrlAndPattern_WhenConfigChanges() {
+	requests := 0
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Write([]byte(`{"BIGIP_HOST":"https://bigip-1","BIGIP_DG":"dg","BIGIP_RWP":"pool-1"}`))
+		} else {
+			w.Write([]byte(`{"BIGIP_HOST":"https://bigip-2","BIGIP_DG":"dg","BIGIP_RWP":"pool-2"}`))
+		}
+	}))
+	defer configSrv.Close()
+	bigIp := NewBigIp(configSrv.URL, s.bigIPKeyFile)
+	bigIp.ConfigRefresh = time.Hour
+
+	err := bigIp.RefreshConfig()
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 1, requests, "config should not be read before the refresh interval elapses")
+	assert.Equal(s.T(), "https://bigip-1"+DG_PATH+"dg", bigIp.Url)
+
+	bigIp.configReadAt = time.Now().Add(-2 * time.Hour)
+	err = bigIp.RefreshConfig()
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 2, requests)
+	assert.Equal(s.T(), "https://bigip-2"+DG_PATH+"dg", bigIp.Url)
+	assert.Equal(s.T(), "pool-2", bigIp.Pattern)
+}
+
+func (s *BigIpTestSuite) Test_RefreshConfig_IsSerializedWithReadersOfTheConfig() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	var lock sync.Mutex
+	requests := 0
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		dataGroup := fmt.Sprintf("dg-%d", requests)
+		lock.Unlock()
+		w.Write([]byte(fmt.Sprintf(`{"BIGIP_HOST":"%s","BIGIP_DG":"%s","BIGIP_RWP":"%s"}`, srv.URL, dataGroup, PATTERN)))
+	}))
+	defer configSrv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+	bigIp.ConfigApi = configSrv.URL
+	bigIp.ConfigRefresh = time.Nanosecond
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bigIp.RefreshConfig()
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := bigIp.GetDrift()
+			assert.Nil(s.T(), err, "should not return err")
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(s.T(), srv.URL+DG_PATH+bigIp.config.DataGroup, bigIp.Url, "the url should match the config it was built from")
+}
+
+func (s *BigIpTestSuite) Test_RefreshConfig_UsesConfigApiTimeoutReadAtStartup() {
+	defer os.Unsetenv("DF_CONFIG_API_TIMEOUT")
+	os.Setenv("DF_CONFIG_API_TIMEOUT", "3")
 	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
-	assert.NotNil(s.T(), bigIp, "should return bigIp")
-	labels := make(map[string]string)
-	labels["com.df.servicePath"] = PATH
-	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
+	bigIp.ConfigRefresh = time.Nanosecond
+	os.Setenv("DF_CONFIG_API_TIMEOUT", "three")
+
+	assert.NotPanics(s.T(), func() { bigIp.RefreshConfig() }, "the timeout should not be read again")
+	assert.Equal(s.T(), 3*time.Second, bigIp.configApiTimeout)
+}
+
+func (s *BigIpTestSuite) Test_RefreshConfig_FallsBackToDefaultPattern_WhenConfigApiOmitsPattern() {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"BIGIP_HOST":"https://bigip-2","BIGIP_DG":"dg"}`))
+	}))
+	defer configSrv.Close()
+	bigIp := newBigIp(&Config{Host: "https://bigip-1", DataGroup: "dg", PoolPattern: "pool-1"}, "test-key-value")
+	bigIp.ConfigApi = configSrv.URL
+	bigIp.ConfigRefresh = time.Hour
+	bigIp.configReadAt = time.Now().Add(-2 * time.Hour)
+	bigIp.defaultPattern = "default-pattern"
+
+	err := bigIp.RefreshConfig()
+
 	assert.Nil(s.T(), err, "should not return err")
-	assert.True(s.T(), len(bigIp.Services) > 0, "cache size should be > 0")
-	value, ok := bigIp.Services[SERVICE_ID]
-	assert.True(s.T(), ok, "service should be added to cache")
-	assert.Equal(s.T(), value[0], PATH, "path should be added to cache")
+	assert.Equal(s.T(), "https://bigip-2"+DG_PATH+"dg", bigIp.Url)
+	assert.Equal(s.T(), "default-pattern", bigIp.Pattern)
+}
 
-	err = bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+func (s *BigIpTestSuite) Test_RefreshConfig_KeepsConfig_WhenConfigApiFails() {
+	configSrv := configServer("https://bigip-1", "dg", PATTERN, "service")
+	bigIp := NewBigIp(configSrv.URL, s.bigIPKeyFile)
+	configSrv.Close()
+	bigIp.ConfigRefresh = time.Second
+	bigIp.configReadAt = time.Now().Add(-time.Minute)
+
+	err := bigIp.RefreshConfig()
+
+	s.Error(err)
+	assert.Equal(s.T(), "https://bigip-1"+DG_PATH+"dg", bigIp.Url)
+	assert.Equal(s.T(), PATTERN, bigIp.Pattern)
+}
+
+func (s *BigIpTestSuite) Test_FetchConfig_ReturnsErr_WhenTimeoutExpires() {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"BIGIP_HOST":"https://bigip","BIGIP_DG":"dg","BIGIP_RWP":"pool"}`))
+	}))
+	defer configSrv.Close()
+
+	_, err := fetchConfig(configSrv.URL, 10*time.Millisecond)
+	s.Error(err)
+
+	_, err = fetchConfig(configSrv.URL, time.Second)
 	assert.Nil(s.T(), err, "should not return err")
-	assert.True(s.T(), len(bigIp.Services) == 0, "cache size should be > 0")
 }
 
-func (s *BigIpTestSuite) Test_UpdateDataGroup_Marshall_Error() {
-	bigIp := NewBigIp(s.errorConfigServer.URL, s.bigIPKeyFile)
-	assert.NotNil(s.T(), bigIp, "should return bigIp")
-	labels := make(map[string]string)
-	labels["com.df.servicePath"] = PATH
+func (s *BigIpTestSuite) Test_NewBigIp_RoutesThroughProxy() {
+	actualHost := ""
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualHost = r.URL.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxySrv.Close()
+	os.Setenv("DF_HTTP_PROXY", proxySrv.URL)
+	defer os.Unsetenv("DF_HTTP_PROXY")
+
+	bigIp := newBigIp(&Config{Host: "http://bigip.invalid", DataGroup: DG}, "test-key-value")
+	err := bigIp.Ping()
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), "bigip.invalid", actualHost, "request should be sent through the proxy")
+}
+
+func (s *BigIpTestSuite) Test_GetData_RendersDataTemplate() {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{.ServiceName}}_pool", "my-service_pool"},
+		{"pool_{{index .Labels \"com.df.port\"}}", "pool_8080"},
+	}
+	b := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	labels := map[string]string{"com.df.port": "8080"}
+	ss := (*s.getSwarmServices(SERVICE_ID, labels))[0]
+	ss.Spec.Name = "my-service"
+	for _, t := range tests {
+		b.DataTemplate = template.Must(template.New("data").Parse(t.template))
+		data, err := b.getData(ss)
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, data)
+	}
+}
+
+func (s *BigIpTestSuite) Test_GetData_FallsBackToPattern() {
+	b := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	ss := (*s.getSwarmServices(SERVICE_ID, map[string]string{}))[0]
+
+	data, err := b.getData(ss)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), PATTERN, data)
+}
+
+func (s *BigIpTestSuite) Test_GetData_IncludesPort() {
+	tests := []struct {
+		labels   map[string]string
+		template string
+		expected string
+	}{
+		{map[string]string{"com.df.port": "8080"}, "", PATTERN + ":8080"},
+		{map[string]string{"com.df.port": "8080"}, "{{.Port}}-{{.Data}}", "8080-" + PATTERN},
+		{map[string]string{}, "", PATTERN},
+	}
+	for _, t := range tests {
+		b := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+		if len(t.template) > 0 {
+			b.PortTemplate = template.Must(template.New("port").Parse(t.template))
+		}
+		ss := (*s.getSwarmServices(SERVICE_ID, t.labels))[0]
+
+		data, err := b.getData(ss)
+
+		assert.Nil(s.T(), err, "should not return err")
+		assert.Equal(s.T(), t.expected, data)
+	}
+}
+
+func (s *BigIpTestSuite) Test_AddRoutes_IncludesPortInRecords() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: "pool"}, "test-key-value")
+	labels := map[string]string{"com.df.servicePath": "/api", "com.df.port": "8080"}
+
 	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, labels))
-	s.Error(err)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), []Record{{Name: "/api", Data: "pool:8080"}}, srv.records(DG))
 }
 
-func (s *BigIpTestSuite) Test_NewRequest() {
-	bigIp := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
-	req, err := bigIp.newRequest("GET", nil)
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_Panics_WhenPatternIsEmpty() {
+	configSrv := configServer("http://bigip", DG, "", "service")
+	defer configSrv.Close()
+	os.Setenv("DF_CONFIG_API", configSrv.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+	}()
+
+	assert.Panics(s.T(), func() { NewBigIpFromEnv() }, "empty pattern should be rejected")
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_FallsBackToDefaultPattern_WhenConfigApiOmitsPattern() {
+	configSrv := configServer("http://bigip", DG, "", "service")
+	defer configSrv.Close()
+	os.Setenv("DF_CONFIG_API", configSrv.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_DEFAULT_PATTERN", "default-pattern")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_DEFAULT_PATTERN")
+	}()
+
+	bigIp := NewBigIpFromEnv()
+
+	assert.Equal(s.T(), "default-pattern", bigIp.Pattern)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_PrefersPatternFromConfigApi_OverDefaultPattern() {
+	configSrv := configServer("http://bigip", DG, "config-pattern", "service")
+	defer configSrv.Close()
+	os.Setenv("DF_CONFIG_API", configSrv.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_DEFAULT_PATTERN", "default-pattern")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_DEFAULT_PATTERN")
+	}()
+
+	bigIp := NewBigIpFromEnv()
+
+	assert.Equal(s.T(), "config-pattern", bigIp.Pattern)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_AllowsEmptyPattern_WhenDataTemplateIsSet() {
+	configSrv := configServer("http://bigip", DG, "", "service")
+	defer configSrv.Close()
+	os.Setenv("DF_CONFIG_API", configSrv.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_DATA_TEMPLATE", "{{.ServiceName}}_pool")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_DATA_TEMPLATE")
+	}()
+
+	assert.NotPanics(s.T(), func() { NewBigIpFromEnv() })
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_ReadsTimeoutAndRetryFromConfigApi() {
+	tests := []struct {
+		payload         string
+		expectedTimeout time.Duration
+		expectedRetries int
+	}{
+		{`{"BIGIP_HOST":"http://bigip","BIGIP_DG":"dg","BIGIP_RWP":"pool","BIGIP_TIMEOUT":7,"BIGIP_RETRY":5}`, 7 * time.Second, 5},
+		{`{"BIGIP_HOST":"http://bigip","BIGIP_DG":"dg","BIGIP_RWP":"pool","BIGIP_TIMEOUT":"7","BIGIP_RETRY":"5"}`, 7 * time.Second, 5},
+		{`{"BIGIP_HOST":"http://bigip","BIGIP_DG":"dg","BIGIP_RWP":"pool"}`, 2 * time.Second, BIGIP_RATE_LIMIT_RETRIES},
+	}
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_GET_TIMEOUT", "2")
+	os.Setenv("DF_BIGIP_PUT_TIMEOUT", "2")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_GET_TIMEOUT")
+		os.Unsetenv("DF_BIGIP_PUT_TIMEOUT")
+	}()
+	for _, t := range tests {
+		configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(t.payload))
+		}))
+		os.Setenv("DF_CONFIG_API", configSrv.URL)
+
+		bigIp := NewBigIpFromEnv()
+
+		configSrv.Close()
+		assert.Equal(s.T(), t.expectedTimeout, bigIp.GetTimeout, "get timeout of %s", t.payload)
+		assert.Equal(s.T(), t.expectedTimeout, bigIp.PutTimeout, "put timeout of %s", t.payload)
+		assert.Equal(s.T(), t.expectedRetries, bigIp.RateLimitRetries, "retries of %s", t.payload)
+	}
+}
+
+func (s *BigIpTestSuite) Test_RefreshConfig_FallsBackToEnvSettings_WhenConfigApiDropsThem() {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"BIGIP_HOST":"https://bigip","BIGIP_DG":"dg","BIGIP_RWP":"pool"}`))
+	}))
+	defer configSrv.Close()
+	bigIp := newBigIp(&Config{Host: "https://bigip", DataGroup: "dg", PoolPattern: "pool", Timeout: 7, Retry: 5}, "test-key-value")
+	assert.Equal(s.T(), 7*time.Second, bigIp.GetTimeout)
+	assert.Equal(s.T(), 5, bigIp.RateLimitRetries)
+	bigIp.ConfigApi = configSrv.URL
+	bigIp.ConfigRefresh = time.Hour
+	bigIp.configReadAt = time.Now().Add(-2 * time.Hour)
+
+	err := bigIp.RefreshConfig()
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), time.Duration(0), bigIp.GetTimeout)
+	assert.Equal(s.T(), BIGIP_RATE_LIMIT_RETRIES, bigIp.RateLimitRetries)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_OverridesPatternFromEnv() {
+	configSrv := configServer("http://bigip", DG, "", "service")
+	defer configSrv.Close()
+	os.Setenv("DF_CONFIG_API", configSrv.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_PATTERN", "env-pattern")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_PATTERN")
+	}()
+
+	bigIp := NewBigIpFromEnv()
+
+	assert.Equal(s.T(), "env-pattern", bigIp.Pattern)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpFromEnv_ParsesDataTemplate() {
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_DATA_TEMPLATE", "{{.ServiceName}}_pool")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_DATA_TEMPLATE")
+	}()
+	bigIp := NewBigIpFromEnv()
+	assert.NotNil(s.T(), bigIp.DataTemplate, "data template should be parsed")
+}
+
+func (s *BigIpTestSuite) Test_NewRequest_UsesKeyHeaderFromEnv() {
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	os.Setenv("DF_BIGIP_KEY_HEADER", "X-Custom-Key")
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+		os.Unsetenv("DF_BIGIP_KEY_HEADER")
+	}()
+	bigIp := NewBigIpFromEnv()
+
+	req, err := bigIp.newRequest(context.Background(), "GET", bigIp.Url, nil)
+
 	assert.Nil(s.T(), err, "newRequest with GET should not result in err")
-	assert.NotNil(s.T(), req, "newRequest with GET should not return req object")
-	val := req.Header.Get(BIGIP_HEADER)
-	assert.True(s.T(), val == "test-key-value", "newRequest sets the BIGIP_HEADER")
+	assert.Equal(s.T(), "test-key-value", req.Header.Get("X-Custom-Key"), "custom header should carry the key")
+	assert.Empty(s.T(), req.Header.Get(BIGIP_HEADER), "default header should not be set")
+}
+
+func (s *BigIpTestSuite) Test_UpdateDataGroup_RecordsDataGroupSize() {
+	srv := newDataGroupServer()
+	defer srv.Close()
+	srv.groups[DG_PATH+DG] = &DataGroup{Records: []Record{{Name: "/a", Data: "x"}, {Name: "/b", Data: "x"}, {Name: "/c", Data: "x"}}}
+	bigIp := newBigIp(&Config{Host: srv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+
+	err := bigIp.updateDataGroup(bigIp.Url, bigIp.getRecords([]string{PATH}, PATTERN), nil)
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), float64(3), getGaugeValue("docker_flow_data_group_size", "data_group", bigIp.Url))
 }
 
 func (s *BigIpTestSuite) Test_GetRecords() {
@@ -161,6 +2288,8 @@ func (s *BigIpTestSuite) Test_ContainsRecords() {
 	assert.True(s.T(), b.containsRecord(records, record), "containsRecord should return true")
 	record = Record{Name: "/test-5", Data: "test-pattern"}
 	assert.False(s.T(), b.containsRecord(records, record), "containsRecord should return false")
+	assert.False(s.T(), b.containsRecord([]Record{{Name: "/apiv2"}, {Name: "/api/v1"}}, Record{Name: "/api/*"}), "wildcard records should only match by their exact names")
+	assert.True(s.T(), b.containsRecord([]Record{{Name: "/apiv2"}, {Name: "/api/*"}}, Record{Name: "/api/*"}), "containsRecord should return true")
 }
 
 func (s *BigIpTestSuite) Test_RemovedRecords() {
@@ -180,6 +2309,257 @@ func (s *BigIpTestSuite) Test_RemovedRecords() {
 	assert.True(s.T(), len(removed) == 2, "removed records should be 2")
 }
 
+func (s *BigIpTestSuite) Test_RemovedRecords_MatchesLinearSearch() {
+	b := NewBigIp(s.goodConfigServer.URL, s.bigIPKeyFile)
+	records := getBenchmarkRecords(1000)
+	remove := []Record{}
+	for i := 0; i < len(records); i += 3 {
+		remove = append(remove, Record{Name: records[i].Name})
+	}
+	expected := []Record{}
+	for _, r := range records {
+		if !b.isOwned(r) || !b.containsRecord(remove, r) {
+			expected = append(expected, r)
+		}
+	}
+
+	removed := b.removeRecords(append([]Record{}, records...), remove)
+
+	assert.Equal(s.T(), expected, removed)
+}
+
+// BenchmarkServiceDiff measures a cycle of Reconcile on a large swarm: the routes of a tenth of the services
+// change and another tenth is removed, while the data group holds the records of all services
+func BenchmarkServiceDiff(bm *testing.B) {
+	const count = 2000
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	services := []service.SwarmService{}
+	cached := map[string]ServiceRoutes{}
+	records := []Record{}
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("service-%d", i)
+		path := "/" + id
+		ss := service.SwarmService{Service: swarm.Service{ID: id}}
+		ss.Spec.Name = id
+		ss.Spec.Labels = map[string]string{"com.df.servicePath": path + "-v2"}
+		services = append(services, ss)
+		cached[id] = ServiceRoutes{Paths: []string{path}, Data: PATTERN, Name: id}
+		records = append(records, Record{Name: path, Data: PATTERN})
+	}
+	payload, _ := json.Marshal(DataGroup{Records: records})
+	added := services[:count/10]
+	removed := []string{}
+	for _, ss := range services[count/10 : count/5] {
+		removed = append(removed, ss.ID)
+	}
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		bm.StopTimer()
+		b := newBigIp(&Config{Host: "http://bigip", DataGroup: DG, PoolPattern: PATTERN}, "test-key-value")
+		b.Client = &http.Client{Transport: &dataGroupTransport{payload: payload}}
+		for id, routes := range cached {
+			b.Services[id] = routes
+		}
+		bm.StartTimer()
+		if err := b.Reconcile(&added, &removed); err != nil {
+			bm.Fatal(err)
+		}
+	}
+}
+
+func getBenchmarkRecords(count int) []Record {
+	records := []Record{}
+	for i := 0; i < count; i++ {
+		records = append(records, Record{Name: fmt.Sprintf("/service-%d", i), Data: "test-pattern"})
+	}
+	return records
+}
+
+// dataGroupTransport serves a data group from memory, so that benchmarks measure the listener rather than HTTP
+type dataGroupTransport struct {
+	payload []byte
+}
+
+func (t *dataGroupTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := t.payload
+	if r.Method != "GET" {
+		body = []byte("{}")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body)), Request: r}, nil
+}
+
+// StandbyBigIp
+
+func (s *BigIpTestSuite) Test_StandbyBigIp_AppliesRoutesToBothBigIps() {
+	primarySrv := newDataGroupServer()
+	defer primarySrv.Close()
+	standbySrv := newDataGroupServer()
+	defer standbySrv.Close()
+	bigIp := &StandbyBigIp{
+		Primary: newBigIp(&Config{Host: primarySrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value"),
+		Standby: newBigIp(&Config{Host: standbySrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value"),
+	}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/demo"}))
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Equal(s.T(), 1, primarySrv.puts)
+	assert.Equal(s.T(), 1, standbySrv.puts)
+	assert.Equal(s.T(), []Record{{Name: "/demo", Data: PATTERN}}, primarySrv.records(DG))
+	assert.Equal(s.T(), []Record{{Name: "/demo", Data: PATTERN}}, standbySrv.records(DG))
+
+	err = bigIp.RemoveRoutes(&[]string{SERVICE_ID})
+
+	assert.Nil(s.T(), err, "should not return err")
+	assert.Empty(s.T(), primarySrv.records(DG))
+	assert.Empty(s.T(), standbySrv.records(DG))
+}
+
+func (s *BigIpTestSuite) Test_StandbyBigIp_ToleratesStandbyFailures() {
+	primarySrv := newDataGroupServer()
+	defer primarySrv.Close()
+	standbySrv := badServer()
+	defer standbySrv.Close()
+	bigIp := &StandbyBigIp{
+		Primary: newBigIp(&Config{Host: primarySrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value"),
+		Standby: newBigIp(&Config{Host: standbySrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value"),
+	}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/demo"}))
+
+	assert.Nil(s.T(), err, "standby failures should not fail the update")
+	assert.Equal(s.T(), []Record{{Name: "/demo", Data: PATTERN}}, primarySrv.records(DG))
+	assert.Contains(s.T(), bigIp.GetRoutes(), SERVICE_ID)
+}
+
+func (s *BigIpTestSuite) Test_StandbyBigIp_ReturnsStandbyErr_WhenStandbyIsRequired() {
+	primarySrv := newDataGroupServer()
+	defer primarySrv.Close()
+	standbySrv := badServer()
+	defer standbySrv.Close()
+	bigIp := &StandbyBigIp{
+		Primary:         newBigIp(&Config{Host: primarySrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value"),
+		Standby:         newBigIp(&Config{Host: standbySrv.URL, DataGroup: DG, PoolPattern: PATTERN}, "test-key-value"),
+		StandbyRequired: true,
+	}
+
+	err := bigIp.AddRoutes(s.getSwarmServices(SERVICE_ID, map[string]string{"com.df.servicePath": "/demo"}))
+
+	s.Error(err)
+}
+
+func (s *BigIpTestSuite) Test_NewBigIpClientFromEnv_ReturnsStandbyBigIp_WhenStandbyConfigApiIsSet() {
+	standbyConfigSrv := configServer("https://standby", DG, PATTERN, "service")
+	defer standbyConfigSrv.Close()
+	os.Setenv("DF_CONFIG_API", s.goodConfigServer.URL)
+	os.Setenv("DF_CONFIG_API_STANDBY", standbyConfigSrv.URL)
+	os.Setenv("DF_BIGIP_KEY_FILE", s.bigIPKeyFile)
+	defer func() {
+		os.Unsetenv("DF_CONFIG_API")
+		os.Unsetenv("DF_CONFIG_API_STANDBY")
+		os.Unsetenv("DF_BIGIP_KEY_FILE")
+	}()
+
+	bigIp, ok := NewBigIpClientFromEnv().(*StandbyBigIp)
+
+	s.Require().True(ok, "should return a standby BigIp")
+	assert.Equal(s.T(), "https://standby"+DG_PATH+DG, bigIp.Standby.Url)
+	assert.False(s.T(), bigIp.StandbyRequired)
+}
+
+// dataGroupServer is a fake BigIp keeping data group records per url path
+type dataGroupServer struct {
+	*httptest.Server
+	groups map[string]*DataGroup
+	puts   int
+	// PUTs to the data groups of failPuts are rejected
+	failPuts map[string]bool
+	lock     sync.Mutex
+}
+
+func newDataGroupServer() *dataGroupServer {
+	srv := &dataGroupServer{groups: map[string]*DataGroup{}}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		switch r.Method {
+		case "GET":
+			dg, ok := srv.groups[r.URL.Path]
+			if !ok {
+				dg = &DataGroup{}
+			}
+			payload, _ := json.Marshal(dg)
+			w.WriteHeader(http.StatusOK)
+			w.Write(payload)
+		case "PUT":
+			if srv.failPuts[r.URL.Path] {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			dg := &DataGroup{}
+			json.NewDecoder(r.Body).Decode(dg)
+			srv.groups[r.URL.Path] = dg
+			srv.puts++
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	return srv
+}
+
+func (srv *dataGroupServer) records(dataGroup string) []Record {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if dg, ok := srv.groups[DG_PATH+dataGroup]; ok {
+		return dg.Records
+	}
+	return nil
+}
+
+// getGaugeValue returns the value of the gauge with the given label from the default registry
+func getGaugeValue(name, labelName, labelValue string) float64 {
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == labelName && l.GetValue() == labelValue {
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func recordNames(records []Record) []string {
+	names := []string{}
+	for _, r := range records {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// getCounterValue returns the value of the counter with the given label from the default registry
+func getCounterValue(name, labelName, labelValue string) float64 {
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == labelName && l.GetValue() == labelValue {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
 func badServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -222,6 +2602,17 @@ func goodServer(dg string, payload []byte) *httptest.Server {
 	}))
 }
 
+func (s *BigIpTestSuite) getAuditRecords(buf *bytes.Buffer) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		record := map[string]interface{}{}
+		assert.Nil(s.T(), decoder.Decode(&record), "audit record should be JSON")
+		records = append(records, record)
+	}
+	return records
+}
+
 func (s *BigIpTestSuite) getSwarmServices(id string, labels map[string]string) *[]service.SwarmService {
 	name := fmt.Sprintf("%s%d", SERVICE_NAME, serviceCount)
 	serviceCount++
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// changeFeedBuffer is the number of changes buffered for a subscriber before further changes are dropped
+const changeFeedBuffer = 64
+
+// ServiceChange is a service that was created, updated or removed, as streamed to subscribers
+type ServiceChange struct {
+	Action      string    `json:"action"`
+	ServiceID   string    `json:"serviceId"`
+	ServiceName string    `json:"serviceName,omitempty"`
+	Ts          time.Time `json:"ts"`
+}
+
+// changeFeed publishes service changes to subscribers. It is safe for concurrent use.
+// Publishing never blocks, so changes are dropped for subscribers that do not keep up.
+type changeFeed struct {
+	subscribers map[chan ServiceChange]bool
+	closed      bool
+	lock        sync.Mutex
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subscribers: map[chan ServiceChange]bool{}}
+}
+
+// Subscribe returns the channel changes are published to. It is closed when the feed is closed.
+func (f *changeFeed) Subscribe() chan ServiceChange {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ch := make(chan ServiceChange, changeFeedBuffer)
+	if f.closed {
+		close(ch)
+		return ch
+	}
+	f.subscribers[ch] = true
+	return ch
+}
+
+func (f *changeFeed) Unsubscribe(ch chan ServiceChange) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.subscribers[ch] {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (f *changeFeed) Publish(change ServiceChange) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- change:
+		default:
+			logPrintf("WARNING: A subscriber of service changes does not keep up. The %s change of %s is dropped", change.Action, change.ServiceID)
+		}
+	}
+}
+
+func (f *changeFeed) subscriberCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.subscribers)
+}
+
+// Close ends the subscriptions, e.g. so that streams do not hold up a shutdown
+func (f *changeFeed) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for ch := range f.subscribers {
+		close(ch)
+	}
+	f.subscribers = map[chan ServiceChange]bool{}
+	f.closed = true
+}
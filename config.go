@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/url"
+	"os"
+
+	"./service"
+)
+
+// REDACTED replaces secrets in the effective configuration
+const REDACTED = "REDACTED"
+
+// EffectiveConfig is the configuration the listener resolved from its environment
+type EffectiveConfig struct {
+	Interval          int            `json:"interval"`
+	Retry             int            `json:"retry"`
+	RetryInterval     int            `json:"retryInterval"`
+	MaxPerCycle       int            `json:"maxPerCycle"`
+	MaxInterval       int            `json:"maxInterval"`
+	NotifyLabel       string         `json:"notifyLabel"`
+	CreateServiceAddr []string       `json:"createServiceAddr"`
+	RemoveServiceAddr []string       `json:"removeServiceAddr"`
+	BigIp             *BigIpSettings `json:"bigIp,omitempty"`
+}
+
+// BigIpSettings is the BigIp part of the effective configuration
+type BigIpSettings struct {
+	Url              string   `json:"url"`
+	StandbyUrl       string   `json:"standbyUrl,omitempty"`
+	DomainUrl        string   `json:"domainUrl,omitempty"`
+	Key              string   `json:"key"`
+	KeyHeader        string   `json:"keyHeader"`
+	Pattern          string   `json:"pattern"`
+	PathDelimiter    string   `json:"pathDelimiter"`
+	PathSource       string   `json:"pathSource,omitempty"`
+	ExcludePaths     []string `json:"excludePaths,omitempty"`
+	PathInclude      string   `json:"pathInclude,omitempty"`
+	CacheFile        string   `json:"cacheFile,omitempty"`
+	Authoritative    bool     `json:"authoritative"`
+	Owner            string   `json:"owner,omitempty"`
+	MinWriteInterval string   `json:"minWriteInterval"`
+	PayloadEnvelope  string   `json:"payloadEnvelope,omitempty"`
+	PrettyPayload    bool     `json:"prettyPayload"`
+	HostPaths        bool     `json:"hostPaths"`
+	GroupType        string   `json:"groupType"`
+	GetTimeout       string   `json:"getTimeout"`
+	PutTimeout       string   `json:"putTimeout"`
+	MaxConcurrency   int      `json:"maxConcurrency"`
+}
+
+// newEffectiveConfig collects the settings of the listener with secrets redacted
+func newEffectiveConfig(args *args, n *service.Notification, bigIp BigIpClient) *EffectiveConfig {
+	config := &EffectiveConfig{
+		Interval:          args.Interval,
+		Retry:             args.Retry,
+		RetryInterval:     args.RetryInterval,
+		MaxPerCycle:       args.MaxPerCycle,
+		MaxInterval:       args.MaxInterval,
+		NotifyLabel:       os.Getenv("DF_NOTIFY_LABEL"),
+		CreateServiceAddr: redactURLs(n.CreateServiceAddr),
+		RemoveServiceAddr: redactURLs(n.RemoveServiceAddr),
+	}
+	standbyUrl := ""
+	if standby, ok := bigIp.(*StandbyBigIp); ok {
+		bigIp = standby.Primary
+		standby.Standby.updateLock.Lock()
+		standbyUrl = redactURL(standby.Standby.Url)
+		standby.Standby.updateLock.Unlock()
+	}
+	if b, ok := bigIp.(*BigIp); ok {
+		b.updateLock.Lock()
+		defer b.updateLock.Unlock()
+		config.BigIp = &BigIpSettings{
+			Url:              redactURL(b.Url),
+			StandbyUrl:       standbyUrl,
+			DomainUrl:        redactURL(b.DomainUrl),
+			KeyHeader:        b.KeyHeader,
+			Pattern:          b.Pattern,
+			PathDelimiter:    b.PathDelimiter,
+			PathSource:       b.PathSource,
+			ExcludePaths:     b.ExcludePaths,
+			CacheFile:        b.CacheFile,
+			Authoritative:    b.Authoritative,
+			Owner:            b.Owner,
+			MinWriteInterval: b.MinWriteInterval.String(),
+			PayloadEnvelope:  b.PayloadEnvelope,
+			PrettyPayload:    b.PrettyPayload,
+			HostPaths:        b.HostPaths,
+			GroupType:        b.GroupType,
+			GetTimeout:       b.GetTimeout.String(),
+			PutTimeout:       b.PutTimeout.String(),
+			MaxConcurrency:   b.MaxConcurrency,
+		}
+		if b.PathInclude != nil {
+			config.BigIp.PathInclude = b.PathInclude.String()
+		}
+		if len(b.Key) > 0 {
+			config.BigIp.Key = REDACTED
+		}
+	}
+	return config
+}
+
+func redactURLs(addrs []string) []string {
+	redacted := []string{}
+	for _, addr := range addrs {
+		redacted = append(redacted, redactURL(addr))
+	}
+	return redacted
+}
+
+// redactURL hides the password of the URL user info, if any
+func redactURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.User == nil {
+		return addr
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), REDACTED)
+	}
+	return u.String()
+}
@@ -1,80 +1,812 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
 	"./metrics"
 	"./service"
 )
 
+// version is the version of the listener, set at build time with `-ldflags "-X main.version=<version>"`
+var version = "dev"
+
 func main() {
 	logPrintf("Starting Docker Flow: Swarm Listener")
+	service.ReadErrorBodyLimitFromEnv()
+	if strings.EqualFold(os.Getenv("DF_VALIDATE_ONLY"), "true") {
+		results := validate(os.Getenv("DF_CONFIG_API"), getKeyFileFromEnv())
+		writeValidationReport(os.Stdout, results)
+		os.Exit(exitCode(validationError(results)))
+	}
 	s := service.NewServiceFromEnv()
-	n := service.NewNotificationFromEnv()
-	bigIp := NewBigIpFromEnv()
+	var bigIp BigIpClient
+	if len(os.Getenv("DF_CONFIG_API")) > 0 {
+		bigIp = NewBigIpClientFromEnv()
+	} else {
+		logPrintf("DF_CONFIG_API is not set. BigIp is disabled")
+		bigIp = noopBigIp{}
+	}
+	n := service.NewNotificationFromConfig(getNotifyConfig(bigIp))
+	n.Readiness = s
+	//Notifications are canceled on shutdown so that a hung consumer does not block it
+	ctx, cancel := context.WithCancel(context.Background())
+	n.Context = ctx
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
 	el := service.NewEventListenerFromEnv()
+	args := getArgs()
+	metrics.RecordInfo(metrics.Info{Version: version, Interval: args.Interval, BigIpEnabled: len(os.Getenv("DF_CONFIG_API")) > 0})
 	serve := NewServe(s, n)
+	serve.BigIp = bigIp
+	serve.Config = newEffectiveConfig(args, n, bigIp)
+	serve.AuthToken = os.Getenv("DF_SERVE_AUTH_TOKEN")
+	//The config API is read when BigIp is created
+	serve.Ready.Mark(MILESTONE_CONFIG_API)
 	go serve.Run()
 
-	args := getArgs()
-
 	if len(n.CreateServiceAddr) == 0 {
 		return
 	}
 
+	l := newListener(s, n, bigIp, args)
+	l.pause = serve.Pause
+	l.cacheClear = serve.CacheClear
+	l.ready = serve.Ready
+	l.changes = serve.Changes
+	l.tasks = s
+	l.servicesFile = os.Getenv("DF_SERVICES_FILE")
+	l.waitInitialDelay()
+
+	if addr := os.Getenv("DF_STARTUP_NOTIFY_URL"); len(addr) > 0 {
+		notifyStartup(addr, startupNotifyTimeout)
+	}
+
 	logPrintf("Sending notifications for running services")
 	allServices, err := s.GetServices()
 	if err != nil {
 		metrics.RecordError("GetServices")
+	} else {
+		l.markPolled()
 	}
 
 	newServices, err := s.GetNewServices(allServices)
 	if err != nil {
 		metrics.RecordError("GetNewServices")
 	}
-	err = n.ServicesCreate(
-		newServices,
-		args.Retry,
-		args.RetryInterval,
-	)
-	if err != nil {
-		metrics.RecordError("ServicesCreate")
-	}
-	bigIp.AddRoutes(newServices)
+	l.createServices(newServices)
 
 	logPrintf("Start listening to docker service events")
 	events, errs := el.ListenForEvents()
+	timer := time.NewTimer(l.nextInterval())
 	for {
 		select {
+		case <-ctx.Done():
+			logPrintf("Shutting down Docker Flow: Swarm Listener")
+			serve.Shutdown()
+			return
 		case event := <-events:
-			if event.Action == "create" || event.Action == "update" {
-				eventServices, err := s.GetServicesFromID(event.ServiceID)
-				if err != nil {
-					metrics.RecordError("GetServicesFromID")
-				}
-				newServices, err := s.GetNewServices(eventServices)
-				if err != nil {
-					metrics.RecordError("GetNewServices")
-				}
-				err = n.ServicesCreate(
-					newServices,
-					args.Retry,
-					args.RetryInterval,
-				)
-				if err != nil {
-					metrics.RecordError("ServicesCreate")
-				}
-				bigIp.AddRoutes(newServices)
-			} else if event.Action == "remove" {
-				err = n.ServicesRemove(&[]string{event.ServiceID}, args.Retry, args.RetryInterval)
-				metrics.RecordService(len(service.CachedServices))
-				if err != nil {
-					metrics.RecordError("ServicesRemove")
-				}
-				bigIp.RemoveRoutes(&[]string{event.ServiceID})
-			}
+			l.handleEvent(event)
+		case <-timer.C:
+			l.runCycle()
+			timer.Reset(l.nextInterval())
 		case <-errs:
 			metrics.RecordError("ListenForEvents")
-			// Restart listening for events
+			l.failures++
+			// Restart listening for events after backing off, unless the listener is shutting down
+			select {
+			case <-time.After(l.nextInterval()):
+			case <-ctx.Done():
+				continue
+			}
 			events, errs = el.ListenForEvents()
 		}
 	}
 }
+
+// startupNotifyTimeout is the timeout of the startup notification
+const startupNotifyTimeout = 5 * time.Second
+
+// notifyStartup tells consumers that the listener started and services are about to be announced.
+// It is best-effort; failures are only logged.
+func notifyStartup(addr string, timeout time.Duration) {
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: service.ProxyFromEnv()},
+	}
+	logPrintf("Sending startup notification to %s", addr)
+	resp, err := client.Get(addr)
+	if err != nil {
+		logPrintf("WARNING: Startup notification to %s failed: %s", addr, err.Error())
+		metrics.RecordError("notifyStartup")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logPrintf("WARNING: Startup notification to %s returned status code %d", addr, resp.StatusCode)
+		metrics.RecordError("notifyStartup")
+	}
+}
+
+type listener struct {
+	Service       service.Servicer
+	Notification  service.Sender
+	BigIp         BigIpClient
+	Args          *args
+	pendingCreate []service.SwarmService
+	pendingRemove []string
+	graceRemove   map[string]time.Time
+	failures      int
+	coolingDown   bool
+	pause         *pauseSwitch
+	cacheClear    *cacheClearSwitch
+	startedAt     time.Time
+	cleanPoll     bool
+	servicesFile  string
+	heldRemoval   map[string]bool
+	ready         *readinessGate
+	changes       *changeFeed
+	announced     map[string]bool
+	tasks         service.TaskCounter
+	belowMin      map[string]service.SwarmService
+	notifiedAt    map[string]time.Time
+}
+
+func newListener(s service.Servicer, n service.Sender, bigIp BigIpClient, args *args) *listener {
+	return &listener{
+		Service:      s,
+		Notification: n,
+		BigIp:        bigIp,
+		Args:         args,
+		graceRemove:  map[string]time.Time{},
+		pause:        &pauseSwitch{},
+		cacheClear:   &cacheClearSwitch{},
+		ready:        newReadinessGate(),
+		changes:      newChangeFeed(),
+		announced:    map[string]bool{},
+		belowMin:     map[string]service.SwarmService{},
+		notifiedAt:   map[string]time.Time{},
+		startedAt:    time.Now(),
+	}
+}
+
+// pauseSwitch tells whether the listener is paused. It is safe for concurrent use.
+type pauseSwitch struct {
+	paused int32
+}
+
+func (p *pauseSwitch) Pause() {
+	atomic.StoreInt32(&p.paused, 1)
+}
+
+func (p *pauseSwitch) Resume() {
+	atomic.StoreInt32(&p.paused, 0)
+}
+
+func (p *pauseSwitch) IsPaused() bool {
+	return atomic.LoadInt32(&p.paused) == 1
+}
+
+// cacheClearSwitch holds a request to clear the caches until the main loop takes it. It is safe for concurrent use.
+type cacheClearSwitch struct {
+	requested bool
+	services  bool
+	routes    bool
+	lock      sync.Mutex
+}
+
+// Request asks the main loop to clear the caches. Requests made before the loop takes them are combined.
+func (c *cacheClearSwitch) Request(services, routes bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requested = true
+	c.services = c.services || services
+	c.routes = c.routes || routes
+}
+
+// take returns the pending request and forgets it
+func (c *cacheClearSwitch) take() (requested, services, routes bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	requested, services, routes = c.requested, c.services, c.routes
+	c.requested, c.services, c.routes = false, false, false
+	return requested, services, routes
+}
+
+// MILESTONE_CONFIG_API is reached once the config API was read
+const MILESTONE_CONFIG_API = "configApi"
+
+// MILESTONE_DOCKER_POLL is reached once services were listed from Docker without errors
+const MILESTONE_DOCKER_POLL = "dockerPoll"
+
+// readinessGate tells whether the startup milestones were reached. It is safe for concurrent use.
+type readinessGate struct {
+	reached map[string]bool
+	lock    sync.Mutex
+}
+
+func newReadinessGate() *readinessGate {
+	return &readinessGate{reached: map[string]bool{}}
+}
+
+func (g *readinessGate) Mark(milestone string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.reached[milestone] = true
+}
+
+// Pending returns the milestones that were not reached yet
+func (g *readinessGate) Pending() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	pending := []string{}
+	for _, m := range []string{MILESTONE_CONFIG_API, MILESTONE_DOCKER_POLL} {
+		if !g.reached[m] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// markPolled records that services were listed without errors
+func (l *listener) markPolled() {
+	l.cleanPoll = true
+	l.ready.Mark(MILESTONE_DOCKER_POLL)
+}
+
+// runCycle runs a full cycle of the listener and records how long it took.
+// A cycle longer than the interval means that the listener is falling behind.
+// While paused, changes stay queued and BigIp is left alone.
+func (l *listener) runCycle() time.Duration {
+	if l.pause.IsPaused() {
+		logPrintf("The listener is paused. %d removed and %d new services are queued", len(l.pendingRemove), len(l.pendingCreate))
+		return 0
+	}
+	start := time.Now()
+	if err := l.BigIp.RefreshConfig(); err != nil {
+		logPrintf(err.Error())
+		metrics.RecordError("RefreshConfig")
+	}
+	l.clearCaches()
+	l.removeVanishedRoutes()
+	l.processPending()
+	l.renotifyServices()
+	l.auditCaches()
+	l.mirrorServices()
+	duration := time.Since(start)
+	metrics.RecordCycleDuration(duration)
+	if interval := time.Second * time.Duration(l.Args.Interval); interval > 0 && duration > interval {
+		logPrintf("WARNING: The cycle took %s, longer than the interval of %s", duration, interval)
+	}
+	return duration
+}
+
+// clearCaches clears the caches requested through the API and queues every running service,
+// so that the services are notified and routed again within the same cycle
+func (l *listener) clearCaches() {
+	requested, services, routes := l.cacheClear.take()
+	if !requested {
+		return
+	}
+	if services {
+		l.Service.ClearCache()
+		logPrintf("The service cache is cleared")
+	}
+	if routes {
+		l.BigIp.ClearRoutes()
+		logPrintf("The BigIp route cache is cleared")
+	}
+	running, err := l.Service.GetServices()
+	if err != nil {
+		metrics.RecordError("GetServices")
+		return
+	}
+	//Services are only new when their cache was cleared, so the routes of cached services are added again explicitly
+	queued, err := l.Service.GetNewServices(running)
+	if err != nil {
+		metrics.RecordError("GetNewServices")
+		return
+	}
+	if !services {
+		queued = running
+	}
+	logPrintf("Notifying and routing %d running services again", len(*queued))
+	l.createServices(queued)
+}
+
+// handleEvent processes a single docker service event
+func (l *listener) handleEvent(event service.Event) {
+	if event.Action == "create" || event.Action == "update" {
+		l.cancelRemoval(event.ServiceID)
+		eventServices, err := l.Service.GetServicesFromID(event.ServiceID)
+		if err != nil {
+			metrics.RecordError("GetServicesFromID")
+		}
+		scaled := service.GetScaleChanges(eventServices)
+		newServices, err := l.Service.GetNewServices(eventServices)
+		if err != nil {
+			metrics.RecordError("GetNewServices")
+		}
+		l.createServices(newServices)
+		l.notifyScaleChanges(scaled)
+	} else if event.Action == "remove" {
+		l.removeServices(&[]string{event.ServiceID})
+	}
+}
+
+// notifyScaleChanges sends scale notifications of services whose number of replicas changed.
+// Scale notifications are not queued, so changes are dropped while the listener is paused.
+func (l *listener) notifyScaleChanges(changes []service.ScaleChange) {
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		logPrintf("Service %s was scaled from %d to %d replicas", c.ServiceName, c.PreviousReplicas, c.Replicas)
+	}
+	if l.pause.IsPaused() {
+		return
+	}
+	if err := l.Notification.ServicesScale(changes, l.Args.Retry, l.Args.RetryInterval); err != nil {
+		metrics.RecordError("ServicesScale")
+	}
+}
+
+// createServices queues services for create notifications and BigIp routes.
+// Queued services are processed right away unless `DF_MAX_PER_CYCLE` is set.
+func (l *listener) createServices(services *[]service.SwarmService) {
+	for _, s := range *services {
+		l.cancelRemoval(s.ID)
+	}
+	l.pendingCreate = append(l.pendingCreate, *services...)
+	if l.Args.MaxPerCycle <= 0 {
+		l.processPending()
+	}
+}
+
+// removeServices queues services for remove notifications and BigIp route removal.
+// Queued services are processed right away unless `DF_MAX_PER_CYCLE` is set.
+// With `DF_REMOVE_GRACE`, services are only queued once they did not reappear within the grace period.
+func (l *listener) removeServices(serviceIDs *[]string) {
+	removed := make(map[string]bool, len(*serviceIDs))
+	for _, id := range *serviceIDs {
+		removed[id] = true
+	}
+	pending := l.pendingCreate[:0]
+	for _, s := range l.pendingCreate {
+		if !removed[s.ID] {
+			pending = append(pending, s)
+		}
+	}
+	l.pendingCreate = pending
+	for id := range removed {
+		delete(l.belowMin, id)
+	}
+	if l.Args.RemoveGrace > 0 {
+		deadline := time.Now().Add(time.Second * time.Duration(l.Args.RemoveGrace))
+		for _, id := range *serviceIDs {
+			l.graceRemove[id] = deadline
+		}
+		return
+	}
+	l.pendingRemove = append(l.pendingRemove, *serviceIDs...)
+	if l.Args.MaxPerCycle <= 0 {
+		l.processPending()
+	}
+}
+
+// cancelRemoval keeps the routes of a service that reappeared within the remove grace period
+func (l *listener) cancelRemoval(serviceID string) {
+	if _, ok := l.graceRemove[serviceID]; ok {
+		logPrintf("Service %s reappeared. Its removal is canceled", serviceID)
+		delete(l.graceRemove, serviceID)
+	}
+}
+
+// removeVanishedRoutes removes BigIp routes of services that are no longer running.
+// It catches services whose remove event was missed.
+// Services waiting for their remove grace period or already queued for removal are left alone.
+// Nothing is removed while the listener is warming up.
+// Services are listed even without routes until they were listed without errors once, so that the listener becomes ready.
+func (l *listener) removeVanishedRoutes() {
+	routes := l.BigIp.GetRoutes()
+	if len(routes) == 0 && l.cleanPoll {
+		return
+	}
+	services, err := l.Service.GetServices()
+	if err != nil {
+		metrics.RecordError("GetServices")
+		return
+	}
+	warmingUp := l.isWarmingUp()
+	l.markPolled()
+	if warmingUp {
+		logPrintf("The listener is warming up. Routes of services that are no longer running are kept")
+		return
+	}
+	running := map[string]bool{}
+	for _, s := range *services {
+		running[s.ID] = true
+	}
+	for _, id := range l.pendingRemove {
+		running[id] = true
+	}
+	for id := range l.graceRemove {
+		running[id] = true
+	}
+	vanished := []string{}
+	holding := l.isHoldingServices()
+	for id := range routes {
+		//Adopted routes are kept until every listed service had the chance to claim their paths
+		if !running[id] && !(isAdopted(id) && holding) {
+			vanished = append(vanished, id)
+		}
+	}
+	if len(vanished) == 0 {
+		l.heldRemoval = nil
+		return
+	}
+	if !l.isRemovalConfirmed(vanished, len(routes)) {
+		return
+	}
+	logPrintf("Removing routes of %d services that are no longer running", len(vanished))
+	if err := l.BigIp.RemoveRoutes(&vanished); err != nil {
+		metrics.RecordError("RemoveVanishedRoutes")
+	}
+}
+
+// isHoldingServices tells whether listed services might not be routed yet,
+// because they are queued, held back by `com.df.minReplicas` or the last cycle failed
+func (l *listener) isHoldingServices() bool {
+	return len(l.pendingCreate) > 0 || len(l.belowMin) > 0 || l.failures > 0
+}
+
+// isRemovalConfirmed tells whether the routes of the vanished services can be removed.
+// With `DF_MAX_REMOVE_FRACTION`, the removal of a larger fraction of the routed services is held,
+// e.g. when a Docker API glitch returns too few services, until the next cycle finds the same services vanished.
+func (l *listener) isRemovalConfirmed(vanished []string, routed int) bool {
+	if l.Args.MaxRemoveFraction <= 0 || float64(len(vanished)) <= l.Args.MaxRemoveFraction*float64(routed) {
+		l.heldRemoval = nil
+		return true
+	}
+	confirmed := l.heldRemoval != nil
+	for _, id := range vanished {
+		if !l.heldRemoval[id] {
+			confirmed = false
+		}
+	}
+	if confirmed {
+		logPrintf("WARNING: The removal of routes of %d out of %d services is confirmed", len(vanished), routed)
+		l.heldRemoval = nil
+		return true
+	}
+	logPrintf("ERROR: Routes of %d out of %d services are no longer running, more than DF_MAX_REMOVE_FRACTION %g. The removal is held until the next cycle confirms it", len(vanished), routed, l.Args.MaxRemoveFraction)
+	metrics.RecordError("MaxRemoveFraction")
+	l.heldRemoval = map[string]bool{}
+	for _, id := range vanished {
+		l.heldRemoval[id] = true
+	}
+	return false
+}
+
+// waitInitialDelay waits `DF_INITIAL_DELAY` before the first poll.
+// It gives the Docker manager and the config API time to come up when they start together with the listener.
+func (l *listener) waitInitialDelay() {
+	if l.Args.InitialDelay <= 0 {
+		return
+	}
+	logPrintf("Waiting %d seconds before the first poll", l.Args.InitialDelay)
+	sleep(time.Second * time.Duration(l.Args.InitialDelay))
+}
+
+// isWarmingUp returns true until `DF_STARTUP_GRACE` elapsed and services were listed without errors at least once.
+// It keeps a shaky start, e.g. with a persisted route cache and an unstable Docker API, from removing routes.
+func (l *listener) isWarmingUp() bool {
+	if l.Args.StartupGrace <= 0 {
+		return false
+	}
+	return !l.cleanPoll || time.Since(l.startedAt) < time.Second*time.Duration(l.Args.StartupGrace)
+}
+
+// auditCaches records how many services differ between the service cache and the BigIp route cache
+func (l *listener) auditCaches() {
+	if _, ok := l.BigIp.(noopBigIp); ok {
+		return
+	}
+	knownNotRouted, routedNotKnown := getCacheDivergence(service.GetCachedServices(), l.BigIp.GetRoutes())
+	metrics.RecordCacheDivergence("known_not_routed", knownNotRouted)
+	metrics.RecordCacheDivergence("routed_not_known", routedNotKnown)
+}
+
+// mirrorServices writes the known services to the file set with `DF_SERVICES_FILE`, if any
+func (l *listener) mirrorServices() {
+	if len(l.servicesFile) == 0 {
+		return
+	}
+	if err := writeServicesFile(l.servicesFile, service.GetCachedServices()); err != nil {
+		logPrintf("ERROR: Unable to write services file %s \n %s", l.servicesFile, err.Error())
+		metrics.RecordError("WriteServicesFile")
+	}
+}
+
+// getCacheDivergence returns the number of services with routing labels that have no routes
+// and the number of services with routes that are not known
+func getCacheDivergence(known map[string]service.SwarmService, routes map[string]ServiceRoutes) (int, int) {
+	knownNotRouted := 0
+	for id, s := range known {
+		_, hasPath := s.Spec.Labels[service.Label(SERVICE_PATH_LABEL)]
+		_, hasDomain := s.Spec.Labels[service.Label(SERVICE_DOMAIN_LABEL)]
+		if _, ok := routes[id]; !ok && (hasPath || hasDomain) {
+			knownNotRouted++
+		}
+	}
+	routedNotKnown := 0
+	for id := range routes {
+		if _, ok := known[id]; !ok {
+			routedNotKnown++
+		}
+	}
+	return knownNotRouted, routedNotKnown
+}
+
+// queueExpiredRemovals queues the removal of services whose grace period elapsed
+func (l *listener) queueExpiredRemovals() {
+	now := time.Now()
+	for id, deadline := range l.graceRemove {
+		if !now.Before(deadline) {
+			l.pendingRemove = append(l.pendingRemove, id)
+			delete(l.graceRemove, id)
+		}
+	}
+}
+
+// recordBigIpSync marks the processed services as out of sync with BigIp when the update failed.
+// Services are in sync again once a later update including them succeeds.
+func (l *listener) recordBigIpSync(create []service.SwarmService, remove []string, err error) {
+	ids := remove
+	for _, s := range create {
+		ids = append(ids, s.ID)
+	}
+	for _, id := range ids {
+		if err != nil {
+			service.Unsynced.Add(id, service.UNSYNCED_TARGET_BIGIP, err.Error())
+		} else {
+			service.Unsynced.Remove(id, service.UNSYNCED_TARGET_BIGIP)
+		}
+	}
+}
+
+// nextInterval returns the interval until the next cycle.
+// It doubles for each consecutive failed cycle, up to `MaxInterval`.
+// While cooling down after a mass change, it is at least `CooldownInterval`.
+func (l *listener) nextInterval() time.Duration {
+	interval := time.Second * time.Duration(l.Args.Interval)
+	maxInterval := time.Second * time.Duration(l.Args.MaxInterval)
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	for i := 0; i < l.failures && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	if cooldown := time.Second * time.Duration(l.Args.CooldownInterval); l.coolingDown && interval < cooldown {
+		interval = cooldown
+	}
+	return interval
+}
+
+// recordChanges starts a cooldown when more than `CooldownChanges` services changed,
+// so that BigIp is reconciled less often while a large deploy settles.
+// The cooldown ends with the first cycle with fewer changes.
+func (l *listener) recordChanges(count int) {
+	if l.Args.CooldownChanges <= 0 {
+		return
+	}
+	mass := count > l.Args.CooldownChanges
+	if mass && !l.coolingDown {
+		logPrintf("%d services changed. The interval is extended to %ds until the changes settle", count, l.Args.CooldownInterval)
+	} else if !mass && l.coolingDown {
+		logPrintf("Changes settled. The interval is restored")
+	}
+	l.coolingDown = mass
+}
+
+// processPending processes at most `MaxPerCycle` queued services, removals first.
+// The rest stays queued for the following cycles.
+// BigIp routes of all processed services are reconciled with a single update per data group.
+// BigIp is reconciled even when nothing is queued so that authoritative mode can remove drift.
+// Queued removals of services whose ID still exists are sent as a single create notification, so that an update does not look like a flap.
+// A cycle in which every operation failed increases the backoff, any success resets it.
+// A cycle with more than `CooldownChanges` changes extends the interval until a quieter cycle.
+// Nothing is processed while the listener is paused.
+func (l *listener) processPending() {
+	if l.pause.IsPaused() {
+		return
+	}
+	l.queueExpiredRemovals()
+	l.holdBelowMinReplicas()
+	budget := len(l.pendingRemove) + len(l.pendingCreate)
+	if l.Args.MaxPerCycle > 0 && l.Args.MaxPerCycle < budget {
+		budget = l.Args.MaxPerCycle
+	}
+	remove := []string{}
+	create := []service.SwarmService{}
+	updated := []service.SwarmService{}
+	var removeErr, createErr error
+	if len(l.pendingRemove) > 0 {
+		count := len(l.pendingRemove)
+		if count > budget {
+			count = budget
+		}
+		remove, updated = service.SplitPersisted(l.Service, l.pendingRemove[:count])
+		l.pendingRemove = l.pendingRemove[count:]
+		budget -= count
+		for _, s := range updated {
+			logPrintf("Service %s still exists. It is notified as updated instead of removed", s.Spec.Name)
+		}
+		if len(remove) > 0 {
+			removeErr = l.Notification.ServicesRemove(&remove, l.Args.Retry, l.Args.RetryInterval)
+			metrics.RecordService(len(service.GetCachedServices()))
+			if removeErr != nil {
+				metrics.RecordError("ServicesRemove")
+			}
+		}
+	}
+	if len(l.pendingCreate) > 0 && budget > 0 {
+		count := len(l.pendingCreate)
+		if count > budget {
+			count = budget
+		}
+		create = l.pendingCreate[:count]
+		l.pendingCreate = l.pendingCreate[count:]
+		createErr = l.Notification.ServicesCreate(
+			&create,
+			l.Args.Retry,
+			l.Args.RetryInterval,
+		)
+		if createErr != nil {
+			metrics.RecordError("ServicesCreate")
+		}
+	}
+	if len(updated) > 0 {
+		if err := l.Notification.ServicesCreate(&updated, l.Args.Retry, l.Args.RetryInterval); err != nil {
+			metrics.RecordError("ServicesCreate")
+			createErr = err
+		}
+		//create shares its array with the queue, so it is copied before it is extended
+		create = append(append([]service.SwarmService{}, create...), updated...)
+	}
+	bigIpErr := l.BigIp.Reconcile(&create, &remove)
+	l.recordChanges(len(remove) + len(create))
+	if len(remove) == 0 && len(create) == 0 {
+		return
+	}
+	l.publishChanges(create, remove)
+	l.trackNotified(create, remove)
+	l.recordBigIpSync(create, remove, bigIpErr)
+	removeFailed := len(remove) == 0 || removeErr != nil || bigIpErr != nil
+	createFailed := len(create) == 0 || createErr != nil || bigIpErr != nil
+	if removeFailed && createFailed {
+		l.failures++
+	} else {
+		l.failures = 0
+	}
+	if len(l.pendingRemove) > 0 || len(l.pendingCreate) > 0 {
+		logPrintf("%d removed and %d new services are deferred to the next cycle", len(l.pendingRemove), len(l.pendingCreate))
+	}
+}
+
+// holdBelowMinReplicas keeps services with fewer running tasks than their `com.df.minReplicas` label
+// from being notified and routed. Held services are checked again every cycle.
+func (l *listener) holdBelowMinReplicas() {
+	if l.tasks == nil || (len(l.belowMin) == 0 && len(l.pendingCreate) == 0) {
+		return
+	}
+	queued := map[string]bool{}
+	for _, s := range l.pendingCreate {
+		queued[s.ID] = true
+	}
+	//Queued services are newer than held ones of the same ID
+	candidates := []service.SwarmService{}
+	for id, s := range l.belowMin {
+		if !queued[id] {
+			candidates = append(candidates, s)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	candidates = append(candidates, l.pendingCreate...)
+	held := l.belowMin
+	l.belowMin = map[string]service.SwarmService{}
+	pending := []service.SwarmService{}
+	for _, s := range candidates {
+		minReplicas := service.GetMinReplicas(s)
+		if minReplicas == 0 {
+			pending = append(pending, s)
+			continue
+		}
+		running, err := l.tasks.RunningTasks(s)
+		if err != nil {
+			logPrintf("WARNING: Unable to count the running tasks of the service %s: %s", s.Spec.Name, err.Error())
+			metrics.RecordError("RunningTasks")
+		}
+		if err != nil || running < minReplicas {
+			if _, ok := held[s.ID]; !ok {
+				logPrintf("Service %s has %d out of %d required running tasks. It is not notified and routed until it has them", s.Spec.Name, running, minReplicas)
+			}
+			l.belowMin[s.ID] = s
+			continue
+		}
+		pending = append(pending, s)
+	}
+	l.pendingCreate = pending
+}
+
+// trackNotified records when services were last notified, so that they are notified again after `DF_RENOTIFY_INTERVAL`
+func (l *listener) trackNotified(create []service.SwarmService, remove []string) {
+	now := time.Now()
+	for _, id := range remove {
+		delete(l.notifiedAt, id)
+	}
+	for _, s := range create {
+		l.notifiedAt[s.ID] = now
+	}
+}
+
+// renotifyServices notifies consumers again of the cached services that were last notified
+// longer than `DF_RENOTIFY_INTERVAL` ago, even though they did not change.
+// Consumers that dropped the config of a service receive it again. BigIp routes are left alone.
+func (l *listener) renotifyServices() {
+	if l.Args.RenotifyInterval <= 0 {
+		return
+	}
+	maxAge := time.Second * time.Duration(l.Args.RenotifyInterval)
+	stale := []service.SwarmService{}
+	for id, s := range service.GetCachedServices() {
+		if notifiedAt, ok := l.notifiedAt[id]; ok && time.Since(notifiedAt) >= maxAge {
+			stale = append(stale, s)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].ID < stale[j].ID })
+	logPrintf("Notifying %d services again that were last notified more than %s ago", len(stale), maxAge)
+	if err := l.Notification.ServicesCreate(&stale, l.Args.Retry, l.Args.RetryInterval); err != nil {
+		metrics.RecordError("ServicesCreate")
+	}
+	now := time.Now()
+	for _, s := range stale {
+		l.notifiedAt[s.ID] = now
+	}
+}
+
+// publishChanges streams the processed services to the subscribers of the change feed.
+// Services published before are streamed as updated.
+func (l *listener) publishChanges(create []service.SwarmService, remove []string) {
+	now := time.Now().UTC()
+	for _, id := range remove {
+		delete(l.announced, id)
+		l.changes.Publish(ServiceChange{Action: "remove", ServiceID: id, Ts: now})
+	}
+	for _, s := range create {
+		action := "create"
+		if l.announced[s.ID] {
+			action = "update"
+		}
+		l.announced[s.ID] = true
+		l.changes.Publish(ServiceChange{Action: action, ServiceID: s.ID, ServiceName: s.Spec.Name, Ts: now})
+	}
+}
@@ -0,0 +1,975 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"./service"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type ListenerTestSuite struct {
+	suite.Suite
+}
+
+func TestListenerUnitTestSuite(t *testing.T) {
+	s := new(ListenerTestSuite)
+	suite.Run(t, s)
+}
+
+func (s *ListenerTestSuite) SetupTest() {
+	service.Unsynced = service.NewUnsyncedServices()
+}
+
+// notifyStartup
+
+func (s *ListenerTestSuite) Test_NotifyStartup_SendsRequestOnce() {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer srv.Close()
+
+	notifyStartup(srv.URL, time.Second)
+
+	s.Equal(1, requests)
+}
+
+func (s *ListenerTestSuite) Test_NotifyStartup_GivesUpAfterTimeout() {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	start := time.Now()
+	notifyStartup(srv.URL, 50*time.Millisecond)
+
+	s.True(time.Since(start) < time.Second, "startup notification should not block the listener")
+}
+
+// runCycle
+
+func (s *ListenerTestSuite) Test_RunCycle_RecordsDuration() {
+	before := getHistogramCount("docker_flow_cycle_duration_seconds")
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		},
+	}
+	l := newListener(getServicerMock(""), NotificationMock{}, bigIpMock, getArgs())
+
+	duration := l.runCycle()
+
+	s.True(duration >= 10*time.Millisecond, "duration should include the BigIp reconciliation")
+	s.Equal(before+1, getHistogramCount("docker_flow_cycle_duration_seconds"))
+}
+
+func (s *ListenerTestSuite) Test_RunCycle_QueuesChanges_WhilePaused() {
+	created := 0
+	reconciled := 0
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			created += len(*services)
+			return nil
+		},
+	}
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			reconciled++
+			return nil
+		},
+	}
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, getArgs())
+	l.pause.Pause()
+
+	l.createServices(&[]service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}})
+	l.runCycle()
+
+	s.Equal(0, created)
+	s.Equal(0, reconciled)
+	s.Len(l.pendingCreate, 1)
+
+	l.pause.Resume()
+	l.runCycle()
+
+	s.Equal(1, created)
+	s.Equal(1, reconciled)
+	s.Empty(l.pendingCreate)
+}
+
+// handleEvent
+
+func (s *ListenerTestSuite) Test_HandleEvent_RunsWithoutBigIp() {
+	services := []service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}}
+	servicerMock := getServicerMock("GetNewServices")
+	servicerMock.On("GetNewServices", mock.Anything).Return(&services, nil)
+	created := 0
+	removed := 0
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			created += len(*services)
+			return nil
+		},
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			removed += len(*remove)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, notifMock, noopBigIp{}, getArgs())
+
+	s.NotPanics(func() {
+		l.handleEvent(service.Event{Action: "create", ServiceID: "my-service-id"})
+		l.handleEvent(service.Event{Action: "remove", ServiceID: "my-service-id"})
+	})
+	s.Equal(1, created)
+	s.Equal(1, removed)
+}
+
+func (s *ListenerTestSuite) Test_HandleEvent_NotifiesScaleChanges() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	getService := func(replicas uint64) service.SwarmService {
+		ss := service.SwarmService{Service: swarm.Service{ID: "my-service-id"}}
+		ss.Spec.Name = "my-service"
+		ss.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+		return ss
+	}
+	service.CachedServices = map[string]service.SwarmService{"my-service-id": getService(1)}
+	servicerMock := getServicerMock("GetServicesFromID")
+	servicerMock.On("GetServicesFromID", "my-service-id").Return(&[]service.SwarmService{getService(3)}, nil)
+	scaled := []service.ScaleChange{}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+		ServicesScaleMock: func(changes []service.ScaleChange, retries, interval int) error {
+			scaled = append(scaled, changes...)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, notifMock, noopBigIp{}, getArgs())
+
+	l.handleEvent(service.Event{Action: "update", ServiceID: "my-service-id"})
+
+	s.Equal([]service.ScaleChange{{ServiceID: "my-service-id", ServiceName: "my-service", Replicas: 3, PreviousReplicas: 1}}, scaled)
+}
+
+func (s *ListenerTestSuite) Test_HandleEvent_DoesNotNotifyScale_WhenReplicasAreUnchanged() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	replicas := uint64(2)
+	ss := service.SwarmService{Service: swarm.Service{ID: "my-service-id"}}
+	ss.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+	service.CachedServices = map[string]service.SwarmService{"my-service-id": ss}
+	servicerMock := getServicerMock("GetServicesFromID")
+	servicerMock.On("GetServicesFromID", "my-service-id").Return(&[]service.SwarmService{ss}, nil)
+	scaled := 0
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+		ServicesScaleMock: func(changes []service.ScaleChange, retries, interval int) error {
+			scaled += len(changes)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, notifMock, noopBigIp{}, getArgs())
+
+	l.handleEvent(service.Event{Action: "update", ServiceID: "my-service-id"})
+
+	s.Equal(0, scaled)
+}
+
+// processPending
+
+func (s *ListenerTestSuite) Test_ProcessPending_TracksServicesOutOfSyncWithBigIp() {
+	bigIpErr := fmt.Errorf("BigIp is down")
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			return bigIpErr
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+	}
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, getArgs())
+	services := []service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}}
+
+	l.createServices(&services)
+
+	unsynced := service.Unsynced.List()
+	s.Require().Len(unsynced, 1)
+	s.Equal("my-service-id", unsynced[0].ServiceID)
+	s.Equal(service.UNSYNCED_TARGET_BIGIP, unsynced[0].Target)
+	s.Equal(bigIpErr.Error(), unsynced[0].Reason)
+
+	bigIpErr = nil
+	l.createServices(&services)
+
+	s.Empty(service.Unsynced.List())
+}
+
+func (s *ListenerTestSuite) Test_ProcessPending_HoldsServices_UntilMinReplicasAreRunning() {
+	routed := []string{}
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			for _, s := range *added {
+				routed = append(routed, s.ID)
+			}
+			return nil
+		},
+	}
+	notified := []string{}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			for _, s := range *services {
+				notified = append(notified, s.ID)
+			}
+			return nil
+		},
+	}
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, getArgs())
+	tasks := taskCounterMock{"critical-id": 1}
+	l.tasks = tasks
+	critical := service.SwarmService{Service: swarm.Service{ID: "critical-id"}}
+	critical.Spec.Labels = map[string]string{service.MIN_REPLICAS_LABEL: "2"}
+	other := service.SwarmService{Service: swarm.Service{ID: "other-id"}}
+
+	l.createServices(&[]service.SwarmService{critical, other})
+
+	s.Equal([]string{"other-id"}, routed)
+	s.Equal([]string{"other-id"}, notified)
+
+	l.runCycle()
+
+	s.Equal([]string{"other-id"}, routed, "services below the minimum should be held across cycles")
+
+	tasks["critical-id"] = 2
+	l.runCycle()
+
+	s.Equal([]string{"other-id", "critical-id"}, routed)
+	s.Equal([]string{"other-id", "critical-id"}, notified)
+	s.Empty(l.belowMin)
+}
+
+func (s *ListenerTestSuite) Test_RemoveServices_ForgetsHeldServices() {
+	l := newListener(getServicerMock(""), NotificationMock{}, BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error { return nil },
+	}, getArgs())
+	l.tasks = taskCounterMock{}
+	l.Args.MaxPerCycle = 1
+	critical := service.SwarmService{Service: swarm.Service{ID: "critical-id"}}
+	critical.Spec.Labels = map[string]string{service.MIN_REPLICAS_LABEL: "2"}
+	l.pendingCreate = []service.SwarmService{critical}
+	l.processPending()
+	s.Len(l.belowMin, 1)
+
+	l.removeServices(&[]string{"critical-id"})
+
+	s.Empty(l.belowMin)
+}
+
+func (s *ListenerTestSuite) Test_RunCycle_RenotifiesServices_WhenRenotifyIntervalElapsed() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	notified := []string{}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			for _, s := range *services {
+				notified = append(notified, s.ID)
+			}
+			return nil
+		},
+	}
+	routed := 0
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			routed += len(*added)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.RenotifyInterval = 60
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, args)
+	services := []service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}}
+	service.CachedServices = map[string]service.SwarmService{"my-service-id": services[0]}
+	l.createServices(&services)
+
+	l.runCycle()
+
+	s.Equal([]string{"my-service-id"}, notified, "services should not be notified again within the interval")
+
+	l.notifiedAt["my-service-id"] = time.Now().Add(-time.Minute)
+	l.runCycle()
+
+	s.Equal([]string{"my-service-id", "my-service-id"}, notified)
+	s.Equal(1, routed, "routes should not be added again")
+	s.True(time.Since(l.notifiedAt["my-service-id"]) < time.Minute)
+}
+
+func (s *ListenerTestSuite) Test_ProcessPending_PublishesChanges() {
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			return nil
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+	}
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, getArgs())
+	changes := l.changes.Subscribe()
+	services := []service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}}
+	services[0].Spec.Name = "my-service"
+
+	l.createServices(&services)
+	l.createServices(&services)
+
+	created := <-changes
+	s.Equal("create", created.Action)
+	s.Equal("my-service-id", created.ServiceID)
+	s.Equal("my-service", created.ServiceName)
+	s.Equal("update", (<-changes).Action)
+}
+
+func (s *ListenerTestSuite) Test_HandleEvent_NotifiesUpdate_WhenRemovedServiceIDStillExists() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	cached := service.SwarmService{Service: swarm.Service{ID: "my-service-id"}}
+	cached.Spec.Name = "my-service"
+	updated := cached
+	updated.Meta.UpdatedAt = time.Now()
+	service.CachedServices = map[string]service.SwarmService{"my-service-id": cached}
+	servicerMock := getServicerMock("GetServicesFromID")
+	servicerMock.On("GetServicesFromID", "my-service-id").Return(&[]service.SwarmService{updated}, nil)
+	created, removed, routesRemoved := []string{}, []string{}, []string{}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			for _, s := range *services {
+				created = append(created, s.ID)
+			}
+			return nil
+		},
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			removed = append(removed, *remove...)
+			return nil
+		},
+	}
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, remove *[]string) error {
+			routesRemoved = append(routesRemoved, *remove...)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, notifMock, bigIpMock, getArgs())
+
+	l.handleEvent(service.Event{Action: "remove", ServiceID: "my-service-id"})
+	l.handleEvent(service.Event{Action: "create", ServiceID: "my-service-id"})
+
+	s.Empty(removed, "remove notification should not be sent")
+	s.Empty(routesRemoved, "routes should not be removed")
+	s.Equal([]string{"my-service-id"}, created, "a single create notification should be sent")
+	s.Equal(updated, service.CachedServices["my-service-id"])
+}
+
+func (s *ListenerTestSuite) Test_ProcessPending_ProcessesAtMostMaxPerCycle() {
+	created := []int{}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			created = append(created, len(*services))
+			return nil
+		},
+	}
+	args := getArgs()
+	args.MaxPerCycle = 2
+	l := newListener(getServicerMock(""), notifMock, noopBigIp{}, args)
+	services := []service.SwarmService{}
+	for i := 0; i < 5; i++ {
+		services = append(services, service.SwarmService{Service: swarm.Service{ID: fmt.Sprintf("my-service-%d", i)}})
+	}
+
+	l.createServices(&services)
+	s.Empty(created, "services should be deferred to the next cycle")
+
+	l.processPending()
+	l.processPending()
+	l.processPending()
+	l.processPending()
+
+	s.Equal([]int{2, 2, 1}, created)
+	s.Empty(l.pendingCreate)
+}
+
+func (s *ListenerTestSuite) Test_ProcessPending_ProcessesRemovalsFirst() {
+	calls := []string{}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			calls = append(calls, "create")
+			return nil
+		},
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			calls = append(calls, "remove")
+			return nil
+		},
+	}
+	args := getArgs()
+	args.MaxPerCycle = 1
+	l := newListener(getServicerMock(""), notifMock, noopBigIp{}, args)
+
+	l.createServices(&[]service.SwarmService{{Service: swarm.Service{ID: "my-service-1"}}})
+	l.removeServices(&[]string{"my-service-2"})
+	l.processPending()
+	l.processPending()
+
+	s.Equal([]string{"remove", "create"}, calls)
+}
+
+func (s *ListenerTestSuite) Test_RemoveServices_DropsPendingCreate() {
+	created := 0
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			created += len(*services)
+			return nil
+		},
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			return nil
+		},
+	}
+	args := getArgs()
+	args.MaxPerCycle = 5
+	l := newListener(getServicerMock(""), notifMock, noopBigIp{}, args)
+
+	l.createServices(&[]service.SwarmService{{Service: swarm.Service{ID: "my-service-1"}}})
+	l.removeServices(&[]string{"my-service-1"})
+	l.processPending()
+
+	s.Equal(0, created)
+}
+
+func (s *ListenerTestSuite) Test_RemoveServices_IsCanceled_WhenServiceReappearsWithinGrace() {
+	services := []service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}}
+	servicerMock := getServicerMock("GetNewServices")
+	servicerMock.On("GetNewServices", mock.Anything).Return(&[]service.SwarmService{}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, remove *[]string) error {
+			removed = append(removed, *remove...)
+			return nil
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			removed = append(removed, *remove...)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.RemoveGrace = 60
+	l := newListener(servicerMock, notifMock, bigIpMock, args)
+	l.createServices(&services)
+
+	l.handleEvent(service.Event{Action: "remove", ServiceID: "my-service-id"})
+	l.processPending()
+	l.handleEvent(service.Event{Action: "update", ServiceID: "my-service-id"})
+	l.processPending()
+
+	s.Empty(removed)
+	s.Empty(l.graceRemove)
+}
+
+func (s *ListenerTestSuite) Test_RemoveServices_RemovesAfterGrace() {
+	removed := []string{}
+	notifMock := NotificationMock{
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			removed = append(removed, *remove...)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.RemoveGrace = 60
+	l := newListener(getServicerMock(""), notifMock, noopBigIp{}, args)
+
+	l.removeServices(&[]string{"my-service-id"})
+	l.processPending()
+	s.Empty(removed, "removal should wait for the grace period")
+
+	l.graceRemove["my-service-id"] = time.Now().Add(-time.Second)
+	l.processPending()
+	s.Equal([]string{"my-service-id"}, removed)
+}
+
+func (s *ListenerTestSuite) Test_ProcessPending_ReconcilesBigIpOnce() {
+	reconciled := [][]int{}
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			reconciled = append(reconciled, []int{len(*added), len(*removed)})
+			return nil
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+		ServicesRemoveMock: func(remove *[]string, retries, interval int) error {
+			return nil
+		},
+	}
+	args := getArgs()
+	args.MaxPerCycle = 5
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, args)
+
+	l.createServices(&[]service.SwarmService{{Service: swarm.Service{ID: "my-service-1"}}})
+	l.removeServices(&[]string{"my-service-2"})
+	l.processPending()
+
+	s.Equal([][]int{{1, 1}}, reconciled)
+}
+
+// clearCaches
+
+func (s *ListenerTestSuite) Test_ClearCaches_NotifiesAndRoutesRunningServicesAgain() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	replicas := uint64(1)
+	running := service.SwarmService{Service: swarm.Service{ID: "my-service-id"}}
+	running.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+	running.Meta.UpdatedAt = time.Now()
+	service.CachedServices = map[string]service.SwarmService{running.ID: running}
+	servicerMock := new(ServicerMock)
+	servicerMock.On("ClearCache")
+	servicerMock.On("GetServicesParameters", mock.Anything).Return(&[]map[string]string{})
+	servicerMock.On("GetServices").Return([]service.SwarmService{running}, nil)
+	servicerMock.On("GetNewServices", mock.Anything).Return(&[]service.SwarmService{running}, nil)
+	routesCleared := false
+	routed := []string{}
+	notified := []string{}
+	bigIpMock := BigIpMock{
+		ClearRoutesMock: func() { routesCleared = true },
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			for _, ss := range *added {
+				routed = append(routed, ss.ID)
+			}
+			return nil
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			for _, ss := range *services {
+				notified = append(notified, ss.ID)
+			}
+			return nil
+		},
+	}
+	l := newListener(servicerMock, notifMock, bigIpMock, getArgs())
+
+	l.clearCaches()
+
+	s.Empty(notified, "nothing should happen until clearing is requested")
+	l.cacheClear.Request(true, true)
+	l.clearCaches()
+
+	servicerMock.AssertCalled(s.T(), "ClearCache")
+	s.True(routesCleared)
+	s.Equal([]string{"my-service-id"}, notified)
+	s.Equal([]string{"my-service-id"}, routed)
+}
+
+func (s *ListenerTestSuite) Test_ClearCaches_RoutesCachedServicesAgain_WhenOnlyRoutesAreCleared() {
+	running := service.SwarmService{Service: swarm.Service{ID: "my-service-id"}}
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{running}, nil)
+	routed := []string{}
+	bigIpMock := BigIpMock{
+		ClearRoutesMock: func() {},
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			for _, ss := range *added {
+				routed = append(routed, ss.ID)
+			}
+			return nil
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error { return nil },
+	}
+	l := newListener(servicerMock, notifMock, bigIpMock, getArgs())
+
+	l.cacheClear.Request(false, true)
+	l.clearCaches()
+
+	servicerMock.AssertNotCalled(s.T(), "ClearCache")
+	s.Equal([]string{"my-service-id"}, routed)
+}
+
+// removeVanishedRoutes
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_RemovesRoutesOfServicesNotRunning() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{{Service: swarm.Service{ID: "running-id"}}}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{
+			"running-id":  {Paths: []string{"/running"}},
+			"vanished-id": {Paths: []string{"/vanished"}},
+			"grace-id":    {Paths: []string{"/grace"}},
+		},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, getArgs())
+	l.graceRemove["grace-id"] = time.Now().Add(time.Minute)
+
+	l.removeVanishedRoutes()
+
+	s.Equal([]string{"vanished-id"}, removed)
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_KeepsAdoptedRoutes_WhileServicesAreHeld() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{{Service: swarm.Service{ID: "running-id"}}}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{
+			"running-id":            {Paths: []string{"/running"}},
+			ADOPTED_PREFIX + "pool": {Paths: []string{"/adopted"}},
+		},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, getArgs())
+	held := service.SwarmService{Service: swarm.Service{ID: "held-id"}}
+
+	l.pendingCreate = []service.SwarmService{held}
+	l.removeVanishedRoutes()
+	l.pendingCreate = nil
+	l.belowMin[held.ID] = held
+	l.removeVanishedRoutes()
+
+	s.Empty(removed, "adopted routes should be kept while listed services are not routed")
+
+	delete(l.belowMin, held.ID)
+	l.removeVanishedRoutes()
+
+	s.Equal([]string{ADOPTED_PREFIX + "pool"}, removed)
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_KeepsRoutes_DuringStartupGrace() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{"my-service-id": {Paths: []string{"/demo"}}},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.StartupGrace = 60
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, args)
+	l.cleanPoll = true
+
+	l.removeVanishedRoutes()
+	s.Empty(removed, "routes should be kept during the startup grace")
+
+	l.startedAt = time.Now().Add(-time.Minute)
+	l.removeVanishedRoutes()
+	s.Equal([]string{"my-service-id"}, removed)
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_KeepsRoutes_UntilServicesWereListed() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{"my-service-id": {Paths: []string{"/demo"}}},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.StartupGrace = 60
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, args)
+	l.startedAt = time.Now().Add(-time.Minute)
+
+	l.removeVanishedRoutes()
+	s.Empty(removed, "routes should be kept until services were listed without errors")
+
+	l.removeVanishedRoutes()
+	s.Equal([]string{"my-service-id"}, removed)
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_MarksDockerPoll_WhenServicesWereListed() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{}, nil)
+	l := newListener(servicerMock, NotificationMock{}, BigIpMock{}, getArgs())
+
+	l.removeVanishedRoutes()
+
+	s.NotContains(l.ready.Pending(), MILESTONE_DOCKER_POLL, "services should be listed even without routes")
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_DoesNothing_WhenServicesCannotBeListed() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{}, fmt.Errorf("Docker is down"))
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{"my-service-id": {Paths: []string{"/demo"}}},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, getArgs())
+
+	l.removeVanishedRoutes()
+
+	s.Empty(removed)
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_HoldsRemoval_WhenMaxRemoveFractionIsExceeded() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{{Service: swarm.Service{ID: "running-id"}}}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{
+			"running-id":    {Paths: []string{"/running"}},
+			"vanished-id-1": {Paths: []string{"/vanished-1"}},
+			"vanished-id-2": {Paths: []string{"/vanished-2"}},
+		},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.MaxRemoveFraction = 0.5
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, args)
+	errorsBefore := getCounterValue("docker_flow_error", "operation", "MaxRemoveFraction")
+
+	l.removeVanishedRoutes()
+
+	s.Empty(removed, "removal of most services should be held")
+	s.Equal(errorsBefore+1, getCounterValue("docker_flow_error", "operation", "MaxRemoveFraction"))
+
+	l.removeVanishedRoutes()
+
+	sort.Strings(removed)
+	s.Equal([]string{"vanished-id-1", "vanished-id-2"}, removed, "removal should proceed once the next cycle confirms it")
+}
+
+func (s *ListenerTestSuite) Test_RemoveVanishedRoutes_RemovesRoutes_WhenMaxRemoveFractionIsNotExceeded() {
+	servicerMock := getServicerMock("GetServices")
+	servicerMock.On("GetServices").Return([]service.SwarmService{{Service: swarm.Service{ID: "running-id"}}}, nil)
+	removed := []string{}
+	bigIpMock := BigIpMock{
+		Routes: map[string]ServiceRoutes{
+			"running-id":  {Paths: []string{"/running"}},
+			"vanished-id": {Paths: []string{"/vanished"}},
+		},
+		RemoveRoutesMock: func(services *[]string) error {
+			removed = append(removed, *services...)
+			return nil
+		},
+	}
+	args := getArgs()
+	args.MaxRemoveFraction = 0.5
+	l := newListener(servicerMock, NotificationMock{}, bigIpMock, args)
+
+	l.removeVanishedRoutes()
+
+	s.Equal([]string{"vanished-id"}, removed)
+}
+
+// auditCaches
+
+func (s *ListenerTestSuite) Test_AuditCaches_RecordsDivergence() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	withPath := func(id string) service.SwarmService {
+		ss := service.SwarmService{Service: swarm.Service{ID: id}}
+		ss.Spec.Labels = map[string]string{SERVICE_PATH_LABEL: "/" + id}
+		return ss
+	}
+	service.CachedServices = map[string]service.SwarmService{
+		"routed-id":     withPath("routed-id"),
+		"not-routed-1":  withPath("not-routed-1"),
+		"not-routed-2":  withPath("not-routed-2"),
+		"no-routing-id": {Service: swarm.Service{ID: "no-routing-id"}},
+	}
+	bigIpMock := BigIpMock{Routes: map[string]ServiceRoutes{
+		"routed-id":  {Paths: []string{"/routed-id"}},
+		"unknown-id": {Paths: []string{"/unknown-id"}},
+	}}
+	l := newListener(getServicerMock(""), NotificationMock{}, bigIpMock, getArgs())
+
+	l.auditCaches()
+
+	s.Equal(2.0, getGaugeValue("docker_flow_cache_divergence", "kind", "known_not_routed"))
+	s.Equal(1.0, getGaugeValue("docker_flow_cache_divergence", "kind", "routed_not_known"))
+}
+
+// mirrorServices
+
+func (s *ListenerTestSuite) Test_RunCycle_MirrorsServicesToFile() {
+	cachedOrig := service.CachedServices
+	defer func() { service.CachedServices = cachedOrig }()
+	file := "/tmp/df-services-file-test.json"
+	defer os.Remove(file)
+	ss := service.SwarmService{Service: swarm.Service{ID: "my-service-id"}}
+	ss.Spec.Name = "my-service"
+	ss.Spec.Labels = map[string]string{SERVICE_PATH_LABEL: "/demo,/demo2", "com.df.notify": "true", "other": "ignored"}
+	service.CachedServices = map[string]service.SwarmService{"my-service-id": ss}
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			return nil
+		},
+	}
+	l := newListener(getServicerMock(""), NotificationMock{}, bigIpMock, getArgs())
+	l.servicesFile = file
+
+	l.runCycle()
+
+	entries := []servicesFileEntry{}
+	content, err := ioutil.ReadFile(file)
+	s.Require().NoError(err)
+	s.Require().NoError(json.Unmarshal(content, &entries))
+	s.Equal([]servicesFileEntry{{
+		ID:     "my-service-id",
+		Name:   "my-service",
+		Paths:  []string{"/demo", "/demo2"},
+		Labels: map[string]string{SERVICE_PATH_LABEL: "/demo,/demo2", "com.df.notify": "true"},
+	}}, entries)
+
+	service.CachedServices = map[string]service.SwarmService{}
+	l.runCycle()
+
+	content, err = ioutil.ReadFile(file)
+	s.Require().NoError(err)
+	s.JSONEq("[]", string(content))
+	_, err = os.Stat(file + ".tmp")
+	s.True(os.IsNotExist(err))
+}
+
+// waitInitialDelay
+
+func (s *ListenerTestSuite) Test_WaitInitialDelay_SleepsForInitialDelay() {
+	waits := []time.Duration{}
+	sleepOrig := sleep
+	defer func() { sleep = sleepOrig }()
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	args := getArgs()
+	args.InitialDelay = 3
+	l := newListener(getServicerMock(""), NotificationMock{}, BigIpMock{}, args)
+
+	l.waitInitialDelay()
+
+	s.Equal([]time.Duration{3 * time.Second}, waits)
+}
+
+func (s *ListenerTestSuite) Test_WaitInitialDelay_DoesNotSleep_WhenInitialDelayIsNotSet() {
+	waits := []time.Duration{}
+	sleepOrig := sleep
+	defer func() { sleep = sleepOrig }()
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	l := newListener(getServicerMock(""), NotificationMock{}, BigIpMock{}, getArgs())
+
+	l.waitInitialDelay()
+
+	s.Empty(waits)
+}
+
+// nextInterval
+
+func (s *ListenerTestSuite) Test_NextInterval_BacksOffOnFailedCycles() {
+	bigIpErr := fmt.Errorf("BigIp is down")
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			return bigIpErr
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+	}
+	args := getArgs()
+	args.Interval = 5
+	args.MaxInterval = 15
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, args)
+	services := []service.SwarmService{{Service: swarm.Service{ID: "my-service-id"}}}
+
+	s.Equal(5*time.Second, l.nextInterval())
+	l.createServices(&services)
+	s.Equal(10*time.Second, l.nextInterval())
+	l.createServices(&services)
+	s.Equal(15*time.Second, l.nextInterval(), "interval should be capped")
+	l.createServices(&services)
+	s.Equal(15*time.Second, l.nextInterval(), "interval should be capped")
+
+	bigIpErr = nil
+	l.createServices(&services)
+	s.Equal(5*time.Second, l.nextInterval(), "interval should be reset after a successful cycle")
+}
+
+func (s *ListenerTestSuite) Test_NextInterval_CoolsDownAfterMassChange() {
+	bigIpMock := BigIpMock{
+		ReconcileMock: func(added *[]service.SwarmService, removed *[]string) error {
+			return nil
+		},
+	}
+	notifMock := NotificationMock{
+		ServicesCreateMock: func(services *[]service.SwarmService, retries, interval int) error {
+			return nil
+		},
+	}
+	args := getArgs()
+	args.Interval = 5
+	args.CooldownChanges = 2
+	args.CooldownInterval = 30
+	l := newListener(getServicerMock(""), notifMock, bigIpMock, args)
+	services := []service.SwarmService{
+		{Service: swarm.Service{ID: "my-service-id-1"}},
+		{Service: swarm.Service{ID: "my-service-id-2"}},
+		{Service: swarm.Service{ID: "my-service-id-3"}},
+	}
+
+	l.createServices(&services)
+	s.Equal(30*time.Second, l.nextInterval(), "interval should be extended after a mass change")
+
+	l.createServices(&[]service.SwarmService{services[0]})
+	s.Equal(5*time.Second, l.nextInterval(), "interval should be restored after a quiet cycle")
+}
+
+func getHistogramCount(name string) uint64 {
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, f := range families {
+		if f.GetName() == name && len(f.GetMetric()) > 0 {
+			return f.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
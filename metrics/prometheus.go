@@ -1,6 +1,9 @@
 package metrics
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -23,8 +26,64 @@ var serviceGauge = prometheus.NewGaugeVec(
 	[]string{"service"},
 )
 
+var dataGroupSizeGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "docker_flow",
+		Name:      "data_group_size",
+		Help:      "Number of records in the BigIp data group",
+	},
+	[]string{"service", "data_group"},
+)
+
+var cacheDivergenceGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "docker_flow",
+		Name:      "cache_divergence",
+		Help:      "Number of services that differ between the service cache and the BigIp route cache",
+	},
+	[]string{"service", "kind"},
+)
+
+var cycleDurationHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Subsystem: "docker_flow",
+		Name:      "cycle_duration_seconds",
+		Help:      "Duration of a full cycle of the listener",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	},
+	[]string{"service"},
+)
+
+var infoGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "docker_flow",
+		Name:      "listener_info",
+		Help:      "Configuration of the listener, always 1",
+	},
+	[]string{"service", "version", "interval", "bigip_enabled"},
+)
+
+// Info is the configuration of the listener exposed by the info metric
+type Info struct {
+	Version      string
+	Interval     int
+	BigIpEnabled bool
+}
+
 func init() {
-	prometheus.MustRegister(errorCounter, serviceGauge)
+	prometheus.MustRegister(errorCounter, serviceGauge, dataGroupSizeGauge, cacheDivergenceGauge, cycleDurationHistogram, infoGauge)
+}
+
+// RecordInfo stores the configuration of the listener as the labels of a Prometheus metric with the value 1,
+// so that dashboards can select listeners by their configuration. It replaces the configuration recorded before.
+func RecordInfo(info Info) {
+	infoGauge.Reset()
+	infoGauge.With(prometheus.Labels{
+		"service":       serviceName,
+		"version":       info.Version,
+		"interval":      strconv.Itoa(info.Interval),
+		"bigip_enabled": strconv.FormatBool(info.BigIpEnabled),
+	}).Set(1)
 }
 
 // RecordError stores error information as Prometheus metric.
@@ -42,3 +101,27 @@ func RecordService(count int) {
 		"service": serviceName,
 	}).Set(float64(count))
 }
+
+// RecordDataGroupSize stores the number of records in a BigIp data group as Prometheus metric.
+func RecordDataGroupSize(dataGroup string, count int) {
+	dataGroupSizeGauge.With(prometheus.Labels{
+		"service":    serviceName,
+		"data_group": dataGroup,
+	}).Set(float64(count))
+}
+
+// RecordCacheDivergence stores the number of services of a kind of divergence between caches as Prometheus metric.
+// The `kind` argument is either `known_not_routed` or `routed_not_known`.
+func RecordCacheDivergence(kind string, count int) {
+	cacheDivergenceGauge.With(prometheus.Labels{
+		"service": serviceName,
+		"kind":    kind,
+	}).Set(float64(count))
+}
+
+// RecordCycleDuration stores the duration of a full cycle of the listener as Prometheus metric.
+func RecordCycleDuration(duration time.Duration) {
+	cycleDurationHistogram.With(prometheus.Labels{
+		"service": serviceName,
+	}).Observe(duration.Seconds())
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/suite"
+)
+
+type PrometheusTestSuite struct {
+	suite.Suite
+}
+
+func TestPrometheusUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(PrometheusTestSuite))
+}
+
+func (s *PrometheusTestSuite) Test_RecordInfo_ExposesConfigurationAsLabels() {
+	RecordInfo(Info{Version: "1.2.3", Interval: 5, BigIpEnabled: false})
+	RecordInfo(Info{Version: "1.2.3", Interval: 10, BigIpEnabled: true})
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	s.Require().NoError(err)
+	var metrics []*dto.Metric
+	for _, f := range families {
+		if f.GetName() == "docker_flow_listener_info" {
+			metrics = f.GetMetric()
+		}
+	}
+	s.Require().Len(metrics, 1, "only the latest configuration should be exposed")
+	labels := map[string]string{}
+	for _, l := range metrics[0].GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	s.Equal(map[string]string{"service": "swarm_listener", "version": "1.2.3", "interval": "10", "bigip_enabled": "true"}, labels)
+	s.Equal(1.0, metrics[0].GetGauge().GetValue())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// recordNameTransform changes the name of a record to the shape the data group expects
+type recordNameTransform func(name string) string
+
+// recordNameTransforms holds the transforms that can be combined with `DF_RECORD_NAME_TRANSFORM`.
+// Transforms with an argument are written as `name:argument`.
+var recordNameTransforms = map[string]struct {
+	hasArg bool
+	new    func(arg string) recordNameTransform
+}{
+	"trim-slash": {false, func(arg string) recordNameTransform {
+		return func(name string) string { return strings.TrimLeft(name, "/") }
+	}},
+	"add-slash": {false, func(arg string) recordNameTransform {
+		return func(name string) string { return "/" + strings.TrimLeft(name, "/") }
+	}},
+	"prefix": {true, func(arg string) recordNameTransform {
+		return func(name string) string { return arg + name }
+	}},
+	"suffix": {true, func(arg string) recordNameTransform {
+		return func(name string) string { return name + arg }
+	}},
+	"trim-prefix": {true, func(arg string) recordNameTransform {
+		return func(name string) string { return strings.TrimPrefix(name, arg) }
+	}},
+}
+
+// parseRecordNameTransforms returns the comma-separated transforms, applied in the order they are listed
+func parseRecordNameTransforms(spec string) ([]recordNameTransform, error) {
+	transforms := []recordNameTransform{}
+	for _, t := range strings.Split(spec, ",") {
+		t = strings.TrimSpace(t)
+		if len(t) == 0 {
+			continue
+		}
+		parts := strings.SplitN(t, ":", 2)
+		factory, ok := recordNameTransforms[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown record name transform %s", parts[0])
+		}
+		arg := ""
+		if len(parts) > 1 {
+			arg = parts[1]
+		}
+		if factory.hasArg != (len(arg) > 0) {
+			return nil, fmt.Errorf("Invalid argument of the record name transform %s", t)
+		}
+		transforms = append(transforms, factory.new(arg))
+	}
+	return transforms, nil
+}
+
+// transformNames returns the names changed by the record name transforms
+func transformNames(transforms []recordNameTransform, names []string) []string {
+	if len(transforms) == 0 || len(names) == 0 {
+		return names
+	}
+	transformed := []string{}
+	for _, name := range names {
+		for _, t := range transforms {
+			name = t(name)
+		}
+		transformed = append(transformed, name)
+	}
+	return transformed
+}
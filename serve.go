@@ -1,35 +1,86 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"./metrics"
 	"./service"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var httpListenAndServe = http.ListenAndServe
+// DEFAULT_SHUTDOWN_TIMEOUT is how long (in seconds) in-flight requests are drained when `DF_SERVE_SHUTDOWN_TIMEOUT` is not set
+const DEFAULT_SHUTDOWN_TIMEOUT = 10
+
+var httpListenAndServe = func(server *http.Server) error {
+	return server.ListenAndServe()
+}
 var httpWriterSetContentType = func(w http.ResponseWriter, value string) {
 	w.Header().Set("Content-Type", value)
 }
 
 // Serve is the instance structure
 type Serve struct {
-	Service      service.Servicer
-	Notification service.Sender
+	Service         service.Servicer
+	Notification    service.Sender
+	BigIp           BigIpClient
+	Config          *EffectiveConfig
+	Pause           *pauseSwitch
+	CacheClear      *cacheClearSwitch
+	Ready           *readinessGate
+	Changes         *changeFeed
+	AuthToken       string
+	ShutdownTimeout time.Duration
+	server          *http.Server
+	lock            sync.Mutex
 }
 
-//Response message
+// Response message
 type Response struct {
 	Status string
 }
 
+// NotifyReport describes the outcome of forced notifications
+type NotifyReport struct {
+	Status   string                       `json:"status"`
+	Services []service.NotificationResult `json:"services"`
+}
+
+// HealthStatus is the health of the listener. It is degraded while services are out of sync.
+type HealthStatus struct {
+	Status   string
+	Unsynced []service.UnsyncedService `json:",omitempty"`
+}
+
+// ReadinessStatus tells whether the listener reached its startup milestones
+type ReadinessStatus struct {
+	Status  string
+	Pending []string `json:",omitempty"`
+}
+
+// RecentActions describes the most recent actions that need attention
+type RecentActions struct {
+	NotificationFailures []service.NotificationFailure `json:"notificationFailures"`
+	UnsyncedServices     []service.UnsyncedService     `json:"unsyncedServices"`
+}
+
 // NewServe returns a new instance of the `Serve`
 func NewServe(service service.Servicer, notification service.Sender) *Serve {
 	return &Serve{
-		Service:      service,
-		Notification: notification,
+		Service:         service,
+		Notification:    notification,
+		BigIp:           noopBigIp{},
+		Config:          &EffectiveConfig{},
+		Pause:           &pauseSwitch{},
+		CacheClear:      &cacheClearSwitch{},
+		Ready:           newReadinessGate(),
+		Changes:         newChangeFeed(),
+		ShutdownTimeout: time.Second * time.Duration(getValue(DEFAULT_SHUTDOWN_TIMEOUT, "DF_SERVE_SHUTDOWN_TIMEOUT")),
 	}
 }
 
@@ -37,15 +88,59 @@ func NewServe(service service.Servicer, notification service.Sender) *Serve {
 func (m *Serve) Run() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/docker-flow-swarm-listener/notify-services", m.NotifyServices)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/notify-service/", m.NotifyService)
 	mux.HandleFunc("/v1/docker-flow-swarm-listener/get-services", m.GetServices)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/bigip/services", m.GetBigIpServices)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/bigip/remove-paths", m.RemovePaths)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/bigip/diff", m.GetBigIpDiff)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/recent-actions", m.GetRecentActions)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/config", m.GetConfig)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/cache/clear", m.ClearCache)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/pause", m.PauseHandler)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/resume", m.ResumeHandler)
 	mux.HandleFunc("/v1/docker-flow-swarm-listener/ping", m.PingHandler)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/ready", m.ReadyHandler)
+	mux.HandleFunc("/v1/docker-flow-swarm-listener/events", m.StreamChanges)
 	mux.Handle("/metrics", prometheus.Handler())
-	return httpListenAndServe(":8080", mux)
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	m.lock.Lock()
+	m.server = server
+	m.lock.Unlock()
+	if err := httpListenAndServe(server); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to complete.
+// Connections still open after `ShutdownTimeout` are closed.
+func (m *Serve) Shutdown() error {
+	m.lock.Lock()
+	server := m.server
+	m.lock.Unlock()
+	if server == nil {
+		return nil
+	}
+	//streams of changes never complete on their own
+	m.Changes.Close()
+	ctx, cancel := operationContext(m.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logPrintf("WARNING: In-flight requests did not complete within %s. Closing their connections", m.ShutdownTimeout)
+		server.Close()
+		return err
+	}
+	return nil
 }
 
-// NotifyServices notifies all configured endpoints of new, updated, or removed services
+// NotifyServices notifies all configured endpoints of new, updated, or removed services.
+// With `report=true`, it waits for the notifications and reports the outcome of each of them.
 func (m *Serve) NotifyServices(w http.ResponseWriter, req *http.Request) {
 	services, _ := m.Service.GetServices()
+	if req.URL.Query().Get("report") == "true" {
+		m.notifyServicesWithReport(w, services)
+		return
+	}
 	go m.Notification.ServicesCreate(services, 10, 5)
 	js, _ := json.Marshal(Response{Status: "OK"})
 	httpWriterSetContentType(w, "application/json")
@@ -53,6 +148,55 @@ func (m *Serve) NotifyServices(w http.ResponseWriter, req *http.Request) {
 	w.Write(js)
 }
 
+// NotifyService notifies all configured endpoints of the cached service named in the path and reports the outcome.
+// The status is 404 when no service of that name is cached.
+func (m *Serve) NotifyService(w http.ResponseWriter, req *http.Request) {
+	if !m.isAdminRequest(w, req) {
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/docker-flow-swarm-listener/notify-service/"), "/")
+	services := []service.SwarmService{}
+	for _, s := range service.GetCachedServices() {
+		if len(name) > 0 && s.Spec.Name == name {
+			services = append(services, s)
+			break
+		}
+	}
+	if len(services) == 0 {
+		js, _ := json.Marshal(Response{Status: "NotFound"})
+		httpWriterSetContentType(w, "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(js)
+		return
+	}
+	logPrintf("Service %s is notified again", name)
+	m.notifyServicesWithReport(w, &services)
+}
+
+// notifyServicesWithReport sends each notification once so that the caller decides what to retry.
+// The status is 200 when all notifications succeeded, 207 when some failed and 502 when all failed.
+func (m *Serve) notifyServicesWithReport(w http.ResponseWriter, services *[]service.SwarmService) {
+	report := NotifyReport{Status: "OK", Services: m.Notification.ServicesNotify(services, 1, 0)}
+	failed := 0
+	for _, r := range report.Services {
+		if !r.Success {
+			failed++
+		}
+	}
+	status := http.StatusOK
+	if failed > 0 && failed == len(report.Services) {
+		report.Status = "Failed"
+		status = http.StatusBadGateway
+	} else if failed > 0 {
+		report.Status = "PartiallyFailed"
+		status = http.StatusMultiStatus
+	}
+	js, _ := json.Marshal(report)
+	httpWriterSetContentType(w, "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
 // GetServices retrieves all services with the `com.df.notify` label set to `true`
 func (m *Serve) GetServices(w http.ResponseWriter, req *http.Request) {
 	services, _ := m.Service.GetServices()
@@ -70,10 +214,215 @@ func (m *Serve) GetServices(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// PingHandler is used for health checks
+// GetBigIpServices retrieves the BigIp routes cached per service, including when they were added
+func (m *Serve) GetBigIpServices(w http.ResponseWriter, req *http.Request) {
+	bytes, error := json.Marshal(m.BigIp.GetRoutes())
+	if error != nil {
+		logPrintf("ERROR: Unable to prepare response: %s", error)
+		metrics.RecordError("serveGetBigIpServices")
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		httpWriterSetContentType(w, "application/json")
+		w.Write(bytes)
+	}
+}
+
+// GetBigIpDiff reads the data groups from BigIp and returns the records that are not tracked by the listener
+// and the records of tracked services that are missing in BigIp
+func (m *Serve) GetBigIpDiff(w http.ResponseWriter, req *http.Request) {
+	drifts, err := m.BigIp.GetDrift()
+	if err != nil {
+		logPrintf("ERROR: Unable to compare BigIp data groups: %s", err.Error())
+		metrics.RecordError("serveGetBigIpDiff")
+		js, _ := json.Marshal(Response{Status: "Failed"})
+		httpWriterSetContentType(w, "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(js)
+		return
+	}
+	bytes, error := json.Marshal(drifts)
+	if error != nil {
+		logPrintf("ERROR: Unable to prepare response: %s", error)
+		metrics.RecordError("serveGetBigIpDiff")
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		httpWriterSetContentType(w, "application/json")
+		w.Write(bytes)
+	}
+}
+
+// RemovePaths removes the BigIp records of a JSON list of paths, whichever service routes them.
+// It lets operators pull a misbehaving path right away.
+func (m *Serve) RemovePaths(w http.ResponseWriter, req *http.Request) {
+	if !m.isAdminRequest(w, req) {
+		return
+	}
+	paths := []string{}
+	if err := json.NewDecoder(req.Body).Decode(&paths); err != nil || len(paths) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	response := Response{Status: "OK"}
+	if err := m.BigIp.RemovePathRecords(paths); err != nil {
+		metrics.RecordError("serveRemovePaths")
+		status = http.StatusInternalServerError
+		response.Status = "Failed"
+	} else {
+		logPrintf("Paths %v are removed from BigIp", paths)
+	}
+	js, _ := json.Marshal(response)
+	httpWriterSetContentType(w, "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// GetRecentActions retrieves the most recent failed notifications, including the consumer responses
+func (m *Serve) GetRecentActions(w http.ResponseWriter, req *http.Request) {
+	bytes, error := json.Marshal(RecentActions{
+		NotificationFailures: m.Notification.GetFailures(),
+		UnsyncedServices:     service.Unsynced.List(),
+	})
+	if error != nil {
+		logPrintf("ERROR: Unable to prepare response: %s", error)
+		metrics.RecordError("serveGetRecentActions")
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		httpWriterSetContentType(w, "application/json")
+		w.Write(bytes)
+	}
+}
+
+// StreamChanges streams the services created, updated or removed by the listener as server-sent events.
+// The stream ends when the client disconnects or the server shuts down.
+func (m *Serve) StreamChanges(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logPrintf("ERROR: Unable to stream changes. The response writer does not support flushing")
+		metrics.RecordError("serveStreamChanges")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	changes := m.Changes.Subscribe()
+	defer m.Changes.Unsubscribe(changes)
+	httpWriterSetContentType(w, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			js, _ := json.Marshal(change)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Action, js); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// GetConfig retrieves the effective configuration of the listener with secrets redacted
+func (m *Serve) GetConfig(w http.ResponseWriter, req *http.Request) {
+	bytes, error := json.Marshal(m.Config)
+	if error != nil {
+		logPrintf("ERROR: Unable to prepare response: %s", error)
+		metrics.RecordError("serveGetConfig")
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		httpWriterSetContentType(w, "application/json")
+		w.Write(bytes)
+	}
+}
+
+// ClearCache asks the main loop to empty the service cache, so that running services are notified again.
+// With `routes=true`, the BigIp route cache is emptied as well so that routes are added again.
+// The service cache is kept with `services=false`. The caches are cleared by the next cycle, so the status is 202.
+func (m *Serve) ClearCache(w http.ResponseWriter, req *http.Request) {
+	if !m.isAdminRequest(w, req) {
+		return
+	}
+	m.CacheClear.Request(req.URL.Query().Get("services") != "false", req.URL.Query().Get("routes") == "true")
+	logPrintf("Clearing the caches is requested")
+	js, _ := json.Marshal(Response{Status: "Accepted"})
+	httpWriterSetContentType(w, "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+// isAdminRequest accepts only POST requests that carry the auth token as a bearer token, if the token is set.
+// Otherwise it responds with an error status.
+func (m *Serve) isAdminRequest(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	if len(m.AuthToken) > 0 {
+		token := []byte("Bearer " + m.AuthToken)
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), token) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
+
+// PauseHandler stops BigIp updates and notifications until the listener is resumed.
+// Services are still polled so that the cache is accurate when the listener is resumed.
+func (m *Serve) PauseHandler(w http.ResponseWriter, req *http.Request) {
+	if !m.isAdminRequest(w, req) {
+		return
+	}
+	m.Pause.Pause()
+	logPrintf("The listener is paused")
+	js, _ := json.Marshal(Response{Status: "Paused"})
+	httpWriterSetContentType(w, "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// ResumeHandler resumes BigIp updates and notifications, processing the changes queued while paused
+func (m *Serve) ResumeHandler(w http.ResponseWriter, req *http.Request) {
+	if !m.isAdminRequest(w, req) {
+		return
+	}
+	m.Pause.Resume()
+	logPrintf("The listener is resumed")
+	js, _ := json.Marshal(Response{Status: "Resumed"})
+	httpWriterSetContentType(w, "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// PingHandler is used for health checks.
+// The status is `Degraded` while services are out of sync after their retries were exhausted.
 func (m *Serve) PingHandler(w http.ResponseWriter, req *http.Request) {
-	js, _ := json.Marshal(Response{Status: "OK"})
+	health := HealthStatus{Status: "OK", Unsynced: service.Unsynced.List()}
+	if len(health.Unsynced) > 0 {
+		health.Status = "Degraded"
+	}
+	js, _ := json.Marshal(health)
 	httpWriterSetContentType(w, "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(js)
 }
+
+// ReadyHandler is used for readiness probes.
+// It returns status 503 until the config API was read and services were listed from Docker.
+func (m *Serve) ReadyHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	readiness := ReadinessStatus{Status: "Ready", Pending: m.Ready.Pending()}
+	if len(readiness.Pending) > 0 {
+		status = http.StatusServiceUnavailable
+		readiness.Status = "NotReady"
+	}
+	js, _ := json.Marshal(readiness)
+	httpWriterSetContentType(w, "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DEFAULT_LOG_SUMMARY_INTERVAL is how often (in seconds) a repeated message is summarized when `DF_LOG_SUMMARY_INTERVAL` is not set
+const DEFAULT_LOG_SUMMARY_INTERVAL = 60
+
+// logDedupMaxMessages is the number of distinct messages tracked before all of them are summarized and forgotten
+const logDedupMaxMessages = 100
+
+// LogDeduper logs identical messages once and then only a periodic summary of how often they were repeated.
+// It keeps outages, during which the same error is logged every cycle, from flooding the log.
+// It is safe for concurrent use. A nil LogDeduper logs every message.
+type LogDeduper struct {
+	SummaryInterval time.Duration
+	messages        map[string]*repeatedMessage
+	lock            sync.Mutex
+}
+
+type repeatedMessage struct {
+	count    int
+	reported int
+	loggedAt time.Time
+}
+
+// NewLogDeduper returns a LogDeduper that summarizes repeated messages every `DF_LOG_SUMMARY_INTERVAL` seconds
+func NewLogDeduper() *LogDeduper {
+	interval := GetValueInRange(DEFAULT_LOG_SUMMARY_INTERVAL, 0, UNBOUNDED, "DF_LOG_SUMMARY_INTERVAL")
+	return &LogDeduper{SummaryInterval: time.Second * time.Duration(interval)}
+}
+
+// Printf logs the message unless it was already logged.
+// A repeated message is logged again with its count once the summary interval elapsed.
+func (d *LogDeduper) Printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if d == nil {
+		logPrintf("%s", msg)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.messages == nil {
+		d.messages = map[string]*repeatedMessage{}
+	}
+	m, ok := d.messages[msg]
+	if !ok {
+		if len(d.messages) >= logDedupMaxMessages {
+			d.flush()
+		}
+		d.messages[msg] = &repeatedMessage{count: 1, reported: 1, loggedAt: time.Now()}
+		logPrintf("%s", msg)
+		return
+	}
+	m.count++
+	if time.Since(m.loggedAt) >= d.SummaryInterval {
+		logPrintf("%s (still failing, %dx)", msg, m.count)
+		m.reported = m.count
+		m.loggedAt = time.Now()
+	}
+}
+
+// Reset logs how often messages were repeated since they were last logged and forgets them,
+// e.g. once the failing operation succeeded, so that the next failure is logged right away.
+func (d *LogDeduper) Reset() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.flush()
+}
+
+func (d *LogDeduper) flush() {
+	msgs := []string{}
+	for msg, m := range d.messages {
+		if m.count > m.reported {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		logPrintf("%s (repeated %dx)", msg, d.messages[msg].count)
+	}
+	d.messages = map[string]*repeatedMessage{}
+}
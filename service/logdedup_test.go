@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LogDeduperTestSuite struct {
+	suite.Suite
+	logged        []string
+	logPrintfOrig func(format string, v ...interface{})
+}
+
+func TestLogDeduperUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(LogDeduperTestSuite))
+}
+
+func (s *LogDeduperTestSuite) SetupTest() {
+	s.logged = []string{}
+	s.logPrintfOrig = logPrintf
+	logPrintf = func(format string, v ...interface{}) {
+		s.logged = append(s.logged, fmt.Sprintf(format, v...))
+	}
+}
+
+func (s *LogDeduperTestSuite) TearDownTest() {
+	logPrintf = s.logPrintfOrig
+}
+
+func (s *LogDeduperTestSuite) Test_Printf_CollapsesRepeatedMessages() {
+	d := &LogDeduper{SummaryInterval: time.Hour}
+
+	for i := 0; i < 5; i++ {
+		d.Printf("ERROR: %s", "BigIp is down")
+	}
+	d.Printf("ERROR: Docker is down")
+
+	s.Equal([]string{"ERROR: BigIp is down", "ERROR: Docker is down"}, s.logged)
+}
+
+func (s *LogDeduperTestSuite) Test_Printf_SummarizesRepeatedMessages_WhenSummaryIntervalElapsed() {
+	d := &LogDeduper{SummaryInterval: 0}
+
+	d.Printf("ERROR: BigIp is down")
+	d.Printf("ERROR: BigIp is down")
+	d.Printf("ERROR: BigIp is down")
+
+	s.Equal([]string{
+		"ERROR: BigIp is down",
+		"ERROR: BigIp is down (still failing, 2x)",
+		"ERROR: BigIp is down (still failing, 3x)",
+	}, s.logged)
+}
+
+func (s *LogDeduperTestSuite) Test_Reset_LogsRepeatCountAndForgetsMessages() {
+	d := &LogDeduper{SummaryInterval: time.Hour}
+	d.Printf("ERROR: BigIp is down")
+	d.Printf("ERROR: BigIp is down")
+	d.Printf("ERROR: Docker is down")
+
+	d.Reset()
+	d.Printf("ERROR: BigIp is down")
+
+	s.Equal([]string{
+		"ERROR: BigIp is down",
+		"ERROR: Docker is down",
+		"ERROR: BigIp is down (repeated 2x)",
+		"ERROR: BigIp is down",
+	}, s.logged)
+}
+
+func (s *LogDeduperTestSuite) Test_Printf_LogsEveryMessage_WhenLogDeduperIsNil() {
+	var d *LogDeduper
+
+	d.Printf("ERROR: BigIp is down")
+	d.Printf("ERROR: BigIp is down")
+
+	s.Equal([]string{"ERROR: BigIp is down", "ERROR: BigIp is down"}, s.logged)
+}
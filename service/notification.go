@@ -1,53 +1,338 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"../metrics"
 )
 
-// Notification defines the structure with exported functions
+// NOTIFY_RETRY_LABEL is the service label that overrides the number of create notification retries
+const NOTIFY_RETRY_LABEL = "com.df.notifyRetry"
+
+// NOTIFY_PATH_LABEL is the service label with the template of the path of create notifications
+const NOTIFY_PATH_LABEL = "com.df.notifyPath"
+
+// DEFAULT_READY_TIMEOUT is how long (in seconds) a new service can take to become ready when `DF_NOTIFY_READY_TIMEOUT` is not set
+const DEFAULT_READY_TIMEOUT = 60
+
+// DEFAULT_NOTIFY_TIMEOUT is how long (in seconds) a notification request can take when `DF_NOTIFY_TIMEOUT` is not set
+const DEFAULT_NOTIFY_TIMEOUT = 30
+
+// readyCheckInterval is the time between readiness checks of a new service
+const readyCheckInterval = time.Second
+
+// maxNotificationFailures is the number of the most recent failed notifications that are kept
+const maxNotificationFailures = 20
+
+// NotificationFailure describes a notification that was not accepted after all retries
+type NotificationFailure struct {
+	URL        string    `json:"url"`
+	RequestID  string    `json:"requestId"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+// NotificationResult is the outcome of the create notification of a service to an address
+type NotificationResult struct {
+	ServiceID   string `json:"serviceId"`
+	ServiceName string `json:"serviceName"`
+	URL         string `json:"url"`
+	Success     bool   `json:"success"`
+	Error       string `json:"error,omitempty"`
+}
+
+// notifyPathData is the service metadata the `com.df.notifyPath` template is rendered against
+type notifyPathData struct {
+	ServiceID   string
+	ServiceName string
+	Params      map[string]string
+}
+
+// ScaleChange describes a change of the number of replicas of a service
+type ScaleChange struct {
+	ServiceID        string
+	ServiceName      string
+	Replicas         uint64
+	PreviousReplicas uint64
+}
+
+// ReadinessChecker tells whether a service has a running task
+type ReadinessChecker interface {
+	IsReady(s SwarmService) (bool, error)
+}
+
+// Notification defines the structure with exported functions.
+// Timeout bounds each notification request. Canceling Context, e.g. on shutdown, abandons in-flight notifications and their retries.
+// RetrySpread staggers the first notifications of services created together.
 type Notification struct {
 	CreateServiceAddr []string
 	RemoveServiceAddr []string
+	ScaleServiceAddr  []string
+	Notifier          Notifier
+	WhenReady         bool
+	ReadyTimeout      time.Duration
+	Readiness         ReadinessChecker
+	ParamMap          map[string]string
+	Timeout           time.Duration
+	Context           context.Context
+	RetrySpread       time.Duration
+	failures          []NotificationFailure
+	lock              sync.Mutex
 }
 
 func newNotification(createServiceAddr, removeServiceAddr []string) *Notification {
 	return &Notification{
 		CreateServiceAddr: createServiceAddr,
 		RemoveServiceAddr: removeServiceAddr,
+		Notifier:          NewHTTPNotifier(),
 	}
 }
 
 // NewNotificationFromEnv returns `notification` instance
 func NewNotificationFromEnv() *Notification {
+	return NewNotificationFromConfig("", "")
+}
+
+// NewNotificationFromConfig returns `notification` instance with the comma-separated addresses of a central config.
+// Addresses the config does not set are read from environment variables.
+func NewNotificationFromConfig(createServiceUrl, removeServiceUrl string) *Notification {
 	createServiceAddr, removeServiceAddr := getSenderAddressesFromEnvVars("notification", "notify", "notif")
-	return newNotification(createServiceAddr, removeServiceAddr)
+	if len(createServiceUrl) > 0 {
+		createServiceAddr = strings.Split(createServiceUrl, ",")
+	}
+	if len(removeServiceUrl) > 0 {
+		removeServiceAddr = strings.Split(removeServiceUrl, ",")
+	}
+	n := newNotification(checkUnixAddrs(createServiceAddr), checkUnixAddrs(removeServiceAddr))
+	n.Notifier = NotifierFromEnv()
+	n.WhenReady = strings.EqualFold(os.Getenv("DF_NOTIFY_WHEN_READY"), "true")
+	n.ReadyTimeout = time.Second * time.Duration(GetValueInRange(DEFAULT_READY_TIMEOUT, 1, UNBOUNDED, "DF_NOTIFY_READY_TIMEOUT"))
+	n.Timeout = time.Second * time.Duration(GetValueInRange(DEFAULT_NOTIFY_TIMEOUT, 1, UNBOUNDED, "DF_NOTIFY_TIMEOUT"))
+	n.RetrySpread = time.Second * time.Duration(GetValueInRange(0, 0, UNBOUNDED, "DF_RETRY_SPREAD"))
+	if httpNotifier, ok := n.Notifier.(*HTTPNotifier); ok {
+		httpNotifier.Client.Timeout = n.Timeout
+	}
+	if len(os.Getenv("DF_NOTIFY_SCALE_SERVICE_URL")) > 0 {
+		n.ScaleServiceAddr = checkUnixAddrs(strings.Split(os.Getenv("DF_NOTIFY_SCALE_SERVICE_URL"), ","))
+	}
+	n.ParamMap = parseKeyValuePairs(os.Getenv("DF_NOTIFY_PARAM_MAP"), "notification parameter mapping")
+	return n
+}
+
+// renameParams returns the notification parameters renamed with `DF_NOTIFY_PARAM_MAP`.
+// Parameters without a mapping keep their names.
+func (m *Notification) renameParams(params url.Values) url.Values {
+	if len(m.ParamMap) == 0 {
+		return params
+	}
+	renamed := url.Values{}
+	for k, values := range params {
+		if to, ok := m.ParamMap[k]; ok {
+			k = to
+		}
+		for _, v := range values {
+			renamed.Add(k, v)
+		}
+	}
+	return renamed
 }
 
-// ServicesCreate sends create service notifications
+// ServicesCreate sends create service notifications.
+// Parameters are renamed with `DF_NOTIFY_PARAM_MAP` after the addresses are selected.
+// With `DF_NOTIFY_WHEN_READY`, notifications are deferred until the service has a running task.
 func (m *Notification) ServicesCreate(services *[]SwarmService, retries, interval int) error {
 	for _, s := range *services {
-		if _, ok := s.Spec.Labels[os.Getenv("DF_NOTIFY_LABEL")]; ok {
-			params := getServiceParams(&s)
-			urlValues := url.Values{}
-			for k, v := range params {
-				urlValues.Add(k, v)
-			}
-			for _, addr := range m.GetCreateServiceAddr(urlValues) {
-				go m.sendCreateServiceRequest(s.ID, addr, urlValues, retries, interval)
-			}
+		if ok, reason := ShouldRoute(s, nil); !ok {
+			logPrintf("Service %s is not notified because %s", s.Spec.Name, reason)
+			continue
+		}
+		params := getServiceParams(&s)
+		urlValues := url.Values{}
+		for k, v := range params {
+			urlValues.Add(k, v)
+		}
+		serviceRetries := getNotifyRetry(&s, retries)
+		addrs := getNotifyPathAddr(&s, params, m.GetCreateServiceAddr(urlValues))
+		urlValues = m.renameParams(urlValues)
+		if m.WhenReady && m.Readiness != nil {
+			go m.sendWhenReady(s, addrs, urlValues, serviceRetries, interval)
+			continue
+		}
+		delay := m.spreadDelay()
+		for _, addr := range addrs {
+			go func(serviceID, addr string, params url.Values) {
+				if delay > 0 {
+					sleep(delay)
+				}
+				m.sendCreateServiceRequest(serviceID, addr, params, serviceRetries, interval)
+			}(s.ID, addr, urlValues)
 		}
 	}
 	return nil
 }
 
+// sendWhenReady sends create service notifications once the service is ready.
+// Nothing is sent when the service does not become ready within `ReadyTimeout`.
+func (m *Notification) sendWhenReady(s SwarmService, addrs []string, params url.Values, retries, interval int) {
+	if !m.waitUntilReady(s) {
+		logPrintf("ERROR: Service %s did not become ready within %s. Service created notifications are not sent.", s.Spec.Name, m.ReadyTimeout)
+		metrics.RecordError("notificationServiceNotReady")
+		return
+	}
+	for _, addr := range addrs {
+		go m.sendCreateServiceRequest(s.ID, addr, params, retries, interval)
+	}
+}
+
+// waitUntilReady checks the readiness of the service until it is ready or `ReadyTimeout` elapsed
+func (m *Notification) waitUntilReady(s SwarmService) bool {
+	deadline := time.Now().Add(m.ReadyTimeout)
+	for {
+		ready, err := m.Readiness.IsReady(s)
+		if err != nil {
+			logPrintf("WARNING: Unable to check the readiness of the service %s: %s", s.Spec.Name, err.Error())
+		} else if ready {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		logPrintf("Service %s is not ready. Service created notifications are deferred.", s.Spec.Name)
+		sleep(readyCheckInterval)
+	}
+}
+
+// ServicesNotify sends create service notifications and waits for them to complete.
+// It returns the outcome of the notification of each service to each address.
+func (m *Notification) ServicesNotify(services *[]SwarmService, retries, interval int) []NotificationResult {
+	results := []NotificationResult{}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, s := range *services {
+		if ok, reason := ShouldRoute(s, nil); !ok {
+			logPrintf("Service %s is not notified because %s", s.Spec.Name, reason)
+			continue
+		}
+		params := getServiceParams(&s)
+		urlValues := url.Values{}
+		for k, v := range params {
+			urlValues.Add(k, v)
+		}
+		serviceRetries := getNotifyRetry(&s, retries)
+		addrs := getNotifyPathAddr(&s, params, m.GetCreateServiceAddr(urlValues))
+		urlValues = m.renameParams(urlValues)
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(serviceID, serviceName, addr string) {
+				defer wg.Done()
+				result := NotificationResult{ServiceID: serviceID, ServiceName: serviceName, URL: addr, Success: true}
+				if err := m.sendCreateServiceRequest(serviceID, addr, urlValues, serviceRetries, interval); err != nil {
+					result.Success = false
+					result.Error = err.Error()
+				}
+				lock.Lock()
+				results = append(results, result)
+				lock.Unlock()
+			}(s.ID, s.Spec.Name, addr)
+		}
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].ServiceName != results[j].ServiceName {
+			return results[i].ServiceName < results[j].ServiceName
+		}
+		return results[i].URL < results[j].URL
+	})
+	return results
+}
+
+// ServicesScale sends scale notifications with the current and previous number of replicas.
+// Nothing is sent unless `DF_NOTIFY_SCALE_SERVICE_URL` is set.
+func (m *Notification) ServicesScale(changes []ScaleChange, retries, interval int) error {
+	for _, c := range changes {
+		params := url.Values{}
+		params.Add("serviceName", c.ServiceName)
+		params.Add("replicas", fmt.Sprintf("%d", c.Replicas))
+		params.Add("previousReplicas", fmt.Sprintf("%d", c.PreviousReplicas))
+		for _, addr := range m.ScaleServiceAddr {
+			go m.sendCreateServiceRequest(c.ServiceID, addr, params, retries, interval)
+		}
+	}
+	return nil
+}
+
+// getNotifyRetry returns the number of retries set with the `com.df.notifyRetry` label of the service.
+// It falls back to retries when the label is absent or invalid.
+func getNotifyRetry(s *SwarmService, retries int) int {
+	if value, ok := s.Spec.Labels[Label(NOTIFY_RETRY_LABEL)]; ok {
+		if serviceRetries, err := strconv.Atoi(value); err == nil && serviceRetries > 0 {
+			return serviceRetries
+		}
+		logPrintf("WARNING: Invalid %s label value %s of the service %s", Label(NOTIFY_RETRY_LABEL), value, s.Spec.Name)
+	}
+	return retries
+}
+
+// getNotifyPathAddr returns the addresses with their path replaced by the `com.df.notifyPath` template of the service.
+// The addresses are returned unchanged when the service has no template or it cannot be rendered.
+func getNotifyPathAddr(s *SwarmService, params map[string]string, addrs []string) []string {
+	tmpl, ok := s.Spec.Labels[Label(NOTIFY_PATH_LABEL)]
+	if !ok {
+		return addrs
+	}
+	path, err := renderNotifyPath(tmpl, notifyPathData{ServiceID: s.ID, ServiceName: params["serviceName"], Params: params})
+	if err != nil {
+		logPrintf("ERROR: Unable to render the %s label of the service %s: %s", Label(NOTIFY_PATH_LABEL), s.Spec.Name, err.Error())
+		metrics.RecordError("notificationRenderNotifyPath")
+		return addrs
+	}
+	pathAddrs := []string{}
+	for _, addr := range addrs {
+		urlObj, err := url.Parse(addr)
+		if err != nil {
+			pathAddrs = append(pathAddrs, addr)
+			continue
+		}
+		if urlObj.Scheme == UNIX_SCHEME {
+			socket, _ := splitUnixPath(urlObj.Path)
+			urlObj.Path = socket + ":" + path
+		} else {
+			urlObj.Path = path
+		}
+		pathAddrs = append(pathAddrs, urlObj.String())
+	}
+	return pathAddrs
+}
+
+// renderNotifyPath renders the notification path template. Missing fields and parameters are errors.
+func renderNotifyPath(tmpl string, data notifyPathData) (string, error) {
+	t, err := template.New("notifyPath").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 // GetCreateServiceAddr returns create service addresses
 func (m *Notification) GetCreateServiceAddr(urlValues map[string][]string) []string {
 	if val, ok := urlValues["notifyService"]; ok {
@@ -70,11 +355,13 @@ func (m *Notification) GetCreateServiceAddr(urlValues map[string][]string) []str
 func (m *Notification) ServicesRemove(remove *[]string, retries, interval int) error {
 	errs := []error{}
 	for _, v := range *remove {
-		serviceName, ok := CachedServices[v]
+		serviceName, ok := GetCachedService(v)
 		if !ok {
 			return fmt.Errorf("ID %s is not CachedServices", v)
 		}
 
+		//Failed create notifications no longer matter once the service is removed. Failed removals are added again.
+		Unsynced.RemoveService(v)
 		parameters := url.Values{}
 		parameters.Add("serviceName", serviceName.Spec.Name)
 		parameters.Add("distribute", "true")
@@ -87,27 +374,33 @@ func (m *Notification) ServicesRemove(remove *[]string, retries, interval int) e
 			}
 			urlObj.RawQuery = parameters.Encode()
 			fullURL := urlObj.String()
-			logPrintf("Sending service removed notification to %s", fullURL)
+			requestID := NewRequestID()
+			logPrintf("Sending service removed notification to %s with request ID %s", fullURL, requestID)
 			for i := 1; i <= retries; i++ {
-				resp, err := http.Get(fullURL)
+				if err := m.canceled(fullURL, requestID); err != nil {
+					errs = append(errs, err)
+					break
+				}
+				resp, err := m.get(fullURL, requestID)
 				if err == nil && resp.StatusCode == http.StatusOK {
-					delete(CachedServices, v)
+					uncacheService(v)
+					Unsynced.Remove(v, addr)
 					break
 				} else if i < retries {
-					if interval > 0 {
-						t := time.NewTicker(time.Second * time.Duration(interval))
-						<-t.C
-					}
+					waitBeforeRetry(resp, interval)
 				} else {
+					m.recordFailure(fullURL, requestID, resp, err)
 					if err != nil {
-						logPrintf("ERROR: %s", err.Error())
+						logPrintf("ERROR: Request ID %s: %s", requestID, err.Error())
 						metrics.RecordError("notificationServicesRemove")
 						errs = append(errs, err)
+						Unsynced.Add(v, addr, err.Error())
 					} else if resp.StatusCode != http.StatusOK {
-						msg := fmt.Errorf("Request %s returned status code %d", fullURL, resp.StatusCode)
+						msg := fmt.Errorf("Request %s with request ID %s returned status code %d", fullURL, requestID, resp.StatusCode)
 						logPrintf("ERROR: %s", msg)
 						metrics.RecordError("notificationServicesRemove")
 						errs = append(errs, msg)
+						Unsynced.Add(v, addr, msg.Error())
 					}
 				}
 				if resp != nil && resp.Body != nil {
@@ -122,47 +415,123 @@ func (m *Notification) ServicesRemove(remove *[]string, retries, interval int) e
 	return nil
 }
 
+// GetFailures returns the most recent failed notifications, oldest first
+func (m *Notification) GetFailures() []NotificationFailure {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	failures := make([]NotificationFailure, len(m.failures))
+	copy(failures, m.failures)
+	return failures
+}
+
+// recordFailure logs and stores the reason a notification failed.
+// Only the beginning of the response body is kept, up to `DF_ERROR_BODY_LIMIT` bytes.
+func (m *Notification) recordFailure(fullURL, requestID string, resp *http.Response, err error) NotificationFailure {
+	failure := NotificationFailure{URL: fullURL, RequestID: requestID, FailedAt: time.Now()}
+	if err != nil {
+		failure.Error = err.Error()
+		logPrintf("WARNING: Notification %s to %s failed: %s", requestID, fullURL, failure.Error)
+	} else {
+		limit := ErrorBodyLimit()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+		failure.StatusCode = resp.StatusCode
+		if len(body) > limit {
+			failure.Body = string(body[:limit])
+		} else {
+			failure.Body = string(body)
+		}
+		logPrintf("WARNING: Notification %s to %s was rejected with status code %d: %s", requestID, fullURL, failure.StatusCode, TruncateBody(body))
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failures = append(m.failures, failure)
+	if len(m.failures) > maxNotificationFailures {
+		m.failures = m.failures[len(m.failures)-maxNotificationFailures:]
+	}
+	return failure
+}
+
+// spreadDelay returns a random part of `RetrySpread`, by which the notifications of a service are delayed,
+// so that services notified together do not hit a recovering consumer at once and neither do their retries
+func (m *Notification) spreadDelay() time.Duration {
+	if m.RetrySpread <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(m.RetrySpread)))
+}
+
+// get sends a notification request through the transport of the notification
+func (m *Notification) get(fullURL, requestID string) (*http.Response, error) {
+	return m.Notifier.Send(m.context(), fullURL, requestID)
+}
+
+func (m *Notification) context() context.Context {
+	if m.Context == nil {
+		return context.Background()
+	}
+	return m.Context
+}
+
+// canceled returns the error of the context once notifications are canceled
+func (m *Notification) canceled(fullURL, requestID string) error {
+	err := m.context().Err()
+	if err != nil {
+		logPrintf("Notification %s to %s is canceled", requestID, fullURL)
+	}
+	return err
+}
+
 // GetRemoveServiceAddr returns remove service addresses
 func (m *Notification) GetRemoveServiceAddr(urlValues map[string][]string) []string {
 	return m.RemoveServiceAddr
 }
 
-func (m *Notification) sendCreateServiceRequest(serviceID, addr string, params url.Values, retries, interval int) {
+// sendCreateServiceRequest sends a create service notification and returns why it failed after all retries, if it did
+func (m *Notification) sendCreateServiceRequest(serviceID, addr string, params url.Values, retries, interval int) error {
 	urlObj, err := url.Parse(addr)
 	if err != nil {
 		logPrintf("ERROR: %s", err.Error())
 		metrics.RecordError("notificationSendCreateServiceRequest")
-		return
+		return err
 	}
 	urlObj.RawQuery = params.Encode()
 	fullURL := urlObj.String()
-	logPrintf("Sending service created notification to %s", fullURL)
+	requestID := NewRequestID()
+	logPrintf("Sending service created notification to %s with request ID %s", fullURL, requestID)
+	var result error
 	for i := 1; i <= retries; i++ {
-		if s, ok := CachedServices[serviceID]; !ok {
-			logPrintf("Service %s was removed. Service created notifications are stopped.", s.Spec.Name)
+		if _, ok := GetCachedService(serviceID); !ok {
+			logPrintf("Service %s was removed. Service created notifications are stopped.", serviceID)
+			Unsynced.Remove(serviceID, addr)
+			return fmt.Errorf("Service %s was removed", serviceID)
+		}
+		if err := m.canceled(fullURL, requestID); err != nil {
+			result = err
 			break
 		}
-		resp, err := http.Get(fullURL)
+		resp, err := m.get(fullURL, requestID)
 		if err == nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict) {
+			resp.Body.Close()
+			result = nil
 			break
 		} else if i < retries {
 			logPrintf("Retrying service created notification to %s", fullURL)
-			if interval > 0 {
-				t := time.NewTicker(time.Second * time.Duration(interval))
-				<-t.C
-			}
+			waitBeforeRetry(resp, interval)
 		} else {
 			if err != nil {
-				logPrintf("ERROR: %s", err.Error())
+				m.recordFailure(fullURL, requestID, nil, err)
+				logPrintf("ERROR: Request ID %s: %s", requestID, err.Error())
 				metrics.RecordError("notificationSendCreateServiceRequest")
+				result = err
 			} else if resp.StatusCode == http.StatusConflict {
 				body, _ := ioutil.ReadAll(resp.Body)
-				logPrintf(fmt.Sprintf("Request %s returned status code %d\n%s", fullURL, resp.StatusCode, string(body[:])))
+				result = fmt.Errorf("Request %s with request ID %s returned status code %d\n%s", fullURL, requestID, resp.StatusCode, TruncateBody(body))
+				logPrintf(result.Error())
 				metrics.RecordError("notificationSendCreateServiceRequest")
 			} else if resp.StatusCode != http.StatusOK {
-				body, _ := ioutil.ReadAll(resp.Body)
-				msg := fmt.Errorf("Request %s returned status code %d\n%s", fullURL, resp.StatusCode, string(body[:]))
-				logPrintf("ERROR: %s", msg.Error())
+				failure := m.recordFailure(fullURL, requestID, resp, nil)
+				result = fmt.Errorf("Request %s with request ID %s returned status code %d\n%s", fullURL, requestID, resp.StatusCode, failure.Body)
+				logPrintf("ERROR: %s", result.Error())
 				metrics.RecordError("notificationSendCreateServiceRequest")
 			}
 		}
@@ -170,4 +539,10 @@ func (m *Notification) sendCreateServiceRequest(serviceID, addr string, params u
 			resp.Body.Close()
 		}
 	}
+	if result != nil {
+		Unsynced.Add(serviceID, addr, result.Error())
+	} else {
+		Unsynced.Remove(serviceID, addr)
+	}
+	return result
 }
@@ -1,13 +1,18 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -91,6 +96,38 @@ func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SetsNotifyRemoveUrlF
 	}
 }
 
+// NewNotificationFromConfig
+
+func (s *NotificationTestSuite) Test_NewNotificationFromConfig_PrefersAddressesOfConfig() {
+	defer os.Setenv("DF_NOTIFY_CREATE_SERVICE_URL", os.Getenv("DF_NOTIFY_CREATE_SERVICE_URL"))
+	defer os.Setenv("DF_NOTIFY_REMOVE_SERVICE_URL", os.Getenv("DF_NOTIFY_REMOVE_SERVICE_URL"))
+	os.Setenv("DF_NOTIFY_CREATE_SERVICE_URL", "http://env.invalid/create")
+	os.Setenv("DF_NOTIFY_REMOVE_SERVICE_URL", "http://env.invalid/remove")
+
+	n := NewNotificationFromConfig("http://config.invalid/create,http://config.invalid/create2", "")
+
+	s.Equal([]string{"http://config.invalid/create", "http://config.invalid/create2"}, n.CreateServiceAddr)
+	s.Equal([]string{"http://env.invalid/remove"}, n.RemoveServiceAddr)
+}
+
+func (s *NotificationTestSuite) Test_NewNotification_RoutesThroughProxy() {
+	actualHost := ""
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualHost = r.URL.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxySrv.Close()
+	os.Setenv("DF_HTTP_PROXY", proxySrv.URL)
+	defer os.Unsetenv("DF_HTTP_PROXY")
+	ss := (*s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil))[0]
+
+	n := newNotification([]string{}, []string{"http://consumer.invalid/remove"})
+	err := n.ServicesRemove(&[]string{ss.ID}, 1, 0)
+
+	s.NoError(err)
+	s.Equal("consumer.invalid", actualHost)
+}
+
 // GetCreateServiceAddr
 
 func (s *NotificationTestSuite) Test_GetCreateServiceAddr_ReturnsCreateServiceAddr() {
@@ -477,6 +514,48 @@ func (s *NotificationTestSuite) Test_ServicesCreate_RetriesRequests() {
 	s.NoError(err)
 }
 
+func (s *NotificationTestSuite) Test_ServicesCreate_UsesNotifyRetryLabel() {
+	var lock sync.Mutex
+	attempts := 0
+	labels := make(map[string]string)
+	labels["com.df.notify"] = "true"
+	labels["com.df.notifyRetry"] = "3"
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer httpSrv.Close()
+
+	n := newNotification([]string{httpSrv.URL}, []string{})
+	n.ServicesCreate(s.getSwarmServices(labels, nil), 1, 0)
+
+	for i := 0; i < 100 && len(n.GetFailures()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	s.Equal(3, attempts)
+}
+
+func (s *NotificationTestSuite) Test_GetNotifyRetry_FallsBackToRetries() {
+	tests := []struct {
+		labels   map[string]string
+		expected int
+	}{
+		{map[string]string{}, 5},
+		{map[string]string{"com.df.notifyRetry": "10"}, 10},
+		{map[string]string{"com.df.notifyRetry": "many"}, 5},
+		{map[string]string{"com.df.notifyRetry": "0"}, 5},
+	}
+	for _, t := range tests {
+		services := s.getSwarmServices(t.labels, nil)
+
+		s.Equal(t.expected, getNotifyRetry(&(*services)[0], 5))
+	}
+}
+
 func (s *NotificationTestSuite) Test_ServicesCreate_StopsSendingNotifications_WhenServiceIsRemoved() {
 	attempt := 0
 	labels := make(map[string]string)
@@ -496,6 +575,407 @@ func (s *NotificationTestSuite) Test_ServicesCreate_StopsSendingNotifications_Wh
 	s.Equal(1, attempt)
 }
 
+func (s *NotificationTestSuite) Test_ServicesCreate_SendsRequests_WhenServiceBecomesReady() {
+	sleepOrig := sleep
+	defer func() { sleep = sleepOrig }()
+	sleep = func(d time.Duration) {}
+	queries := make(chan string, 1)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+	}))
+	defer httpSrv.Close()
+	readiness := &readinessMock{readyAfter: 2}
+	n := newNotification([]string{httpSrv.URL}, []string{})
+	n.WhenReady = true
+	n.ReadyTimeout = time.Minute
+	n.Readiness = readiness
+
+	n.ServicesCreate(s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil), 1, 0)
+
+	select {
+	case query := <-queries:
+		s.Equal("distribute=true&replicas=1&serviceName=my-service", query)
+	case <-time.After(time.Second):
+		s.Fail("create notification was not sent")
+	}
+	s.Equal(2, readiness.getChecks())
+}
+
+func (s *NotificationTestSuite) Test_ServicesCreate_DoesNotSendRequests_WhenServiceIsNotReadyWithinTimeout() {
+	sent := make(chan bool, 1)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- true
+	}))
+	defer httpSrv.Close()
+	readiness := &readinessMock{readyAfter: 100}
+	n := newNotification([]string{httpSrv.URL}, []string{})
+	n.WhenReady = true
+	n.Readiness = readiness
+
+	n.ServicesCreate(s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil), 1, 0)
+
+	select {
+	case <-sent:
+		s.Fail("create notification was sent before the service was ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Equal(1, readiness.getChecks())
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SetsWhenReady() {
+	os.Setenv("DF_NOTIFY_WHEN_READY", "true")
+	os.Setenv("DF_NOTIFY_READY_TIMEOUT", "30")
+	defer func() {
+		os.Unsetenv("DF_NOTIFY_WHEN_READY")
+		os.Unsetenv("DF_NOTIFY_READY_TIMEOUT")
+	}()
+
+	n := NewNotificationFromEnv()
+
+	s.True(n.WhenReady)
+	s.Equal(30*time.Second, n.ReadyTimeout)
+}
+
+func (s *NotificationTestSuite) Test_ServicesCreate_SendsRequestsToNotifyPath() {
+	paths := make(chan string, 1)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer httpSrv.Close()
+	labels := map[string]string{"com.df.notify": "true", "com.df.notifyPath": "/register/{{.ServiceName}}"}
+	n := newNotification([]string{httpSrv.URL + "/v1/docker-flow-proxy/reconfigure"}, []string{})
+
+	n.ServicesCreate(s.getSwarmServices(labels, nil), 1, 0)
+
+	select {
+	case path := <-paths:
+		s.Equal("/register/my-service", path)
+	case <-time.After(time.Second):
+		s.Fail("create notification was not sent")
+	}
+}
+
+func (s *NotificationTestSuite) Test_ServicesCreate_RenamesParamsWithParamMap() {
+	queries := make(chan url.Values, 1)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+	}))
+	defer httpSrv.Close()
+	labels := map[string]string{"com.df.notify": "true", "com.df.servicePath": "/demo", "com.df.port": "8080"}
+	n := newNotification([]string{httpSrv.URL + "/v1/docker-flow-proxy/reconfigure"}, []string{})
+	n.ParamMap = map[string]string{"servicePath": "path", "port": "targetPort"}
+
+	n.ServicesCreate(s.getSwarmServices(labels, nil), 1, 0)
+
+	select {
+	case query := <-queries:
+		s.Equal("/demo", query.Get("path"))
+		s.Equal("8080", query.Get("targetPort"))
+		s.Equal("my-service", query.Get("serviceName"))
+		s.Empty(query.Get("servicePath"))
+		s.Empty(query.Get("port"))
+	case <-time.After(time.Second):
+		s.Fail("create notification was not sent")
+	}
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SetsParamMap() {
+	os.Setenv("DF_NOTIFY_PARAM_MAP", "servicePath=path, port=targetPort,invalid")
+	defer os.Unsetenv("DF_NOTIFY_PARAM_MAP")
+
+	n := NewNotificationFromEnv()
+
+	s.Equal(map[string]string{"servicePath": "path", "port": "targetPort"}, n.ParamMap)
+}
+
+func (s *NotificationTestSuite) Test_RenderNotifyPath_RendersServiceMetadata() {
+	data := notifyPathData{ServiceID: "my-service-id", ServiceName: "my-service", Params: map[string]string{"port": "8080"}}
+
+	path, err := renderNotifyPath("/register/{{.ServiceName}}", data)
+	s.NoError(err)
+	s.Equal("/register/my-service", path)
+
+	path, err = renderNotifyPath("/services/{{.ServiceID}}/ports/{{.Params.port}}", data)
+	s.NoError(err)
+	s.Equal("/services/my-service-id/ports/8080", path)
+}
+
+func (s *NotificationTestSuite) Test_RenderNotifyPath_ReturnsError_WhenFieldIsMissing() {
+	data := notifyPathData{ServiceName: "my-service", Params: map[string]string{}}
+
+	_, err := renderNotifyPath("/register/{{.Stack}}", data)
+	s.Error(err)
+
+	_, err = renderNotifyPath("/register/{{.Params.port}}", data)
+	s.Error(err)
+}
+
+func (s *NotificationTestSuite) Test_GetNotifyPathAddr_FallsBackToAddresses_WhenTemplateFails() {
+	addrs := []string{"http://proxy/v1/docker-flow-proxy/reconfigure"}
+	labels := map[string]string{"com.df.notify": "true", "com.df.notifyPath": "/register/{{.Params.port}}"}
+	ss := (*s.getSwarmServices(labels, nil))[0]
+
+	actual := getNotifyPathAddr(&ss, getServiceParams(&ss), addrs)
+
+	s.Equal(addrs, actual)
+}
+
+func (s *NotificationTestSuite) Test_ServicesNotify_TracksServicesOutOfSync() {
+	unsyncedOrig := Unsynced
+	defer func() { Unsynced = unsyncedOrig }()
+	Unsynced = NewUnsyncedServices()
+	status := http.StatusInternalServerError
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer httpSrv.Close()
+	n := newNotification([]string{httpSrv.URL}, []string{})
+	services := s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil)
+
+	n.ServicesNotify(services, 1, 0)
+
+	unsynced := Unsynced.List()
+	s.Require().Len(unsynced, 1)
+	s.Equal("my-service-id", unsynced[0].ServiceID)
+	s.Equal(httpSrv.URL, unsynced[0].Target)
+
+	status = http.StatusOK
+	n.ServicesNotify(services, 1, 0)
+
+	s.Empty(Unsynced.List())
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_ForgetsFailedCreate_WhenServiceIsRemoved() {
+	unsyncedOrig := Unsynced
+	defer func() { Unsynced = unsyncedOrig }()
+	Unsynced = NewUnsyncedServices()
+	createSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer createSrv.Close()
+	removeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer removeSrv.Close()
+	n := newNotification([]string{createSrv.URL}, []string{removeSrv.URL})
+	services := s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil)
+	n.ServicesNotify(services, 1, 0)
+	s.Require().Len(Unsynced.List(), 1)
+
+	err := n.ServicesRemove(&[]string{(*services)[0].ID}, 1, 0)
+
+	s.NoError(err)
+	s.Empty(Unsynced.List())
+}
+
+// ServicesScale
+
+func (s *NotificationTestSuite) Test_ServicesScale_SendsReplicas() {
+	CachedServices = map[string]SwarmService{"my-service-id": {}}
+	queries := make(chan string, 1)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+	}))
+	defer httpSrv.Close()
+	n := newNotification([]string{}, []string{})
+	n.ScaleServiceAddr = []string{httpSrv.URL}
+
+	n.ServicesScale([]ScaleChange{{ServiceID: "my-service-id", ServiceName: "my-service", Replicas: 3, PreviousReplicas: 1}}, 1, 0)
+
+	select {
+	case query := <-queries:
+		s.Equal("previousReplicas=1&replicas=3&serviceName=my-service", query)
+	case <-time.After(time.Second):
+		s.Fail("scale notification was not sent")
+	}
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SetsScaleUrl() {
+	os.Setenv("DF_NOTIFY_SCALE_SERVICE_URL", "http://consumer/scale")
+	defer os.Unsetenv("DF_NOTIFY_SCALE_SERVICE_URL")
+
+	n := NewNotificationFromEnv()
+
+	s.Equal([]string{"http://consumer/scale"}, n.ScaleServiceAddr)
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_UsesHTTPTransportByDefault() {
+	os.Unsetenv("DF_NOTIFY_TRANSPORT")
+
+	n := NewNotificationFromEnv()
+
+	s.IsType(&HTTPNotifier{}, n.Notifier)
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_FallsBackToHTTPTransport_WhenTransportIsUnknown() {
+	os.Setenv("DF_NOTIFY_TRANSPORT", "carrier-pigeon")
+	defer os.Unsetenv("DF_NOTIFY_TRANSPORT")
+
+	n := NewNotificationFromEnv()
+
+	s.IsType(&HTTPNotifier{}, n.Notifier)
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SendsThroughSelectedTransport() {
+	sent := false
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = true
+	}))
+	defer httpSrv.Close()
+	os.Setenv("DF_NOTIFY_TRANSPORT", "NOOP")
+	defer os.Unsetenv("DF_NOTIFY_TRANSPORT")
+	os.Setenv("DF_NOTIFY_REMOVE_SERVICE_URL", httpSrv.URL)
+	defer os.Unsetenv("DF_NOTIFY_REMOVE_SERVICE_URL")
+	ss := (*s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil))[0]
+
+	n := NewNotificationFromEnv()
+	err := n.ServicesRemove(&[]string{ss.ID}, 1, 0)
+
+	s.NoError(err)
+	s.Require().IsType(&NoopNotifier{}, n.Notifier)
+	s.Equal([]string{httpSrv.URL + "?distribute=true&serviceName=" + ss.Spec.Name}, n.Notifier.(*NoopNotifier).Sent)
+	s.False(sent)
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_SendsRequestsOverUnixSocket() {
+	dir, err := ioutil.TempDir("", "notification")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "consumer.sock")
+	listener, err := net.Listen("unix", socket)
+	s.Require().NoError(err)
+	actualPath := ""
+	actualQuery := ""
+	httpSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualPath = r.URL.Path
+		actualQuery = r.URL.RawQuery
+	}))
+	httpSrv.Listener = listener
+	httpSrv.Start()
+	defer httpSrv.Close()
+	os.Setenv("DF_NOTIFY_REMOVE_SERVICE_URL", "unix://"+socket+":/v1/remove")
+	defer os.Unsetenv("DF_NOTIFY_REMOVE_SERVICE_URL")
+	ss := (*s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil))[0]
+
+	n := NewNotificationFromEnv()
+	err = n.ServicesRemove(&[]string{ss.ID}, 1, 0)
+
+	s.NoError(err)
+	s.Equal("/v1/remove", actualPath)
+	s.Equal("distribute=true&serviceName="+ss.Spec.Name, actualQuery)
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_DropsUnixAddresses_WithoutSocket() {
+	os.Setenv("DF_NOTIFY_CREATE_SERVICE_URL", "unix://consumer/v1/create,unix://,http://consumer/v1/create")
+	defer os.Unsetenv("DF_NOTIFY_CREATE_SERVICE_URL")
+
+	n := NewNotificationFromEnv()
+
+	s.Equal([]string{"http://consumer/v1/create"}, n.CreateServiceAddr)
+}
+
+func (s *NotificationTestSuite) Test_GetNotifyPathAddr_KeepsSocket_WhenAddressIsUnix() {
+	ss := SwarmService{}
+	ss.ID = "my-service-id"
+	ss.Spec.Labels = map[string]string{"com.df.notifyPath": "/v1/{{.ServiceName}}"}
+
+	actual := getNotifyPathAddr(&ss, map[string]string{"serviceName": "my-service"}, []string{"unix:///var/run/consumer.sock:/v1/create"})
+
+	s.Equal([]string{"unix:///var/run/consumer.sock:/v1/my-service"}, actual)
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_TimesOut_WhenConsumerIsSlow() {
+	block := make(chan struct{})
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer httpSrv.Close()
+	defer close(block)
+	os.Setenv("DF_NOTIFY_REMOVE_SERVICE_URL", httpSrv.URL)
+	os.Setenv("DF_NOTIFY_TIMEOUT", "1")
+	defer func() {
+		os.Unsetenv("DF_NOTIFY_REMOVE_SERVICE_URL")
+		os.Unsetenv("DF_NOTIFY_TIMEOUT")
+	}()
+	ss := (*s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil))[0]
+	n := NewNotificationFromEnv()
+
+	done := make(chan error)
+	go func() { done <- n.ServicesRemove(&[]string{ss.ID}, 1, 0) }()
+
+	select {
+	case err := <-done:
+		s.Error(err)
+	case <-time.After(5 * time.Second):
+		s.Fail("the notification should time out rather than hang")
+	}
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_StopsRetrying_WhenContextIsCanceled() {
+	block := make(chan struct{})
+	requests := make(chan string, 10)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.String()
+		<-block
+	}))
+	defer httpSrv.Close()
+	defer close(block)
+	ss := (*s.getSwarmServices(map[string]string{"com.df.notify": "true"}, nil))[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	n := newNotification([]string{}, []string{httpSrv.URL})
+	n.Context = ctx
+
+	done := make(chan error)
+	go func() { done <- n.ServicesRemove(&[]string{ss.ID}, 10, 0) }()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		s.Error(err)
+		s.Len(requests, 1)
+	case <-time.After(5 * time.Second):
+		s.Fail("the notification should be canceled rather than hang")
+	}
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SetsNotifyTimeout() {
+	os.Setenv("DF_NOTIFY_TIMEOUT", "7")
+	defer os.Unsetenv("DF_NOTIFY_TIMEOUT")
+
+	n := NewNotificationFromEnv()
+
+	s.Equal(7*time.Second, n.Timeout)
+	s.Require().IsType(&HTTPNotifier{}, n.Notifier)
+	s.Equal(7*time.Second, n.Notifier.(*HTTPNotifier).Client.Timeout)
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_Panics_WhenValueIsNotANumber() {
+	for _, varName := range []string{"DF_NOTIFY_TIMEOUT", "DF_NOTIFY_READY_TIMEOUT", "DF_RETRY_SPREAD"} {
+		os.Setenv(varName, "five")
+
+		s.Panics(func() { NewNotificationFromEnv() }, varName)
+		os.Unsetenv(varName)
+	}
+	os.Setenv("DF_ERROR_BODY_LIMIT", "five")
+	s.Panics(func() { ReadErrorBodyLimitFromEnv() }, "DF_ERROR_BODY_LIMIT")
+	s.Equal(DEFAULT_ERROR_BODY_LIMIT, ErrorBodyLimit(), "the limit should not be read again when bodies are truncated")
+	os.Unsetenv("DF_ERROR_BODY_LIMIT")
+	os.Setenv("DF_LOG_SUMMARY_INTERVAL", "five")
+	s.Panics(func() { NewLogDeduper() }, "DF_LOG_SUMMARY_INTERVAL")
+	os.Unsetenv("DF_LOG_SUMMARY_INTERVAL")
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_ClampsTimeouts() {
+	defer os.Unsetenv("DF_NOTIFY_TIMEOUT")
+	defer os.Unsetenv("DF_RETRY_SPREAD")
+	os.Setenv("DF_NOTIFY_TIMEOUT", "0")
+	os.Setenv("DF_RETRY_SPREAD", "-3")
+
+	n := NewNotificationFromEnv()
+
+	s.Equal(time.Second, n.Timeout)
+	s.Equal(time.Duration(0), n.RetrySpread)
+}
+
 // ServicesRemove
 
 func (s *NotificationTestSuite) Test_ServicesRemove_SendsRequests() {
@@ -531,6 +1011,208 @@ func (s *NotificationTestSuite) Test_ServicesRemove_ReturnsError_WhenHttpStatusI
 	s.Error(err)
 }
 
+func (s *NotificationTestSuite) Test_ServicesRemove_CapturesResponse_WhenHttpStatusIsNot200() {
+	CachedServices = make(map[string]SwarmService)
+	CachedServices["my-removed-service-1"] = SwarmService{}
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("serviceName is invalid"))
+	}))
+	defer httpSrv.Close()
+	logged := []string{}
+	logPrintfOrig := logPrintf
+	defer func() { logPrintf = logPrintfOrig }()
+	logPrintf = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+
+	n := newNotification([]string{}, []string{httpSrv.URL})
+	err := n.ServicesRemove(&[]string{"my-removed-service-1"}, 1, 0)
+
+	s.Error(err)
+	failures := n.GetFailures()
+	s.Require().Len(failures, 1)
+	s.Equal(http.StatusBadRequest, failures[0].StatusCode)
+	s.Equal("serviceName is invalid", failures[0].Body)
+	s.True(strings.HasPrefix(failures[0].URL, httpSrv.URL))
+	s.Contains(logged, fmt.Sprintf("WARNING: Notification %s to %s was rejected with status code 400: serviceName is invalid", failures[0].RequestID, failures[0].URL))
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_SendsRequestID() {
+	CachedServices = make(map[string]SwarmService)
+	CachedServices["my-removed-service-1"] = SwarmService{}
+	requestID := ""
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-ID")
+	}))
+	defer httpSrv.Close()
+	logged := []string{}
+	logPrintfOrig := logPrintf
+	defer func() { logPrintf = logPrintfOrig }()
+	logPrintf = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+
+	n := newNotification([]string{}, []string{httpSrv.URL})
+	err := n.ServicesRemove(&[]string{"my-removed-service-1"}, 1, 0)
+
+	s.NoError(err)
+	s.NotEmpty(requestID)
+	s.Require().Len(logged, 1)
+	s.True(strings.HasSuffix(logged[0], "with request ID "+requestID))
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_KeepsOnlyRecentFailures() {
+	CachedServices = make(map[string]SwarmService)
+	body := strings.Repeat("x", DEFAULT_ERROR_BODY_LIMIT*2)
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(body))
+	}))
+	defer httpSrv.Close()
+
+	n := newNotification([]string{}, []string{httpSrv.URL})
+	for i := 0; i < maxNotificationFailures+5; i++ {
+		CachedServices["my-removed-service-1"] = SwarmService{}
+		n.ServicesRemove(&[]string{"my-removed-service-1"}, 1, 0)
+	}
+
+	failures := n.GetFailures()
+	s.Len(failures, maxNotificationFailures)
+	s.Len(failures[0].Body, DEFAULT_ERROR_BODY_LIMIT)
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_TruncatesLoggedBody() {
+	CachedServices = map[string]SwarmService{"my-removed-service-1": {}}
+	os.Setenv("DF_ERROR_BODY_LIMIT", "10")
+	ReadErrorBodyLimitFromEnv()
+	defer func() {
+		os.Unsetenv("DF_ERROR_BODY_LIMIT")
+		ReadErrorBodyLimitFromEnv()
+	}()
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer httpSrv.Close()
+	logged := []string{}
+	logPrintfOrig := logPrintf
+	defer func() { logPrintf = logPrintfOrig }()
+	logPrintf = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+
+	n := newNotification([]string{}, []string{httpSrv.URL})
+	n.ServicesRemove(&[]string{"my-removed-service-1"}, 1, 0)
+
+	s.Contains(logged, fmt.Sprintf("WARNING: Notification %s to %s was rejected with status code 400: xxxxxxxxxx...", n.GetFailures()[0].RequestID, n.GetFailures()[0].URL))
+	s.Equal("xxxxxxxxxx", n.GetFailures()[0].Body)
+}
+
+func (s *NotificationTestSuite) Test_ServicesRemove_WaitsRetryAfter_WhenRateLimited() {
+	tests := []struct {
+		retryAfter string
+		minWait    time.Duration
+		maxWait    time.Duration
+	}{
+		{"3", 3 * time.Second, 3 * time.Second},
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+	}
+	for _, t := range tests {
+		CachedServices = make(map[string]SwarmService)
+		CachedServices["my-removed-service-1"] = SwarmService{}
+		requests := 0
+		httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.Header().Set("Retry-After", t.retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		}))
+		waits := []time.Duration{}
+		sleepOrig := sleep
+		sleep = func(d time.Duration) { waits = append(waits, d) }
+
+		n := newNotification([]string{}, []string{httpSrv.URL})
+		err := n.ServicesRemove(&[]string{"my-removed-service-1"}, 2, 1)
+
+		sleep = sleepOrig
+		httpSrv.Close()
+		s.NoError(err)
+		s.Equal(2, requests)
+		if s.Len(waits, 1) {
+			s.True(waits[0] >= t.minWait && waits[0] <= t.maxWait, "unexpected wait %s for Retry-After %s", waits[0], t.retryAfter)
+		}
+	}
+}
+
+func (s *NotificationTestSuite) Test_ServicesCreate_StaggersServicesWithinRetrySpread() {
+	CachedServices = make(map[string]SwarmService)
+	services := []SwarmService{}
+	for i := 1; i <= 10; i++ {
+		ss := SwarmService{Service: swarm.Service{ID: fmt.Sprintf("my-service-%d", i)}}
+		ss.Spec.Name = ss.ID
+		ss.Spec.Labels = map[string]string{"com.df.notify": "true"}
+		CachedServices[ss.ID] = ss
+		services = append(services, ss)
+	}
+	requests := make(chan string, len(services))
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Query().Get("serviceName")
+	}))
+	defer httpSrv.Close()
+	var lock sync.Mutex
+	waits := []time.Duration{}
+	sleepOrig := sleep
+	defer func() { sleep = sleepOrig }()
+	sleep = func(d time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		waits = append(waits, d)
+	}
+	n := newNotification([]string{httpSrv.URL}, []string{})
+	n.RetrySpread = 2 * time.Second
+
+	n.ServicesCreate(&services, 1, 0)
+	for range services {
+		<-requests
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	s.True(len(waits) >= len(services)-1, "each service should be delayed before its first notification")
+	distinct := map[time.Duration]bool{}
+	for _, wait := range waits {
+		s.True(wait >= 0 && wait < n.RetrySpread, "wait %s should be within the retry spread", wait)
+		distinct[wait] = true
+	}
+	s.True(len(distinct) > 1, "notifications of services should not be synchronized")
+}
+
+func (s *NotificationTestSuite) Test_NewNotificationFromEnv_SetsRetrySpread() {
+	os.Setenv("DF_RETRY_SPREAD", "3")
+	defer os.Unsetenv("DF_RETRY_SPREAD")
+
+	n := NewNotificationFromEnv()
+
+	s.Equal(3*time.Second, n.RetrySpread)
+}
+
+func (s *NotificationTestSuite) Test_RetryAfter_ReturnsFalse_WhenNotRateLimited() {
+	notFound := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{"Retry-After": []string{"5"}}}
+	missing := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	invalid := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"soon"}}}
+
+	_, ok := RetryAfter(notFound)
+	s.False(ok)
+	_, ok = RetryAfter(missing)
+	s.False(ok)
+	_, ok = RetryAfter(invalid)
+	s.False(ok)
+	_, ok = RetryAfter(nil)
+	s.False(ok)
+}
+
 func (s *NotificationTestSuite) Test_ServicesRemove_ReturnsError_WhenHttpRequestReturnsError() {
 	CachedServices = make(map[string]SwarmService)
 	n := newNotification([]string{}, []string{"this-does-not-exist"})
@@ -652,3 +1334,22 @@ func (s *NotificationTestSuite) verifyNotifyServiceRemove(expectSent bool, expec
 		s.NotContains(CachedServices, "my-removed-service-1")
 	}
 }
+
+type readinessMock struct {
+	readyAfter int
+	checks     int
+	lock       sync.Mutex
+}
+
+func (m *readinessMock) IsReady(s SwarmService) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checks++
+	return m.checks >= m.readyAfter, nil
+}
+
+func (m *readinessMock) getChecks() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.checks
+}
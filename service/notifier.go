@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_NOTIFY_TRANSPORT is the transport used when `DF_NOTIFY_TRANSPORT` is not set
+const DEFAULT_NOTIFY_TRANSPORT = "http"
+
+// UNIX_SCHEME is the scheme of notification addresses served on a Unix domain socket,
+// e.g. `unix:///var/run/consumer.sock:/v1/reconfigure`. The request path follows the socket path after a colon.
+const UNIX_SCHEME = "unix"
+
+// Notifier delivers a single notification request. The request is abandoned when ctx is canceled.
+// The returned response drives the retries of the notification, the caller closes its body.
+type Notifier interface {
+	Send(ctx context.Context, fullURL, requestID string) (*http.Response, error)
+}
+
+// notifierFactories holds the transports that can be selected with `DF_NOTIFY_TRANSPORT`.
+// New transports are added by registering a factory.
+var notifierFactories = map[string]func() Notifier{
+	"http": func() Notifier { return NewHTTPNotifier() },
+	"noop": func() Notifier { return &NoopNotifier{} },
+}
+
+// HTTPNotifier sends notifications as GET requests.
+// Requests to `unix://` addresses are sent over the Unix domain socket of the address.
+type HTTPNotifier struct {
+	Client      *http.Client
+	unixClients map[string]*http.Client
+	lock        sync.Mutex
+}
+
+// NewHTTPNotifier returns a notifier that routes requests through the proxy set with `DF_HTTP_PROXY`
+func NewHTTPNotifier() *HTTPNotifier {
+	return &HTTPNotifier{Client: &http.Client{Transport: &http.Transport{Proxy: ProxyFromEnv()}}}
+}
+
+// Send sends a notification request tagged with the request ID
+func (n *HTTPNotifier) Send(ctx context.Context, fullURL, requestID string) (*http.Response, error) {
+	client := n.Client
+	if urlObj, err := url.Parse(fullURL); err == nil && urlObj.Scheme == UNIX_SCHEME {
+		socket, path := splitUnixPath(urlObj.Path)
+		client = n.unixClient(socket)
+		fullURL = (&url.URL{Scheme: "http", Host: UNIX_SCHEME, Path: path, RawQuery: urlObj.RawQuery}).String()
+	}
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(REQUEST_ID_HEADER, requestID)
+	return client.Do(req.WithContext(ctx))
+}
+
+// unixClient returns the client dialing the socket, with the timeout of Client.
+// Clients are reused so that connections are kept alive.
+func (n *HTTPNotifier) unixClient(socket string) *http.Client {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.unixClients == nil {
+		n.unixClients = map[string]*http.Client{}
+	}
+	client, ok := n.unixClients[socket]
+	if !ok {
+		client = &http.Client{
+			Timeout: n.Client.Timeout,
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		}
+		n.unixClients[socket] = client
+	}
+	return client
+}
+
+// splitUnixPath returns the socket and the request path of the path of a `unix://` address.
+// The request path defaults to `/`.
+func splitUnixPath(p string) (socket, path string) {
+	parts := strings.SplitN(p, ":", 2)
+	if len(parts) < 2 || len(parts[1]) == 0 {
+		return parts[0], "/"
+	}
+	return parts[0], parts[1]
+}
+
+// checkUnixAddrs logs the addresses served on Unix domain sockets and drops those without a socket
+func checkUnixAddrs(addrs []string) []string {
+	checked := []string{}
+	for _, addr := range addrs {
+		if urlObj, err := url.Parse(addr); err == nil && urlObj.Scheme == UNIX_SCHEME {
+			socket, path := splitUnixPath(urlObj.Path)
+			if len(urlObj.Host) > 0 || len(socket) == 0 {
+				logPrintf("ERROR: Notification address %s does not name a socket, e.g. unix:///var/run/consumer.sock:/path", addr)
+				continue
+			}
+			logPrintf("Notifications to %s are sent to %s over the socket %s", addr, path, socket)
+		}
+		checked = append(checked, addr)
+	}
+	return checked
+}
+
+// NoopNotifier accepts every notification without sending it.
+// The URLs it was asked to send are kept in Sent.
+type NoopNotifier struct {
+	Sent []string
+	lock sync.Mutex
+}
+
+// Send records the notification and reports it as accepted
+func (n *NoopNotifier) Send(ctx context.Context, fullURL, requestID string) (*http.Response, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.Sent = append(n.Sent, fullURL)
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+// NotifierFromEnv returns the transport selected with `DF_NOTIFY_TRANSPORT`.
+// It falls back to the HTTP transport when the variable is not set or unknown.
+func NotifierFromEnv() Notifier {
+	transport := strings.ToLower(strings.TrimSpace(os.Getenv("DF_NOTIFY_TRANSPORT")))
+	if len(transport) == 0 {
+		transport = DEFAULT_NOTIFY_TRANSPORT
+	}
+	factory, ok := notifierFactories[transport]
+	if !ok {
+		logPrintf("ERROR: Unknown notification transport %s, using %s", transport, DEFAULT_NOTIFY_TRANSPORT)
+		factory = notifierFactories[DEFAULT_NOTIFY_TRANSPORT]
+	}
+	return factory()
+}
@@ -4,4 +4,7 @@ package service
 type Sender interface {
 	ServicesCreate(services *[]SwarmService, retries, interval int) error
 	ServicesRemove(services *[]string, retries, interval int) error
+	ServicesNotify(services *[]SwarmService, retries, interval int) []NotificationResult
+	ServicesScale(changes []ScaleChange, retries, interval int) error
+	GetFailures() []NotificationFailure
 }
@@ -3,30 +3,85 @@ package service
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 	"golang.org/x/net/context"
 )
 
-// CachedServices stores the information about services processed by the system
+// CachedServices stores the information about services processed by the system.
+// Notifications and the HTTP server read it from other goroutines, so it is accessed through the functions below.
 var CachedServices map[string]SwarmService
+var cachedServicesLock sync.RWMutex
+
+// GetCachedService returns the cached service with the ID
+func GetCachedService(id string) (SwarmService, bool) {
+	cachedServicesLock.RLock()
+	defer cachedServicesLock.RUnlock()
+	s, ok := CachedServices[id]
+	return s, ok
+}
+
+// GetCachedServices returns a copy of the cached services by ID
+func GetCachedServices() map[string]SwarmService {
+	cachedServicesLock.RLock()
+	defer cachedServicesLock.RUnlock()
+	services := make(map[string]SwarmService, len(CachedServices))
+	for id, s := range CachedServices {
+		services[id] = s
+	}
+	return services
+}
+
+func cacheService(s SwarmService) {
+	cachedServicesLock.Lock()
+	defer cachedServicesLock.Unlock()
+	CachedServices[s.ID] = s
+}
+
+func uncacheService(id string) {
+	cachedServicesLock.Lock()
+	defer cachedServicesLock.Unlock()
+	delete(CachedServices, id)
+}
+
+func resetCachedServices() {
+	cachedServicesLock.Lock()
+	defer cachedServicesLock.Unlock()
+	CachedServices = make(map[string]SwarmService)
+}
 
 // Service defines the based structure
 type Service struct {
 	Host                 string
 	ServiceLastUpdatedAt time.Time
 	DockerClient         *client.Client
+	DefaultLabels        map[string]string
+	IncludeNetwork       string
+	includedNetwork      []string
+	networkLock          sync.Mutex
+	errorLog             *LogDeduper
 }
 
 // Servicer defines interface with mandatory methods
 type Servicer interface {
 	GetServices() (*[]SwarmService, error)
 	GetNewServices(services *[]SwarmService) (*[]SwarmService, error)
+	GetServicesFromID(serviceID string) (*[]SwarmService, error)
 	GetServicesParameters(services *[]SwarmService) *[]map[string]string
+	ClearCache()
+}
+
+// ClearCache forgets processed services so that the next services are treated as new
+func (m *Service) ClearCache() {
+	resetCachedServices()
+	m.ServiceLastUpdatedAt = time.Time{}
 }
 
 // GetServicesParameters returns parameters extracted from labels associated with input services
@@ -41,21 +96,32 @@ func (m *Service) GetServicesParameters(services *[]SwarmService) *[]map[string]
 	return &params
 }
 
-// GetServices returns all services running in the cluster
+// GetServices returns all services running in the cluster.
+// Docker lists only services with the notify label, unless a default label sets it.
 func (m *Service) GetServices() (*[]SwarmService, error) {
 	filter := filters.NewArgs()
-	filter.Add("label", fmt.Sprintf("%s=true", os.Getenv("DF_NOTIFY_LABEL")))
+	notifyLabel := os.Getenv("DF_NOTIFY_LABEL")
+	if _, ok := m.DefaultLabels[notifyLabel]; !ok {
+		filter.Add("label", fmt.Sprintf("%s=true", notifyLabel))
+	}
 	services, err := m.DockerClient.ServiceList(
 		context.Background(),
 		types.ServiceListOptions{Filters: filter},
 	)
 	if err != nil {
-		logPrintf(err.Error())
+		m.errorLog.Printf("%s", err.Error())
 		return &[]SwarmService{}, err
 	}
+	m.errorLog.Reset()
+	network := m.getIncludedNetwork()
 	swarmServices := []SwarmService{}
 	for _, s := range services {
 		ss := SwarmService{s, nil}
+		//Default labels apply before filtering, so that services can rely on them to be routed
+		m.applyDefaultLabels(&ss)
+		if ok, _ := ShouldRoute(ss, network); !ok {
+			continue
+		}
 		if strings.EqualFold(os.Getenv("DF_INCLUDE_NODE_IP_INFO"), "true") {
 			ss.NodeInfo = m.getNodeInfo(ss)
 		}
@@ -71,7 +137,7 @@ func (m *Service) GetNewServices(services *[]SwarmService) (*[]SwarmService, err
 	for _, s := range *services {
 		if tmpUpdatedAt.Nanosecond() == 0 || s.Meta.UpdatedAt.After(tmpUpdatedAt) {
 			updated := false
-			if service, ok := CachedServices[s.ID]; ok {
+			if service, ok := GetCachedService(s.ID); ok {
 				if m.isUpdated(s, service) {
 					updated = true
 				}
@@ -80,7 +146,7 @@ func (m *Service) GetNewServices(services *[]SwarmService) (*[]SwarmService, err
 			}
 			if updated {
 				newServices = append(newServices, s)
-				CachedServices[s.ID] = s
+				cacheService(s)
 				if m.ServiceLastUpdatedAt.Before(s.Meta.UpdatedAt) {
 					m.ServiceLastUpdatedAt = s.Meta.UpdatedAt
 				}
@@ -90,6 +156,81 @@ func (m *Service) GetNewServices(services *[]SwarmService) (*[]SwarmService, err
 	return &newServices, nil
 }
 
+// GetScaleChanges returns the services whose number of replicas differs from the cached service.
+// It must be called before the services are cached by GetNewServices.
+func GetScaleChanges(services *[]SwarmService) []ScaleChange {
+	changes := []ScaleChange{}
+	for _, s := range *services {
+		cached, ok := GetCachedService(s.ID)
+		if !ok || s.Spec.Mode.Replicated == nil || cached.Spec.Mode.Replicated == nil {
+			continue
+		}
+		//The number of replicas is not set in every valid spec
+		if s.Spec.Mode.Replicated.Replicas == nil || cached.Spec.Mode.Replicated.Replicas == nil {
+			continue
+		}
+		replicas := *s.Spec.Mode.Replicated.Replicas
+		previousReplicas := *cached.Spec.Mode.Replicated.Replicas
+		if replicas != previousReplicas {
+			changes = append(changes, ScaleChange{
+				ServiceID:        s.ID,
+				ServiceName:      s.Spec.Name,
+				Replicas:         replicas,
+				PreviousReplicas: previousReplicas,
+			})
+		}
+	}
+	return changes
+}
+
+// MIN_REPLICAS_LABEL is the label with the number of running tasks a service needs before it is notified and routed
+const MIN_REPLICAS_LABEL = "com.df.minReplicas"
+
+// TaskCounter counts the running tasks of a service
+type TaskCounter interface {
+	RunningTasks(s SwarmService) (int, error)
+}
+
+// GetMinReplicas returns the number of running tasks set with the `com.df.minReplicas` label.
+// It returns 0 when the label is not set or is not a positive number.
+func GetMinReplicas(s SwarmService) int {
+	value, ok := s.Spec.Labels[Label(MIN_REPLICAS_LABEL)]
+	if !ok {
+		return 0
+	}
+	minReplicas, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || minReplicas < 0 {
+		logPrintf("WARNING: Invalid %s label %q of the service %s is ignored", Label(MIN_REPLICAS_LABEL), value, s.Spec.Name)
+		return 0
+	}
+	return minReplicas
+}
+
+// IsReady returns true when the service has at least one running task
+func (m *Service) IsReady(s SwarmService) (bool, error) {
+	running, err := m.RunningTasks(s)
+	return running > 0, err
+}
+
+// RunningTasks returns the number of running tasks of the service
+func (m *Service) RunningTasks(s SwarmService) (int, error) {
+	filter := filters.NewArgs()
+	filter.Add("desired-state", "running")
+	filter.Add("service", s.ID)
+	taskList, err := m.DockerClient.TaskList(
+		context.Background(), types.TaskListOptions{Filters: filter})
+	if err != nil {
+		return 0, err
+	}
+	running := 0
+	for _, task := range taskList {
+		if task.Status.State == swarm.TaskStateRunning {
+			running++
+		}
+	}
+	return running, nil
+}
+
 // GetServicesFromID returns service associated with serviceID
 func (m *Service) GetServicesFromID(serviceID string) (*[]SwarmService, error) {
 	filter := filters.NewArgs()
@@ -103,9 +244,15 @@ func (m *Service) GetServicesFromID(serviceID string) (*[]SwarmService, error) {
 		return &[]SwarmService{}, err
 	}
 
+	network := m.getIncludedNetwork()
 	swarmServices := []SwarmService{}
 	for _, s := range services {
 		ss := SwarmService{s, nil}
+		//Default labels apply before filtering, so that services can rely on them to be routed
+		m.applyDefaultLabels(&ss)
+		if ok, _ := ShouldRoute(ss, network); !ok {
+			continue
+		}
 		if strings.EqualFold(os.Getenv("DF_INCLUDE_NODE_IP_INFO"), "true") {
 			ss.NodeInfo = m.getNodeInfo(ss)
 		}
@@ -114,6 +261,39 @@ func (m *Service) GetServicesFromID(serviceID string) (*[]SwarmService, error) {
 	return &swarmServices, nil
 }
 
+// ServiceLookup finds services by their ID
+type ServiceLookup interface {
+	GetServicesFromID(serviceID string) (*[]SwarmService, error)
+}
+
+// SplitPersisted splits services queued for removal into the ones that are gone and the ones whose ID still exists.
+// A service whose ID still exists was updated rather than removed, e.g. when an update hid it from Docker for a cycle.
+// The cache of such services is refreshed so that they are not notified again as new services.
+// Services that cannot be looked up are treated as removed.
+func SplitPersisted(lookup ServiceLookup, serviceIDs []string) ([]string, []SwarmService) {
+	removed := []string{}
+	persisted := []SwarmService{}
+	for _, id := range serviceIDs {
+		services, err := lookup.GetServicesFromID(id)
+		found := false
+		if err == nil {
+			for _, s := range *services {
+				// The ID filter of Docker matches prefixes
+				if s.ID == id {
+					persisted = append(persisted, s)
+					cacheService(s)
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			removed = append(removed, id)
+		}
+	}
+	return removed, persisted
+}
+
 // NewService returns a new instance of the `Service` structure
 func NewService(host string) *Service {
 	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
@@ -121,11 +301,16 @@ func NewService(host string) *Service {
 	if err != nil {
 		logPrintf(err.Error())
 	}
-	CachedServices = make(map[string]SwarmService)
-	return &Service{
-		Host:         host,
-		DockerClient: dc,
+	resetCachedServices()
+	s := &Service{
+		Host:           host,
+		DockerClient:   dc,
+		DefaultLabels:  parseKeyValuePairs(os.Getenv("DF_DEFAULT_LABELS"), "default label"),
+		IncludeNetwork: os.Getenv("DF_INCLUDE_NETWORK"),
+		errorLog:       NewLogDeduper(),
 	}
+	s.getIncludedNetwork()
+	return s
 }
 
 // NewServiceFromEnv returns a new instance of the `Service` structure using environment variable `DF_DOCKER_HOST` for the host
@@ -137,9 +322,25 @@ func NewServiceFromEnv() *Service {
 	return NewService(host)
 }
 
+// applyDefaultLabels adds the labels set with `DF_DEFAULT_LABELS` that the service does not set itself
+func (m *Service) applyDefaultLabels(s *SwarmService) {
+	if len(m.DefaultLabels) == 0 {
+		return
+	}
+	labels := map[string]string{}
+	for k, v := range m.DefaultLabels {
+		labels[k] = v
+	}
+	for k, v := range s.Spec.Labels {
+		labels[k] = v
+	}
+	s.Spec.Labels = labels
+}
+
 func (m *Service) isUpdated(candidate SwarmService, cached SwarmService) bool {
+	prefix := LabelPrefix()
 	for k, v := range candidate.Spec.Labels {
-		if strings.HasPrefix(k, "com.df.") {
+		if strings.HasPrefix(k, prefix) {
 			if storedValue, ok := cached.Spec.Labels[k]; !ok || v != storedValue {
 				return true
 			}
@@ -166,6 +367,50 @@ func (m *Service) isUpdated(candidate SwarmService, cached SwarmService) bool {
 	return false
 }
 
+// getIncludedNetwork returns the name and the ID of the network set through `DF_INCLUDE_NETWORK`.
+// It returns nil when services are not filtered by network.
+// The ID is looked up once, when the service is created. While Docker cannot return it,
+// only the name is matched and the lookup is repeated.
+func (m *Service) getIncludedNetwork() []string {
+	m.networkLock.Lock()
+	defer m.networkLock.Unlock()
+	if len(m.IncludeNetwork) == 0 {
+		return nil
+	}
+	if m.includedNetwork != nil {
+		return m.includedNetwork
+	}
+	resource, err := m.DockerClient.NetworkInspect(context.Background(), m.IncludeNetwork)
+	if err != nil {
+		logPrintf("Could not inspect network %s: %s", m.IncludeNetwork, err.Error())
+		return []string{m.IncludeNetwork}
+	}
+	m.includedNetwork = []string{m.IncludeNetwork, resource.ID}
+	return m.includedNetwork
+}
+
+// isOnNetwork returns true when the service is attached to a network with one of the given names or IDs
+func isOnNetwork(s SwarmService, network []string) bool {
+	targets := []string{}
+	for _, n := range s.Spec.TaskTemplate.Networks {
+		targets = append(targets, n.Target)
+	}
+	for _, n := range s.Spec.Networks {
+		targets = append(targets, n.Target)
+	}
+	for _, vip := range s.Endpoint.VirtualIPs {
+		targets = append(targets, vip.NetworkID)
+	}
+	for _, t := range targets {
+		for _, n := range network {
+			if t == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (m *Service) getNodeInfo(s SwarmService) *NodeIPSet {
 
 	nodeInfo := NodeIPSet{}
@@ -178,7 +423,7 @@ func (m *Service) getNodeInfo(s SwarmService) *NodeIPSet {
 		return nil
 	}
 
-	networkName, ok := s.Spec.Labels["com.df.scrapeNetwork"]
+	networkName, ok := s.Spec.Labels[Label("com.df.scrapeNetwork")]
 	if !ok {
 		return nil
 	}
@@ -2,8 +2,11 @@ package service
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -427,6 +430,82 @@ func (s *ServiceTestSuite) Test_GetServicesParameters_IgnoresThoseScaledToZero()
 	s.Equal(&expected, paramsList)
 }
 
+// isOnNetwork
+
+func (s *ServiceTestSuite) Test_IsOnNetwork_ReturnsTrue_WhenServiceIsAttachedToNetwork() {
+	public := SwarmService{Service: swarm.Service{Spec: swarm.ServiceSpec{
+		TaskTemplate: swarm.TaskSpec{Networks: []swarm.NetworkAttachmentConfig{{Target: "public-id"}}},
+	}}}
+	deprecated := SwarmService{Service: swarm.Service{Spec: swarm.ServiceSpec{
+		Networks: []swarm.NetworkAttachmentConfig{{Target: "public"}},
+	}}}
+	endpoint := SwarmService{Service: swarm.Service{Endpoint: swarm.Endpoint{
+		VirtualIPs: []swarm.EndpointVirtualIP{{NetworkID: "public-id", Addr: "10.0.0.2/24"}},
+	}}}
+
+	s.True(isOnNetwork(public, []string{"public", "public-id"}))
+	s.True(isOnNetwork(deprecated, []string{"public", "public-id"}))
+	s.True(isOnNetwork(endpoint, []string{"public", "public-id"}))
+}
+
+func (s *ServiceTestSuite) Test_IsOnNetwork_ReturnsFalse_WhenServiceIsAttachedToOtherNetworks() {
+	internal := SwarmService{Service: swarm.Service{Spec: swarm.ServiceSpec{
+		TaskTemplate: swarm.TaskSpec{Networks: []swarm.NetworkAttachmentConfig{{Target: "internal-id"}}},
+	}}}
+	detached := SwarmService{Service: swarm.Service{}}
+
+	s.False(isOnNetwork(internal, []string{"public", "public-id"}))
+	s.False(isOnNetwork(detached, []string{"public", "public-id"}))
+}
+
+func (s *ServiceTestSuite) Test_GetServices_ReturnsOnlyServicesOnIncludedNetwork() {
+	inspects := 0
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/networks/public"):
+			inspects++
+			w.Write([]byte(`{"Name":"public","Id":"public-id"}`))
+		case strings.HasSuffix(r.URL.Path, "/services"):
+			w.Write([]byte(`[
+				{"ID":"public-service-id","Spec":{"Labels":{"com.df.notify":"true"},"TaskTemplate":{"Networks":[{"Target":"public-id"}]}}},
+				{"ID":"internal-service-id","Spec":{"Labels":{"com.df.notify":"true"},"TaskTemplate":{"Networks":[{"Target":"internal-id"}]}}}
+			]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer dockerSrv.Close()
+	defer os.Unsetenv("DF_INCLUDE_NETWORK")
+	os.Setenv("DF_INCLUDE_NETWORK", "public")
+	service := NewService(strings.Replace(dockerSrv.URL, "http://", "tcp://", 1))
+
+	service.GetServices()
+	services, err := service.GetServices()
+
+	s.NoError(err)
+	s.Require().Len(*services, 1)
+	s.Equal("public-service-id", (*services)[0].ID)
+	s.Equal(1, inspects, "the network should be looked up once")
+}
+
+func (s *ServiceTestSuite) Test_GetServices_AppliesDefaultLabelsBeforeFiltering() {
+	filtersParams := []string{}
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filtersParams = append(filtersParams, r.URL.Query().Get("filters"))
+		w.Write([]byte(`[{"ID":"unlabeled-service-id","Spec":{"Name":"unlabeled-service"}}]`))
+	}))
+	defer dockerSrv.Close()
+	service := NewService(strings.Replace(dockerSrv.URL, "http://", "tcp://", 1))
+	service.DefaultLabels = map[string]string{"com.df.notify": "true"}
+
+	services, err := service.GetServices()
+
+	s.NoError(err)
+	s.Equal([]string{""}, filtersParams, "services should not be filtered by the notify label a default label sets")
+	s.Require().Len(*services, 1)
+	s.Equal("true", (*services)[0].Spec.Labels["com.df.notify"])
+}
+
 // NewService
 
 func (s *ServiceTestSuite) Test_NewService_SetsHost() {
@@ -437,6 +516,161 @@ func (s *ServiceTestSuite) Test_NewService_SetsHost() {
 	s.Equal(expected, service.Host)
 }
 
+func (s *ServiceTestSuite) Test_NewService_SetsDefaultLabelsFromEnv() {
+	defer os.Unsetenv("DF_DEFAULT_LABELS")
+	os.Setenv("DF_DEFAULT_LABELS", "com.df.env=prod, com.df.team=web")
+
+	service := NewService("this-is-a-host")
+
+	s.Equal(map[string]string{"com.df.env": "prod", "com.df.team": "web"}, service.DefaultLabels)
+}
+
+// applyDefaultLabels
+
+func (s *ServiceTestSuite) Test_ApplyDefaultLabels_AddsLabelsToNotificationParameters() {
+	service := NewService("unix:///var/run/docker.sock")
+	service.DefaultLabels = map[string]string{"com.df.env": "prod", "com.df.team": "web"}
+	replicas := uint64(1)
+	srv := swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "demo",
+				Labels: map[string]string{
+					"com.df.notify":      "true",
+					"com.df.servicePath": "/demo",
+					"com.df.env":         "staging",
+				},
+			},
+			Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		},
+	}
+	ss := SwarmService{srv, nil}
+
+	service.applyDefaultLabels(&ss)
+
+	s.Equal("staging", ss.Spec.Labels["com.df.env"], "labels of the service should take precedence")
+	s.Equal("web", ss.Spec.Labels["com.df.team"])
+	s.Equal("prod", service.DefaultLabels["com.df.env"], "default labels should not be changed")
+	params := service.GetServicesParameters(&[]SwarmService{ss})
+	s.Equal("staging", (*params)[0]["env"])
+	s.Equal("web", (*params)[0]["team"])
+}
+
+// ShouldRoute
+
+func (s *ServiceTestSuite) Test_ShouldRoute_ExclusionTakesPrecedence() {
+	tests := []struct {
+		name        string
+		notifyLabel string
+		labels      map[string]string
+		network     []string
+		expected    bool
+		reason      string
+	}{
+		{"notify label", "com.df.notify", map[string]string{"com.df.notify": "true"}, nil, true, ""},
+		{"notify label without value", "com.df.notify", map[string]string{"com.df.notify": ""}, nil, true, ""},
+		{"notify label and path", "com.df.notify", map[string]string{"com.df.notify": "TRUE", "com.df.servicePath": "/demo"}, nil, true, ""},
+		{"path without notify label", "com.df.notify", map[string]string{"com.df.servicePath": "/demo"}, nil, false, "it does not have the com.df.notify label"},
+		{"notify label of any value", "com.df.notify", map[string]string{"com.df.notify": "false", "com.df.servicePath": "/demo"}, nil, true, ""},
+		{"no notify label required", "", map[string]string{"com.df.servicePath": "/demo"}, nil, true, ""},
+		{"notify label on included network", "com.df.notify", map[string]string{"com.df.notify": "true"}, []string{"public", "public-id"}, true, ""},
+		{"notify label on other network", "com.df.notify", map[string]string{"com.df.notify": "true"}, []string{"internal", "internal-id"}, false, "it is not attached to the network internal"},
+		{"path without notify label on included network", "com.df.notify", map[string]string{"com.df.servicePath": "/demo"}, []string{"public", "public-id"}, false, "it does not have the com.df.notify label"},
+		{"path without notify label on other network", "com.df.notify", map[string]string{"com.df.servicePath": "/demo"}, []string{"internal", "internal-id"}, false, "it is not attached to the network internal"},
+	}
+	defer os.Setenv("DF_NOTIFY_LABEL", os.Getenv("DF_NOTIFY_LABEL"))
+	for _, t := range tests {
+		os.Setenv("DF_NOTIFY_LABEL", t.notifyLabel)
+		ss := SwarmService{}
+		ss.Spec.Labels = t.labels
+		ss.Spec.TaskTemplate.Networks = []swarm.NetworkAttachmentConfig{{Target: "public-id"}}
+
+		actual, reason := ShouldRoute(ss, t.network)
+
+		s.Equal(t.expected, actual, t.name)
+		s.Equal(t.reason, reason, t.name)
+	}
+}
+
+func (s *ServiceTestSuite) Test_ShouldRoutePath_ExclusionTakesPrecedence() {
+	tests := []struct {
+		name     string
+		path     string
+		include  *regexp.Regexp
+		exclude  []string
+		expected bool
+		reason   string
+	}{
+		{"path", "/demo", nil, nil, true, ""},
+		{"wildcard path", "/api/*", nil, nil, true, ""},
+		{"malformed wildcard", "/api/*/users", nil, nil, false, "a wildcard is only allowed at the end of a path, e.g. /api/*"},
+		{"malformed wildcard matching include", "*", regexp.MustCompile(".*"), nil, false, "a wildcard is only allowed at the end of a path, e.g. /api/*"},
+		{"included path", "/api/users", regexp.MustCompile("^/api/"), nil, true, ""},
+		{"path not matching include", "/demo", regexp.MustCompile("^/api/"), nil, false, "it does not match ^/api/"},
+		{"excluded path", "/metrics", nil, []string{"/metrics"}, false, "it matches the excluded path /metrics"},
+		{"excluded path matching include", "/api/internal/health", regexp.MustCompile("^/api/"), []string{"/api/internal/*"}, false, "it matches the excluded path /api/internal/*"},
+		{"path matching include and not excluded", "/api/users", regexp.MustCompile("^/api/"), []string{"/api/internal/*"}, true, ""},
+	}
+	for _, t := range tests {
+		actual, reason := ShouldRoutePath(t.path, t.include, t.exclude)
+
+		s.Equal(t.expected, actual, t.name)
+		s.Equal(t.reason, reason, t.name)
+	}
+}
+
+// GetScaleChanges
+
+func (s *ServiceTestSuite) Test_GetScaleChanges_SkipsServices_WhenReplicasAreNotSet() {
+	cachedOrig := CachedServices
+	defer func() { CachedServices = cachedOrig }()
+	three := uint64(3)
+	cached := SwarmService{}
+	cached.ID = "my-service-id"
+	cached.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &three}
+	CachedServices = map[string]SwarmService{cached.ID: cached}
+	current := SwarmService{}
+	current.ID = cached.ID
+	current.Spec.Mode.Replicated = &swarm.ReplicatedService{}
+
+	s.NotPanics(func() {
+		s.Empty(GetScaleChanges(&[]SwarmService{current}))
+	})
+	CachedServices = map[string]SwarmService{cached.ID: current}
+	s.NotPanics(func() {
+		s.Empty(GetScaleChanges(&[]SwarmService{cached}))
+	})
+}
+
+// GetMinReplicas
+
+func (s *ServiceTestSuite) Test_GetMinReplicas_ReturnsLabelValue() {
+	tests := []struct {
+		labels   map[string]string
+		expected int
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{"com.df.minReplicas": "2"}, 2},
+		{map[string]string{"com.df.minReplicas": "two"}, 0},
+		{map[string]string{"com.df.minReplicas": "-1"}, 0},
+	}
+	for _, t := range tests {
+		ss := SwarmService{}
+		ss.Spec.Labels = t.labels
+
+		s.Equal(t.expected, GetMinReplicas(ss), "labels %v", t.labels)
+	}
+}
+
+func (s *ServiceTestSuite) Test_GetMinReplicas_ReadsLabelWithPrefix() {
+	os.Setenv("DF_LABEL_PREFIX", "com.example.")
+	defer os.Unsetenv("DF_LABEL_PREFIX")
+	ss := SwarmService{}
+	ss.Spec.Labels = map[string]string{"com.example.minReplicas": "3", "com.df.minReplicas": "2"}
+
+	s.Equal(3, GetMinReplicas(ss))
+}
+
 // NewServiceFromEnv
 
 func (s *ServiceTestSuite) Test_NewServiceFromEnv_SetsHost() {
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// UNSYNCED_TARGET_BIGIP is the target of services whose BigIp routes could not be updated
+const UNSYNCED_TARGET_BIGIP = "bigip"
+
+// Unsynced stores the services that are out of sync with a notification address or BigIp
+var Unsynced = NewUnsyncedServices()
+
+// UnsyncedService is a service whose last update of a target failed after all retries
+type UnsyncedService struct {
+	ServiceID string    `json:"serviceId"`
+	Target    string    `json:"target"`
+	Reason    string    `json:"reason"`
+	Since     time.Time `json:"since"`
+}
+
+// UnsyncedServices is a set of unsynced services. It is safe for concurrent use.
+type UnsyncedServices struct {
+	services map[string]UnsyncedService
+	lock     sync.Mutex
+}
+
+// NewUnsyncedServices returns an empty set of unsynced services
+func NewUnsyncedServices() *UnsyncedServices {
+	return &UnsyncedServices{services: map[string]UnsyncedService{}}
+}
+
+// Add marks the service as out of sync with the target.
+// The time it got out of sync is kept when it already was.
+func (u *UnsyncedServices) Add(serviceID, target, reason string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	key := serviceID + " " + target
+	since := time.Now()
+	if current, ok := u.services[key]; ok {
+		since = current.Since
+	}
+	u.services[key] = UnsyncedService{ServiceID: serviceID, Target: target, Reason: reason, Since: since}
+}
+
+// Remove marks the service as in sync with the target
+func (u *UnsyncedServices) Remove(serviceID, target string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.services, serviceID+" "+target)
+}
+
+// RemoveService forgets every target the service is out of sync with, e.g. once it is removed
+func (u *UnsyncedServices) RemoveService(serviceID string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for key, s := range u.services {
+		if s.ServiceID == serviceID {
+			delete(u.services, key)
+		}
+	}
+}
+
+// List returns the unsynced services sorted by service ID and target
+func (u *UnsyncedServices) List() []UnsyncedService {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	services := []UnsyncedService{}
+	for _, s := range u.services {
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].ServiceID != services[j].ServiceID {
+			return services[i].ServiceID < services[j].ServiceID
+		}
+		return services[i].Target < services[j].Target
+	})
+	return services
+}
@@ -1,16 +1,82 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// REQUEST_ID_HEADER is the header carrying the ID that correlates outgoing requests with log lines
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// DEFAULT_ERROR_BODY_LIMIT is the number of response body bytes logged with errors
+const DEFAULT_ERROR_BODY_LIMIT = 512
+
+// DEFAULT_LABEL_PREFIX is the prefix of the service labels read by the listener
+const DEFAULT_LABEL_PREFIX = "com.df."
+
+// UNBOUNDED is the upper bound of numeric settings without a maximum
+const UNBOUNDED = int(^uint(0) >> 1)
+
 var logPrintf = log.Printf
+var errorBodyLimit = DEFAULT_ERROR_BODY_LIMIT
+var sleep = time.Sleep
 var dockerApiVersion string = "v1.22"
 
+// GetValueInRange returns the number of the environment variable, or defValue when it is not set.
+// Numbers outside of min and max are clamped with a warning.
+// A value that is not a number is a misconfiguration, so it panics rather than falling back silently.
+func GetValueInRange(defValue, min, max int, varName string) int {
+	raw := strings.TrimSpace(os.Getenv(varName))
+	if len(raw) == 0 {
+		return defValue
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		panic(fmt.Errorf("%s must be a whole number, got %s", varName, raw))
+	}
+	if value < min {
+		logPrintf("WARNING: %s of %d is below the minimum of %d. %d is used instead", varName, value, min, min)
+		return min
+	}
+	if value > max {
+		logPrintf("WARNING: %s of %d is above the maximum of %d. %d is used instead", varName, value, max, max)
+		return max
+	}
+	return value
+}
+
+// GetFloatValueInRange is GetValueInRange for fractional numbers
+func GetFloatValueInRange(defValue, min, max float64, varName string) float64 {
+	raw := strings.TrimSpace(os.Getenv(varName))
+	if len(raw) == 0 {
+		return defValue
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		panic(fmt.Errorf("%s must be a number, got %s", varName, raw))
+	}
+	if value < min {
+		logPrintf("WARNING: %s of %g is below the minimum of %g. %g is used instead", varName, value, min, min)
+		return min
+	}
+	if value > max {
+		logPrintf("WARNING: %s of %g is above the maximum of %g. %g is used instead", varName, value, max, max)
+		return max
+	}
+	return value
+}
+
 func getSenderAddressesFromEnvVars(catchAllType, senderType, altSenderType string) (createServiceAddr, removeServiceAddr []string) {
 	catchAllVarName := fmt.Sprintf("DF_%s_URL", strings.ToUpper(catchAllType))
 	createVarName := fmt.Sprintf("DF_%s_CREATE_SERVICE_URL", strings.ToUpper(senderType))
@@ -34,20 +100,194 @@ func getSenderAddressesFromEnvVars(catchAllType, senderType, altSenderType strin
 	return createServiceAddr, removeServiceAddr
 }
 
+// ProxyFromEnv returns the proxy used for outbound requests.
+// `DF_HTTP_PROXY` takes precedence over the standard `HTTP_PROXY` and `HTTPS_PROXY` variables.
+func ProxyFromEnv() func(*http.Request) (*url.URL, error) {
+	if len(os.Getenv("DF_HTTP_PROXY")) > 0 {
+		proxyURL, err := url.Parse(os.Getenv("DF_HTTP_PROXY"))
+		if err == nil {
+			return http.ProxyURL(proxyURL)
+		}
+		logPrintf("ERROR: Unable to parse DF_HTTP_PROXY: %s", err.Error())
+	}
+	return http.ProxyFromEnvironment
+}
+
+// NewRequestID returns a random ID used to trace an outgoing request across services
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// RetryAfter returns how long to wait before retrying a rate-limited (429) response.
+// The `Retry-After` header can be either a number of seconds or an HTTP-date.
+// It returns false when the response is not rate-limited or the header is missing or invalid.
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	wait := time.Until(date)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// waitBeforeRetry waits for the interval (in seconds) or, for rate-limited responses, as long as `Retry-After` asks
+func waitBeforeRetry(resp *http.Response, interval int) {
+	wait := time.Second * time.Duration(interval)
+	if retryAfter, ok := RetryAfter(resp); ok {
+		logPrintf("Request was rate-limited. Retrying in %s", retryAfter)
+		wait = retryAfter
+	}
+	if wait > 0 {
+		sleep(wait)
+	}
+}
+
+// ReadErrorBodyLimitFromEnv reads `DF_ERROR_BODY_LIMIT` once at startup, so that an invalid value stops the listener
+// rather than failing requests whose errors are logged
+func ReadErrorBodyLimitFromEnv() {
+	errorBodyLimit = GetValueInRange(DEFAULT_ERROR_BODY_LIMIT, 1, UNBOUNDED, "DF_ERROR_BODY_LIMIT")
+}
+
+// ErrorBodyLimit returns the number of response body bytes logged with errors.
+// It can be changed with `DF_ERROR_BODY_LIMIT`.
+func ErrorBodyLimit() int {
+	return errorBodyLimit
+}
+
+// TruncateBody returns the response body cut to the error body limit, with an ellipsis when it was cut
+func TruncateBody(body []byte) string {
+	limit := ErrorBodyLimit()
+	if len(body) <= limit {
+		return string(body)
+	}
+	return string(body[:limit]) + "..."
+}
+
+// LabelPrefix returns the prefix of the service labels read by the listener.
+// It can be changed with `DF_LABEL_PREFIX`.
+func LabelPrefix() string {
+	if prefix := os.Getenv("DF_LABEL_PREFIX"); len(prefix) > 0 {
+		return prefix
+	}
+	return DEFAULT_LABEL_PREFIX
+}
+
+// Label returns the key of a label with the default prefix replaced by the configured one
+func Label(key string) string {
+	return LabelPrefix() + strings.TrimPrefix(key, DEFAULT_LABEL_PREFIX)
+}
+
+// parseKeyValuePairs returns the comma-separated `key=value` pairs. Invalid pairs are logged and ignored.
+func parseKeyValuePairs(spec, description string) map[string]string {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			logPrintf("WARNING: Invalid %s %s is ignored", description, pair)
+			continue
+		}
+		pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return pairs
+}
+
+// ShouldRoute tells whether consumers are notified of the service and its BigIp routes are added.
+// When they are not, the reason is returned for logging.
+// Exclusions take precedence over inclusions:
+//  1. A service that is not attached to the network is excluded, whatever its labels.
+//  2. A service without the `DF_NOTIFY_LABEL` label is excluded, even with path labels.
+//  3. A service with the `DF_NOTIFY_LABEL` label is included. Without `DF_NOTIFY_LABEL`, no label is required.
+//
+// The network holds the name and the ID of `DF_INCLUDE_NETWORK`. It is nil when services are not filtered by network
+// or were already filtered when they were listed.
+// The paths of a routed service are then checked one by one with ShouldRoutePath.
+func ShouldRoute(s SwarmService, network []string) (bool, string) {
+	if network != nil && !isOnNetwork(s, network) {
+		return false, fmt.Sprintf("it is not attached to the network %s", network[0])
+	}
+	notifyLabel := os.Getenv("DF_NOTIFY_LABEL")
+	if len(notifyLabel) == 0 {
+		return true, ""
+	}
+	if _, ok := s.Spec.Labels[notifyLabel]; !ok {
+		return false, fmt.Sprintf("it does not have the %s label", notifyLabel)
+	}
+	return true, ""
+}
+
+// ShouldRoutePath tells whether a path of a routed service is added to BigIp.
+// When it is not, the reason is returned for logging. Exclusions take precedence over inclusions:
+//  1. A malformed wildcard is excluded. A wildcard is only allowed at the end of a path.
+//  2. A path matching any of the excluded paths is excluded, even when it matches the include pattern.
+//  3. A path that does not match the include pattern is excluded. Without a pattern, every path is included.
+func ShouldRoutePath(p string, include *regexp.Regexp, exclude []string) (bool, string) {
+	if !isValidWildcard(p) {
+		return false, "a wildcard is only allowed at the end of a path, e.g. /api/*"
+	}
+	if pattern, ok := matchesAny(exclude, p); ok {
+		return false, fmt.Sprintf("it matches the excluded path %s", pattern)
+	}
+	if include != nil && !include.MatchString(p) {
+		return false, fmt.Sprintf("it does not match %s", include.String())
+	}
+	return true, ""
+}
+
+// Returns true when the path has no wildcard or a single `*` at its end after a prefix, e.g. `/api/*` or `/api*`.
+// Wildcard paths are written to the data group as they are and BigIp matches requests against them.
+func isValidWildcard(p string) bool {
+	i := strings.Index(p, "*")
+	return i < 0 || (i > 0 && i == len(p)-1)
+}
+
+func matchesAny(patterns []string, candidate string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, candidate); (err == nil && matched) || pattern == candidate {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
 func getServiceParams(s *SwarmService) map[string]string {
 	params := map[string]string{}
 	// if _, ok := s.Spec.Labels[os.Getenv("DF_NOTIFY_LABEL")]; ok {
 	if _, ok := s.Spec.Labels[os.Getenv("DF_NOTIFY_LABEL")]; ok && !hasZeroReplicas(s) {
 		serviceName := s.Spec.Name
 		stackName := s.Spec.Labels["com.docker.stack.namespace"]
-		if len(stackName) > 0 && strings.EqualFold(s.Spec.Labels["com.df.shortName"], "true") {
+		if len(stackName) > 0 && strings.EqualFold(s.Spec.Labels[Label("com.df.shortName")], "true") {
 			serviceName = strings.TrimPrefix(serviceName, stackName+"_")
 		}
 		params["serviceName"] = serviceName
 
+		prefix := LabelPrefix()
 		for k, v := range s.Spec.Labels {
-			if strings.HasPrefix(k, "com.df") && k != os.Getenv("DF_NOTIFY_LABEL") {
-				params[strings.TrimPrefix(k, "com.df.")] = v
+			if strings.HasPrefix(k, prefix) && k != os.Getenv("DF_NOTIFY_LABEL") {
+				params[strings.TrimPrefix(k, prefix)] = v
 			}
 		}
 		if s.Service.Spec.Mode.Replicated != nil {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"./service"
+)
+
+// servicesFileEntry is a service as it is written to the file set with `DF_SERVICES_FILE`
+type servicesFileEntry struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Paths  []string          `json:"paths,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// getServicesFileEntries returns the services sorted by name.
+// Only the labels with the listener label prefix are kept.
+func getServicesFileEntries(services map[string]service.SwarmService) []servicesFileEntry {
+	delimiter := os.Getenv("DF_PATH_DELIMITER")
+	if len(delimiter) == 0 {
+		delimiter = PATH_DELIMITER
+	}
+	entries := []servicesFileEntry{}
+	for id, s := range services {
+		entry := servicesFileEntry{ID: id, Name: s.Spec.Name, Labels: map[string]string{}}
+		for k, v := range s.Spec.Labels {
+			if strings.HasPrefix(k, service.LabelPrefix()) {
+				entry.Labels[k] = v
+			}
+		}
+		if label, ok := s.Spec.Labels[service.Label(SERVICE_PATH_LABEL)]; ok && len(label) > 0 {
+			entry.Paths = strings.Split(label, delimiter)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// writeServicesFile writes the services to the file as JSON.
+// The content is written to a temporary file first and renamed, so readers never see a partial file.
+func writeServicesFile(file string, services map[string]service.SwarmService) error {
+	content, err := json.Marshal(getServicesFileEntries(services))
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"./metrics"
+	"./service"
+)
+
+// StandbyBigIp applies every route change to a primary and a standby BigIp.
+// It keeps BigIp pairs that do not sync data groups consistent.
+// Standby failures are only logged unless StandbyRequired is set.
+type StandbyBigIp struct {
+	Primary         *BigIp
+	Standby         *BigIp
+	StandbyRequired bool
+}
+
+// NewBigIpClientFromEnv returns the BigIp configured with `DF_CONFIG_API`.
+// When `DF_CONFIG_API_STANDBY` is set, updates are also applied to the standby BigIp.
+func NewBigIpClientFromEnv() BigIpClient {
+	primary := NewBigIpFromEnv()
+	standbyApi := os.Getenv("DF_CONFIG_API_STANDBY")
+	if len(standbyApi) == 0 {
+		return primary
+	}
+	cacheFile := ""
+	if len(primary.CacheFile) > 0 {
+		cacheFile = primary.CacheFile + ".standby"
+	}
+	return &StandbyBigIp{
+		Primary:         primary,
+		Standby:         newBigIpFromEnv(standbyApi, cacheFile),
+		StandbyRequired: strings.EqualFold(os.Getenv("DF_BIGIP_STANDBY_REQUIRED"), "true"),
+	}
+}
+
+func (b *StandbyBigIp) AddRoutes(services *[]service.SwarmService) error {
+	return b.apply(func(bigIp *BigIp) error { return bigIp.AddRoutes(services) })
+}
+
+func (b *StandbyBigIp) RemoveRoutes(services *[]string) error {
+	return b.apply(func(bigIp *BigIp) error { return bigIp.RemoveRoutes(services) })
+}
+
+func (b *StandbyBigIp) Reconcile(added *[]service.SwarmService, removed *[]string) error {
+	return b.apply(func(bigIp *BigIp) error { return bigIp.Reconcile(added, removed) })
+}
+
+func (b *StandbyBigIp) RemovePathRecords(paths []string) error {
+	return b.apply(func(bigIp *BigIp) error { return bigIp.RemovePathRecords(paths) })
+}
+
+func (b *StandbyBigIp) RefreshConfig() error {
+	return b.apply(func(bigIp *BigIp) error { return bigIp.RefreshConfig() })
+}
+
+// GetRoutes returns the routes of the primary BigIp
+func (b *StandbyBigIp) GetRoutes() map[string]ServiceRoutes {
+	return b.Primary.GetRoutes()
+}
+
+// GetDrift compares the data groups of the primary BigIp with its routes
+func (b *StandbyBigIp) GetDrift() ([]DataGroupDrift, error) {
+	return b.Primary.GetDrift()
+}
+
+// ClearRoutes empties the route caches of both BigIps
+func (b *StandbyBigIp) ClearRoutes() {
+	b.Primary.ClearRoutes()
+	b.Standby.ClearRoutes()
+}
+
+// Applies the change to the primary and then the standby BigIp.
+// The error of the primary is returned, or the error of the standby when it is required.
+func (b *StandbyBigIp) apply(change func(bigIp *BigIp) error) error {
+	err := change(b.Primary)
+	if standbyErr := change(b.Standby); standbyErr != nil {
+		log.Printf("WARNING: Updating standby BigIp %s failed: %s", b.Standby.Host, standbyErr.Error())
+		metrics.RecordError("StandbyBigIp")
+		if b.StandbyRequired && err == nil {
+			return standbyErr
+		}
+	}
+	return err
+}
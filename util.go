@@ -1,5 +1,24 @@
 package main
 
-import "log"
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SECRETS_DIR is the directory secrets are mounted to when `DF_SECRETS_DIR` is not set
+const SECRETS_DIR = "/run/secrets"
 
 var logPrintf = log.Printf
+var sleep = time.Sleep
+
+// getSecretFile returns the path of the secret file with the given name.
+// The file is resolved from `DF_SECRETS_DIR`, defaulting to `/run/secrets`.
+func getSecretFile(name string) string {
+	dir := os.Getenv("DF_SECRETS_DIR")
+	if len(dir) == 0 {
+		dir = SECRETS_DIR
+	}
+	return filepath.Join(dir, name)
+}
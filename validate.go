@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Exit codes of the validate-only mode. Each class of failure has its own code.
+const (
+	EXIT_OK                     = 0
+	EXIT_FAILURE                = 1
+	EXIT_CONFIG_UNREACHABLE     = 2
+	EXIT_KEY_UNREADABLE         = 3
+	EXIT_BIGIP_AUTH_FAILED      = 4
+	EXIT_DATA_GROUP_UNREACHABLE = 5
+)
+
+type validationResult struct {
+	Check string
+	Err   error
+}
+
+// configUnreachableError is returned when the config API could not be read
+type configUnreachableError struct {
+	err error
+}
+
+func (e *configUnreachableError) Error() string {
+	return e.err.Error()
+}
+
+// keyUnreadableError is returned when the BigIp key file could not be read
+type keyUnreadableError struct {
+	err error
+}
+
+func (e *keyUnreadableError) Error() string {
+	return e.err.Error()
+}
+
+// dataGroupUnreachableError is returned when the data group did not respond for reasons other than authorization
+type dataGroupUnreachableError struct {
+	err error
+}
+
+func (e *dataGroupUnreachableError) Error() string {
+	return e.err.Error()
+}
+
+// validate checks that the config API is reachable, the key file loads and the data group responds
+func validate(configApi, keyFile string) []validationResult {
+	results := []validationResult{}
+	config, configErr := fetchConfig(configApi, getConfigApiTimeoutFromEnv())
+	if configErr != nil {
+		configErr = &configUnreachableError{err: configErr}
+	}
+	results = append(results, validationResult{Check: fmt.Sprintf("Config API %s", configApi), Err: configErr})
+	key, keyErr := readKey(keyFile)
+	if keyErr != nil {
+		keyErr = &keyUnreadableError{err: keyErr}
+	}
+	results = append(results, validationResult{Check: fmt.Sprintf("Key file %s", keyFile), Err: keyErr})
+	if configErr != nil || keyErr != nil {
+		results = append(results, validationResult{Check: "Data group", Err: fmt.Errorf("Skipped since config or key could not be loaded")})
+		return results
+	}
+	b := newBigIp(config, key)
+	pingErr := b.Ping()
+	if _, ok := pingErr.(*bigIpAuthError); pingErr != nil && !ok {
+		pingErr = &dataGroupUnreachableError{err: pingErr}
+	}
+	results = append(results, validationResult{Check: fmt.Sprintf("Data group %s", b.Url), Err: pingErr})
+	return results
+}
+
+// validationError returns the error of the first failed check, or nil when all checks passed
+func validationError(results []validationResult) error {
+	for _, r := range results {
+		if r.Err != nil {
+			return r.Err
+		}
+	}
+	return nil
+}
+
+// exitCode maps an error to the exit code of its failure class
+func exitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return EXIT_OK
+	case *configUnreachableError:
+		return EXIT_CONFIG_UNREACHABLE
+	case *keyUnreadableError:
+		return EXIT_KEY_UNREADABLE
+	case *bigIpAuthError:
+		return EXIT_BIGIP_AUTH_FAILED
+	case *dataGroupUnreachableError:
+		return EXIT_DATA_GROUP_UNREACHABLE
+	default:
+		return EXIT_FAILURE
+	}
+}
+
+// writeValidationReport writes a pass/fail line per check and returns true when all checks passed
+func writeValidationReport(w io.Writer, results []validationResult) bool {
+	passed := true
+	for _, r := range results {
+		if r.Err != nil {
+			passed = false
+			fmt.Fprintf(w, "FAIL: %s: %s\n", r.Check, r.Err.Error())
+		} else {
+			fmt.Fprintf(w, "PASS: %s\n", r.Check)
+		}
+	}
+	return passed
+}
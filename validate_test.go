@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ValidateTestSuite struct {
+	suite.Suite
+	keyFile string
+}
+
+func TestValidateUnitTestSuite(t *testing.T) {
+	s := new(ValidateTestSuite)
+	suite.Run(t, s)
+}
+
+func (s *ValidateTestSuite) SetupSuite() {
+	os.MkdirAll("/tmp/secrets", 0755)
+	s.keyFile = "/tmp/secrets/bigip-validate-key"
+	ioutil.WriteFile(s.keyFile, []byte("test-key-value"), 0755)
+}
+
+func (s *ValidateTestSuite) Test_Validate_ReportsPass() {
+	bigIpSrv := goodServer(DG, []byte(`{"records":[]}`))
+	defer bigIpSrv.Close()
+	configSrv := configServer(bigIpSrv.URL, DG, PATTERN, "service")
+	defer configSrv.Close()
+	out := bytes.Buffer{}
+
+	passed := writeValidationReport(&out, validate(configSrv.URL, s.keyFile))
+
+	s.True(passed)
+	s.Equal(3, strings.Count(out.String(), "PASS: "))
+	s.NotContains(out.String(), "FAIL: ")
+}
+
+func (s *ValidateTestSuite) Test_Validate_ReportsFail_WhenDataGroupIsNotReachable() {
+	bigIpSrv := badServer()
+	defer bigIpSrv.Close()
+	configSrv := configServer(bigIpSrv.URL, DG, PATTERN, "service")
+	defer configSrv.Close()
+	out := bytes.Buffer{}
+
+	results := validate(configSrv.URL, s.keyFile)
+	passed := writeValidationReport(&out, results)
+
+	s.False(passed)
+	s.Equal(2, strings.Count(out.String(), "PASS: "))
+	s.Contains(out.String(), "FAIL: Data group")
+	s.Equal(EXIT_DATA_GROUP_UNREACHABLE, exitCode(validationError(results)))
+}
+
+func (s *ValidateTestSuite) Test_Validate_ReportsFail_WhenKeyFileIsMissing() {
+	configSrv := configServer("http://localhost", DG, PATTERN, "service")
+	defer configSrv.Close()
+	out := bytes.Buffer{}
+
+	results := validate(configSrv.URL, "/tmp/secrets/does-not-exist")
+	passed := writeValidationReport(&out, results)
+
+	s.False(passed)
+	s.Contains(out.String(), "FAIL: Key file")
+	s.Contains(out.String(), "FAIL: Data group")
+	s.Equal(EXIT_KEY_UNREADABLE, exitCode(validationError(results)))
+}
+
+func (s *ValidateTestSuite) Test_Validate_ReturnsAuthError_WhenKeyIsRejected() {
+	bigIpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer bigIpSrv.Close()
+	configSrv := configServer(bigIpSrv.URL, DG, PATTERN, "service")
+	defer configSrv.Close()
+
+	err := validationError(validate(configSrv.URL, s.keyFile))
+
+	s.Equal(EXIT_BIGIP_AUTH_FAILED, exitCode(err))
+}
+
+func (s *ValidateTestSuite) Test_Validate_ReturnsConfigError_WhenConfigApiIsNotReachable() {
+	configSrv := badServer()
+	defer configSrv.Close()
+
+	err := validationError(validate(configSrv.URL, s.keyFile))
+
+	s.Equal(EXIT_CONFIG_UNREACHABLE, exitCode(err))
+}
+
+func (s *ValidateTestSuite) Test_ExitCode_MapsErrorsToFailureClasses() {
+	cause := fmt.Errorf("cause")
+	cases := []struct {
+		err      error
+		expected int
+	}{
+		{nil, EXIT_OK},
+		{cause, EXIT_FAILURE},
+		{&configUnreachableError{err: cause}, EXIT_CONFIG_UNREACHABLE},
+		{&keyUnreadableError{err: cause}, EXIT_KEY_UNREADABLE},
+		{&bigIpAuthError{url: "http://bigip", statusCode: http.StatusForbidden}, EXIT_BIGIP_AUTH_FAILED},
+		{&dataGroupUnreachableError{err: cause}, EXIT_DATA_GROUP_UNREACHABLE},
+	}
+
+	for _, c := range cases {
+		s.Equal(c.expected, exitCode(c.err), "%v", c.err)
+	}
+}